@@ -0,0 +1,610 @@
+package tencloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/3van/go-querystring/query"
+	"github.com/3van/tencloud-go"
+)
+
+// apiVersions holds the API version to send for modules that tcapi doesn't
+// version itself. Modules that aren't listed here are either versioned by
+// tcapi (cvm, image) or only speak the legacy API.
+var apiVersions = map[string]string{
+	"cam": "2019-01-16",
+	"sts": "2018-08-13",
+	"tag": "2018-08-13",
+	"vpc": "2017-03-12",
+}
+
+// apiParams wraps an action's request so the common parameters tcapi doesn't
+// know about can be sent alongside it.
+type apiParams struct {
+	Version string `url:",omitempty"`
+	Token   string `url:",omitempty"`
+	Params  apiRequest
+}
+
+type apiRequest struct {
+	req interface{}
+}
+
+func (r apiRequest) EncodeValues(_ string, v *url.Values) error {
+	if r.req == nil {
+		return nil
+	}
+	values, err := query.Values(r.req)
+	if err != nil {
+		return err
+	}
+	for k, vals := range values {
+		for _, val := range vals {
+			v.Add(k, val)
+		}
+	}
+	return nil
+}
+
+// callAPI performs an API action that tcapi has no wrapper for, decoding the
+// response into resp if it is non-nil.
+func callAPI(tc *tcapi.Client, module, action string, req, resp interface{}) error {
+	return callAPIWithToken(tc, "", module, action, req, resp)
+}
+
+// callAPIWithToken is callAPI for clients holding temporary credentials,
+// which must be accompanied by their security token.
+func callAPIWithToken(tc *tcapi.Client, token, module, action string, req, resp interface{}) error {
+	params := &apiParams{
+		Version: apiVersions[module],
+		Token:   token,
+		Params:  apiRequest{req},
+	}
+
+	raw, err := tc.Do(module, action, params)
+	if err != nil {
+		return fmt.Errorf("[%s:%s] request failed: %s", module, action, err)
+	}
+
+	// tcapi only unwraps responses for the modules it versions itself
+	if params.Version != "" {
+		v3Resp := new(tcapi.V3BaseResponse)
+		if err := json.Unmarshal(*raw, v3Resp); err != nil || v3Resp.Response == nil {
+			return fmt.Errorf("[%s:%s] response unmarshal failed: %v", module, action, err)
+		}
+		errResp := new(tcapi.V3ErrorResponse)
+		if err := json.Unmarshal(*v3Resp.Response, errResp); err != nil {
+			return fmt.Errorf("[%s:%s] response unmarshal failed: %s", module, action, err)
+		}
+		if errResp.Error.Code != "" {
+			return fmt.Errorf("[%s:%s] request failed: API returned an error (%v - %s): %s", module, action, errResp.Error.Code, errResp.Error.CodeDesc, errResp.Error.Message)
+		}
+		raw = v3Resp.Response
+	}
+
+	if resp == nil {
+		return nil
+	}
+	if err := json.Unmarshal(*raw, resp); err != nil {
+		return fmt.Errorf("[%s:%s] response unmarshal failed: %s", module, action, err)
+	}
+
+	return nil
+}
+
+// retryableCodes are the API error codes a call is worth retrying after
+var retryableCodes = []string{
+	"InternalError",
+	"RequestLimitExceeded",
+	"ResourceUnavailable",
+	"ResourceBusy",
+	"MutexOperation",
+}
+
+// isUnsupportedAction reports whether err is the API not knowing the action
+// called, as in regions it hasn't reached yet
+func isUnsupportedAction(err error) bool {
+	return strings.Contains(err.Error(), "InvalidAction")
+}
+
+// isRetryable reports whether a failed call may succeed if it's made again.
+// API errors are only retried if they're transient, anything else, like a
+// timeout, always is.
+func isRetryable(err error) bool {
+	msg := err.Error()
+	i := strings.Index(msg, "API returned an error (")
+	if i < 0 {
+		return true
+	}
+	code := msg[i+len("API returned an error ("):]
+	for _, c := range retryableCodes {
+		if strings.HasPrefix(code, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientToken returns the idempotency token for one create call of a build,
+// so a retry of a call that succeeded without us hearing back doesn't create
+// the resource twice
+func clientToken(buildUUID, call string) string {
+	token := fmt.Sprintf("%s-%s", buildUUID, call)
+	if len(token) > 64 {
+		token = token[:64]
+	}
+	return token
+}
+
+type exportImagesRequest struct {
+	BucketName         string   `json:",omitempty" url:",omitempty"`
+	ImageIds           []string `json:",omitempty" url:",omitempty,dotnumbered"`
+	ExportFormat       string   `json:",omitempty" url:",omitempty"`
+	FileNamePrefixList []string `json:",omitempty" url:",omitempty,dotnumbered"`
+}
+
+type exportImagesResponse struct {
+	RequestId string   `json:",omitempty" url:",omitempty"`
+	TaskId    int      `json:",omitempty" url:",omitempty"`
+	CosPaths  []string `json:",omitempty" url:",omitempty,dotnumbered"`
+}
+
+func exportImages(tc *tcapi.Client, req *exportImagesRequest) (*exportImagesResponse, error) {
+	resp := new(exportImagesResponse)
+	if err := callAPI(tc, "image", "ExportImages", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+type describeImageExportTasksRequest struct {
+	TaskIds []int `json:",omitempty" url:",omitempty,dotnumbered"`
+}
+
+type imageExportTask struct {
+	TaskId    int
+	TaskState string
+	Message   string
+}
+
+type describeImageExportTasksResponse struct {
+	RequestId string            `json:",omitempty" url:",omitempty"`
+	TaskSet   []imageExportTask `json:",omitempty" url:",omitempty,dotnumbered"`
+}
+
+func describeImageExportTasks(tc *tcapi.Client, req *describeImageExportTasksRequest) (*describeImageExportTasksResponse, error) {
+	resp := new(describeImageExportTasksResponse)
+	if err := callAPI(tc, "image", "DescribeImageExportTasks", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+type importImageRequest struct {
+	Architecture     string             `json:",omitempty" url:",omitempty"`
+	OsType           string             `json:",omitempty" url:",omitempty"`
+	OsVersion        string             `json:",omitempty" url:",omitempty"`
+	ImageUrl         string             `json:",omitempty" url:",omitempty"`
+	ImageName        string             `json:",omitempty" url:",omitempty"`
+	TagSpecification []tagSpecification `json:",omitempty" url:",omitempty,dotnumbered"`
+}
+
+func importImage(tc *tcapi.Client, token string, req *importImageRequest) error {
+	return callAPIWithToken(tc, token, "image", "ImportImage", req, nil)
+}
+
+type assumeRoleRequest struct {
+	RoleArn         string `json:",omitempty" url:",omitempty"`
+	RoleSessionName string `json:",omitempty" url:",omitempty"`
+	DurationSeconds int    `json:",omitempty" url:",omitempty"`
+}
+
+type assumeRoleResponse struct {
+	RequestId   string `json:",omitempty" url:",omitempty"`
+	ExpiredTime int    `json:",omitempty" url:",omitempty"`
+	Credentials struct {
+		Token        string
+		TmpSecretId  string
+		TmpSecretKey string
+	}
+}
+
+// assumeRole returns a client for region that authenticates with temporary
+// credentials for roleArn, along with the security token that every request
+// made with it must carry.
+func assumeRole(tc *tcapi.Client, roleArn, region string) (*tcapi.Client, string, error) {
+	resp := new(assumeRoleResponse)
+	err := callAPI(tc, "sts", "AssumeRole", &assumeRoleRequest{
+		RoleArn:         roleArn,
+		RoleSessionName: "packer-builder-tencloud",
+		DurationSeconds: 7200,
+	}, resp)
+	if err != nil {
+		return nil, "", err
+	}
+
+	roleClient := tc.Copy(region, nil)
+	roleClient.SecretId = resp.Credentials.TmpSecretId
+	roleClient.Secret = resp.Credentials.TmpSecretKey
+	return roleClient, resp.Credentials.Token, nil
+}
+
+type syncImagesRequest struct {
+	ImageIds           []string `json:",omitempty" url:",omitempty,dotnumbered"`
+	DestinationRegions []string `json:",omitempty" url:",omitempty,dotnumbered"`
+	ImageSetRequired   bool     `json:",omitempty" url:",omitempty"`
+}
+
+type syncImage struct {
+	ImageId string
+	Region  string
+}
+
+type syncImagesResponse struct {
+	RequestId string      `json:",omitempty" url:",omitempty"`
+	ImageSet  []syncImage `json:",omitempty" url:",omitempty,dotnumbered"`
+}
+
+// syncImages is tcapi's SyncImages, but asks for and returns the IDs of the
+// copies made in each destination region.
+func syncImages(tc *tcapi.Client, req *syncImagesRequest) (*syncImagesResponse, error) {
+	req.ImageSetRequired = true
+	resp := new(syncImagesResponse)
+	if err := callAPI(tc, "image", "SyncImages", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+type createImageResponse struct {
+	RequestId string `json:",omitempty" url:",omitempty"`
+	ImageId   string `json:",omitempty" url:",omitempty"`
+}
+
+// createImage is tcapi's CreateImage, but returns the new image's ID.
+func createImage(tc *tcapi.Client, req *tcapi.CreateImageRequest) (*createImageResponse, error) {
+	resp := new(createImageResponse)
+	if err := callAPI(tc, "image", "CreateImage", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+type launchTemplate struct {
+	LaunchTemplateId   string
+	LaunchTemplateName string
+}
+
+type describeLaunchTemplatesRequest struct {
+	Offset int `json:",omitempty" url:",omitempty"`
+	Limit  int `json:",omitempty" url:",omitempty"`
+}
+
+type describeLaunchTemplatesResponse struct {
+	RequestId         string           `json:",omitempty" url:",omitempty"`
+	TotalCount        int              `json:",omitempty" url:",omitempty"`
+	LaunchTemplateSet []launchTemplate `json:",omitempty" url:",omitempty,dotnumbered"`
+}
+
+func describeLaunchTemplates(tc *tcapi.Client, req *describeLaunchTemplatesRequest) (*describeLaunchTemplatesResponse, error) {
+	resp := new(describeLaunchTemplatesResponse)
+	if err := callAPI(tc, "cvm", "DescribeLaunchTemplates", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+type launchTemplateVersion struct {
+	LaunchTemplateId          string
+	LaunchTemplateVersion     int
+	LaunchTemplateVersionData struct {
+		ImageId string
+	}
+}
+
+type describeLaunchTemplateVersionsRequest struct {
+	LaunchTemplateId string `json:",omitempty" url:",omitempty"`
+	Offset           int    `json:",omitempty" url:",omitempty"`
+	Limit            int    `json:",omitempty" url:",omitempty"`
+}
+
+type describeLaunchTemplateVersionsResponse struct {
+	RequestId                string                  `json:",omitempty" url:",omitempty"`
+	TotalCount               int                     `json:",omitempty" url:",omitempty"`
+	LaunchTemplateVersionSet []launchTemplateVersion `json:",omitempty" url:",omitempty,dotnumbered"`
+}
+
+func describeLaunchTemplateVersions(tc *tcapi.Client, req *describeLaunchTemplateVersionsRequest) (*describeLaunchTemplateVersionsResponse, error) {
+	resp := new(describeLaunchTemplateVersionsResponse)
+	if err := callAPI(tc, "cvm", "DescribeLaunchTemplateVersions", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+type resourceTag struct {
+	TagKey     string
+	TagValue   string
+	ResourceId string
+}
+
+type describeResourceTagsByResourceIdsRequest struct {
+	ServiceType    string   `json:",omitempty" url:",omitempty"`
+	ResourcePrefix string   `json:",omitempty" url:",omitempty"`
+	ResourceIds    []string `json:",omitempty" url:",omitempty,dotnumbered"`
+	ResourceRegion string   `json:",omitempty" url:",omitempty"`
+	Offset         int      `json:",omitempty" url:",omitempty"`
+	Limit          int      `json:",omitempty" url:",omitempty"`
+}
+
+type describeResourceTagsByResourceIdsResponse struct {
+	RequestId  string        `json:",omitempty" url:",omitempty"`
+	TotalCount int           `json:",omitempty" url:",omitempty"`
+	Tags       []resourceTag `json:",omitempty" url:",omitempty,dotnumbered"`
+}
+
+func describeResourceTagsByResourceIds(tc *tcapi.Client, req *describeResourceTagsByResourceIdsRequest) (*describeResourceTagsByResourceIdsResponse, error) {
+	resp := new(describeResourceTagsByResourceIdsResponse)
+	if err := callAPI(tc, "tag", "DescribeResourceTagsByResourceIds", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+type tag struct {
+	TagKey   string
+	TagValue string
+}
+
+// runInstancesRequest is tcapi's request with the tags to launch with, which
+// it has no field for
+type runInstancesRequest struct {
+	tcapi.RunInstancesRequest
+	TagSpecification []tagSpecification `json:",omitempty" url:",omitempty,dotnumbered"`
+}
+
+type tagSpecification struct {
+	ResourceType string
+	Tags         []cvmTag
+}
+
+type cvmTag struct {
+	Key   string
+	Value string
+}
+
+func runInstances(tc *tcapi.Client, req *runInstancesRequest) (*tcapi.RunInstancesResponse, error) {
+	resp := new(tcapi.RunInstancesResponse)
+	if err := callAPI(tc, "cvm", "RunInstances", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+type tagResourcesRequest struct {
+	ResourceList []string `json:",omitempty" url:",omitempty,dotnumbered"`
+	Tags         []tag    `json:",omitempty" url:",omitempty,dotnumbered"`
+}
+
+func tagResources(tc *tcapi.Client, req *tagResourcesRequest) error {
+	return callAPI(tc, "tag", "TagResources", req, nil)
+}
+
+type getUserAppIdResponse struct {
+	RequestId string `json:",omitempty" url:",omitempty"`
+	Uin       string `json:",omitempty" url:",omitempty"`
+	OwnerUin  string `json:",omitempty" url:",omitempty"`
+	AppId     int    `json:",omitempty" url:",omitempty"`
+}
+
+func getUserAppId(tc *tcapi.Client) (*getUserAppIdResponse, error) {
+	resp := new(getUserAppIdResponse)
+	if err := callAPI(tc, "cam", "GetUserAppId", nil, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+type securityGroup struct {
+	SecurityGroupId   string
+	SecurityGroupName string
+	SecurityGroupDesc string
+	CreatedTime       string
+	TagSet            []securityGroupTag
+}
+
+type securityGroupTag struct {
+	Key   string
+	Value string
+}
+
+type describeSecurityGroupsRequest struct {
+	SecurityGroupIds []string       `json:",omitempty" url:",omitempty,dotnumbered"`
+	Filters          []tcapi.Filter `json:",omitempty" url:",omitempty,dotnumbered"`
+	Offset           string         `json:",omitempty" url:",omitempty"`
+	Limit            string         `json:",omitempty" url:",omitempty"`
+}
+
+type describeSecurityGroupsResponse struct {
+	RequestId        string          `json:",omitempty" url:",omitempty"`
+	TotalCount       int             `json:",omitempty" url:",omitempty"`
+	SecurityGroupSet []securityGroup `json:",omitempty" url:",omitempty,dotnumbered"`
+}
+
+func describeSecurityGroups(tc *tcapi.Client, req *describeSecurityGroupsRequest) (*describeSecurityGroupsResponse, error) {
+	resp := new(describeSecurityGroupsResponse)
+	if err := callAPI(tc, "vpc", "DescribeSecurityGroups", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+type createSecurityGroupRequest struct {
+	GroupName        string `json:",omitempty" url:",omitempty"`
+	GroupDescription string `json:",omitempty" url:",omitempty"`
+	ProjectId        int    `json:",omitempty" url:",omitempty"`
+}
+
+type createSecurityGroupResponse struct {
+	RequestId     string        `json:",omitempty" url:",omitempty"`
+	SecurityGroup securityGroup `json:",omitempty" url:",omitempty"`
+}
+
+func createSecurityGroup(tc *tcapi.Client, req *createSecurityGroupRequest) (*createSecurityGroupResponse, error) {
+	resp := new(createSecurityGroupResponse)
+	if err := callAPI(tc, "vpc", "CreateSecurityGroup", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+type securityGroupPolicy struct {
+	Protocol          string `json:",omitempty" url:",omitempty"`
+	Port              string `json:",omitempty" url:",omitempty"`
+	CidrBlock         string `json:",omitempty" url:",omitempty"`
+	Ipv6CidrBlock     string `json:",omitempty" url:",omitempty"`
+	Action            string `json:",omitempty" url:",omitempty"`
+	PolicyDescription string `json:",omitempty" url:",omitempty"`
+}
+
+type securityGroupPolicySet struct {
+	Ingress []securityGroupPolicy `json:",omitempty" url:",omitempty,dotnumbered"`
+	Egress  []securityGroupPolicy `json:",omitempty" url:",omitempty,dotnumbered"`
+}
+
+type createSecurityGroupPoliciesRequest struct {
+	SecurityGroupId        string                 `json:",omitempty" url:",omitempty"`
+	SecurityGroupPolicySet securityGroupPolicySet `json:",omitempty" url:",omitempty"`
+}
+
+func createSecurityGroupPolicies(tc *tcapi.Client, req *createSecurityGroupPoliciesRequest) error {
+	return callAPI(tc, "vpc", "CreateSecurityGroupPolicies", req, nil)
+}
+
+type deleteSecurityGroupRequest struct {
+	SecurityGroupId string `json:",omitempty" url:",omitempty"`
+}
+
+func deleteSecurityGroup(tc *tcapi.Client, req *deleteSecurityGroupRequest) error {
+	return callAPI(tc, "vpc", "DeleteSecurityGroup", req, nil)
+}
+
+type address struct {
+	AddressId     string
+	AddressIp     string
+	AddressStatus string
+	InstanceId    string
+	CreatedTime   string
+}
+
+type describeAddressesRequest struct {
+	AddressIds []string       `json:",omitempty" url:",omitempty,dotnumbered"`
+	Filters    []tcapi.Filter `json:",omitempty" url:",omitempty,dotnumbered"`
+	Offset     int            `json:",omitempty" url:",omitempty"`
+	Limit      int            `json:",omitempty" url:",omitempty"`
+}
+
+type describeAddressesResponse struct {
+	RequestId  string    `json:",omitempty" url:",omitempty"`
+	TotalCount int       `json:",omitempty" url:",omitempty"`
+	AddressSet []address `json:",omitempty" url:",omitempty,dotnumbered"`
+}
+
+func describeAddresses(tc *tcapi.Client, req *describeAddressesRequest) (*describeAddressesResponse, error) {
+	resp := new(describeAddressesResponse)
+	if err := callAPI(tc, "vpc", "DescribeAddresses", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+type allocateAddressesRequest struct {
+	AddressCount int `json:",omitempty" url:",omitempty"`
+}
+
+type allocateAddressesResponse struct {
+	RequestId  string   `json:",omitempty" url:",omitempty"`
+	AddressSet []string `json:",omitempty" url:",omitempty,dotnumbered"`
+}
+
+func allocateAddresses(tc *tcapi.Client, req *allocateAddressesRequest) (*allocateAddressesResponse, error) {
+	resp := new(allocateAddressesResponse)
+	if err := callAPI(tc, "vpc", "AllocateAddresses", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+type associateAddressRequest struct {
+	AddressId  string `json:",omitempty" url:",omitempty"`
+	InstanceId string `json:",omitempty" url:",omitempty"`
+}
+
+func associateAddress(tc *tcapi.Client, req *associateAddressRequest) error {
+	return callAPI(tc, "vpc", "AssociateAddress", req, nil)
+}
+
+type disassociateAddressRequest struct {
+	AddressId string `json:",omitempty" url:",omitempty"`
+}
+
+func disassociateAddress(tc *tcapi.Client, req *disassociateAddressRequest) error {
+	return callAPI(tc, "vpc", "DisassociateAddress", req, nil)
+}
+
+type releaseAddressesRequest struct {
+	AddressIds []string `json:",omitempty" url:",omitempty,dotnumbered"`
+}
+
+func releaseAddresses(tc *tcapi.Client, req *releaseAddressesRequest) error {
+	return callAPI(tc, "vpc", "ReleaseAddresses", req, nil)
+}
+
+type subnet struct {
+	SubnetId  string
+	VpcId     string
+	CidrBlock string
+}
+
+type describeSubnetsRequest struct {
+	SubnetIds []string `json:",omitempty" url:",omitempty,dotnumbered"`
+}
+
+type describeSubnetsResponse struct {
+	RequestId  string   `json:",omitempty" url:",omitempty"`
+	TotalCount int      `json:",omitempty" url:",omitempty"`
+	SubnetSet  []subnet `json:",omitempty" url:",omitempty,dotnumbered"`
+}
+
+func describeSubnets(tc *tcapi.Client, req *describeSubnetsRequest) (*describeSubnetsResponse, error) {
+	resp := new(describeSubnetsResponse)
+	if err := callAPI(tc, "vpc", "DescribeSubnets", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+type vpc struct {
+	VpcId     string
+	CidrBlock string
+}
+
+type describeVpcsRequest struct {
+	VpcIds []string `json:",omitempty" url:",omitempty,dotnumbered"`
+}
+
+type describeVpcsResponse struct {
+	RequestId  string `json:",omitempty" url:",omitempty"`
+	TotalCount int    `json:",omitempty" url:",omitempty"`
+	VpcSet     []vpc  `json:",omitempty" url:",omitempty,dotnumbered"`
+}
+
+func describeVpcs(tc *tcapi.Client, req *describeVpcsRequest) (*describeVpcsResponse, error) {
+	resp := new(describeVpcsResponse)
+	if err := callAPI(tc, "vpc", "DescribeVpcs", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,262 @@
+package tencloud
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/3van/tencloud-go"
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// fakeAPI answers API calls by action from handlers, returning the value a
+// handler returns as the response or its error as the error code. tcapi
+// clients copied for a region always use http.DefaultClient, so that's
+// where it's installed.
+type fakeAPI struct {
+	mu       sync.Mutex
+	handlers map[string]func(params url.Values) (interface{}, error)
+	calls    map[string]int
+}
+
+// useFakeAPI installs a fakeAPI and returns a client using it, and a func
+// that uninstalls it
+func useFakeAPI(handlers map[string]func(params url.Values) (interface{}, error)) (*fakeAPI, *tcapi.Client, func()) {
+	f := &fakeAPI{
+		handlers: handlers,
+		calls:    make(map[string]int),
+	}
+	transport := http.DefaultClient.Transport
+	http.DefaultClient.Transport = f
+	tc := tcapi.New("AKIDexample", "secret", "ap-guangzhou", nil)
+	return f, tc, func() {
+		http.DefaultClient.Transport = transport
+	}
+}
+
+func (f *fakeAPI) RoundTrip(req *http.Request) (*http.Response, error) {
+	params := req.URL.Query()
+	action := params.Get("Action")
+
+	f.mu.Lock()
+	f.calls[action]++
+	handler := f.handlers[action]
+	f.mu.Unlock()
+
+	var result interface{}
+	err := fmt.Errorf("UnsupportedOperation")
+	if handler != nil {
+		result, err = handler(params)
+	}
+	if err != nil {
+		result = map[string]interface{}{
+			"Error": map[string]string{
+				"Code":    err.Error(),
+				"Message": err.Error(),
+			},
+		}
+	}
+	body, err := json.Marshal(map[string]interface{}{"Response": result})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+// Calls returns how often action was called
+func (f *fakeAPI) Calls(action string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[action]
+}
+
+// paramList returns the values of a list parameter, such as ImageIds.0,
+// ImageIds.1 and so on
+func paramList(params url.Values, name string) []string {
+	list := make([]string, 0)
+	for i := 0; ; i++ {
+		v, ok := params[fmt.Sprintf("%s.%d", name, i)]
+		if !ok {
+			return list
+		}
+		list = append(list, v...)
+	}
+}
+
+// fakeImages is an image service for fakeAPI: it keeps images, with the
+// accounts they're shared with, and refuses to delete images that are still
+// shared, as the real one does. Scaling configurations and launch templates
+// are always empty.
+type fakeImages struct {
+	mu     sync.Mutex
+	images map[string]*fakeImage
+}
+
+type fakeImage struct {
+	tcapi.Image
+	Region string
+	Shared []string
+}
+
+func newFakeImages(images ...*fakeImage) *fakeImages {
+	f := &fakeImages{images: make(map[string]*fakeImage)}
+	for _, image := range images {
+		if image.ImageState == "" {
+			image.ImageState = "NORMAL"
+		}
+		f.images[image.ImageId] = image
+	}
+	return f
+}
+
+// Get returns the image with imageId, or nil once it's deleted
+func (f *fakeImages) Get(imageId string) *fakeImage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.images[imageId]
+}
+
+func (f *fakeImages) handlers() map[string]func(url.Values) (interface{}, error) {
+	return map[string]func(url.Values) (interface{}, error){
+		"DescribeImages": func(params url.Values) (interface{}, error) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			imageIds := paramList(params, "ImageIds")
+			resp := &tcapi.DescribeImagesResponse{}
+			for _, image := range f.images {
+				if image.Region != params.Get("Region") {
+					continue
+				}
+				if len(imageIds) > 0 && !stringInSlice(image.ImageId, imageIds) {
+					continue
+				}
+				resp.ImageSet = append(resp.ImageSet, image.Image)
+			}
+			sort.Slice(resp.ImageSet, func(i, j int) bool {
+				return resp.ImageSet[i].ImageId < resp.ImageSet[j].ImageId
+			})
+			resp.TotalCount = len(resp.ImageSet)
+			return resp, nil
+		},
+		"DescribeImageSharePermission": func(params url.Values) (interface{}, error) {
+			image, err := f.image(params)
+			if err != nil {
+				return nil, err
+			}
+			resp := &tcapi.DescribeImageSharePermissionResponse{}
+			for _, account := range image.Shared {
+				resp.SharePermissionSet = append(resp.SharePermissionSet, tcapi.SharePermission{Account: account})
+			}
+			return resp, nil
+		},
+		"ModifyImageSharePermission": func(params url.Values) (interface{}, error) {
+			image, err := f.image(params)
+			if err != nil {
+				return nil, err
+			}
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			for _, account := range paramList(params, "AccountIds") {
+				switch params.Get("Permission") {
+				case "SHARE":
+					if !stringInSlice(account, image.Shared) {
+						image.Shared = append(image.Shared, account)
+					}
+				case "CANCEL":
+					kept := make([]string, 0, len(image.Shared))
+					for _, shared := range image.Shared {
+						if shared != account {
+							kept = append(kept, shared)
+						}
+					}
+					image.Shared = kept
+				}
+			}
+			return map[string]string{}, nil
+		},
+		"DeleteImages": func(params url.Values) (interface{}, error) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			for _, imageId := range paramList(params, "ImageIds") {
+				image := f.images[imageId]
+				if image == nil || image.Region != params.Get("Region") {
+					return nil, errors.New("InvalidImageId.NotFound")
+				}
+				if len(image.Shared) > 0 {
+					return nil, errors.New("InvalidImageId.InShared")
+				}
+			}
+			for _, imageId := range paramList(params, "ImageIds") {
+				delete(f.images, imageId)
+			}
+			return map[string]string{}, nil
+		},
+		"DescribeLaunchTemplates": func(params url.Values) (interface{}, error) {
+			return map[string]int{"TotalCount": 0}, nil
+		},
+		"DescribeScalingConfiguration": func(params url.Values) (interface{}, error) {
+			return map[string]int{"TotalCount": 0}, nil
+		},
+	}
+}
+
+func (f *fakeImages) image(params url.Values) (*fakeImage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	image := f.images[params.Get("ImageId")]
+	if image == nil || image.Region != params.Get("Region") {
+		return nil, errors.New("InvalidImageId.NotFound")
+	}
+	return image, nil
+}
+
+// testStepState returns the state steps expect, using tc and discarding
+// what's written to the UI
+func testStepState(tc *tcapi.Client) multistep.StateBag {
+	state := new(multistep.BasicStateBag)
+	state.Put("tc", tc)
+	state.Put("ui", &packer.BasicUi{
+		Reader:      new(bytes.Buffer),
+		Writer:      ioutil.Discard,
+		ErrorWriter: ioutil.Discard,
+	})
+	return state
+}
+
+func TestIsRetryable(t *testing.T) {
+	cases := map[string]bool{
+		"[cvm:CreateImage] request failed: Get https://cvm.tencentcloudapi.com/: net/http: timeout":  true,
+		"[cvm:CreateImage] request failed: API returned an error (InternalError - ): oops":           true,
+		"[cvm:CreateImage] request failed: API returned an error (RequestLimitExceeded - ): slow":    true,
+		"[cvm:CreateImage] request failed: API returned an error (InvalidParameter - ): bad name":    false,
+		"[cvm:CreateImage] request failed: API returned an error (AuthFailure.SignatureFailure - ):": false,
+	}
+	for msg, expected := range cases {
+		if got := isRetryable(errors.New(msg)); got != expected {
+			t.Errorf("%q: got %t, expected %t", msg, got, expected)
+		}
+	}
+}
+
+func TestClientToken(t *testing.T) {
+	if a, b := clientToken("uuid", "run-instances"), clientToken("uuid", "run-instances"); a != b {
+		t.Fatalf("tokens differ: %s, %s", a, b)
+	}
+	if token := clientToken(strings.Repeat("x", 60), "run-instances"); len(token) != 64 {
+		t.Fatalf("bad token length: %d", len(token))
+	}
+}
@@ -13,8 +13,16 @@ import (
 
 type Artifact struct {
 	Images         map[string]string
+	Exports        map[string]string
+	AccountImages  map[string]string
+	AccountRoles   map[string]string
 	BuilderIdValue string
 	Session        *tcapi.Client
+
+	// DeleteInUse allows Destroy to delete images that are still referenced
+	DeleteInUse    bool
+	ProtectionTag  string
+	SharedAccounts []string
 }
 
 func (a Artifact) BuilderId() string {
@@ -22,7 +30,15 @@ func (a Artifact) BuilderId() string {
 }
 
 func (a Artifact) Files() []string {
-	return nil
+	if len(a.Exports) == 0 {
+		return nil
+	}
+	files := make([]string, 0, len(a.Exports))
+	for _, url := range a.Exports {
+		files = append(files, url)
+	}
+	sort.Strings(files)
+	return files
 }
 
 func (a Artifact) Id() string {
@@ -40,7 +56,19 @@ func (a Artifact) String() string {
 		parts = append(parts, fmt.Sprintf("%s: %s", region, image))
 	}
 	sort.Strings(parts)
-	return fmt.Sprintf("Images were created:\n%s\n", strings.Join(parts, "\n"))
+	out := fmt.Sprintf("Images were created:\n%s\n", strings.Join(parts, "\n"))
+	if len(a.Exports) > 0 {
+		out += fmt.Sprintf("Images were exported:\n%s\n", strings.Join(a.Files(), "\n"))
+	}
+	if len(a.AccountImages) > 0 {
+		copies := make([]string, 0, len(a.AccountImages))
+		for key, image := range a.AccountImages {
+			copies = append(copies, fmt.Sprintf("%s: %s", key, image))
+		}
+		sort.Strings(copies)
+		out += fmt.Sprintf("Images were delivered to accounts:\n%s\n", strings.Join(copies, "\n"))
+	}
+	return out
 }
 
 func (a Artifact) State(name string) interface{} {
@@ -57,15 +85,43 @@ func (a Artifact) Destroy() error {
 	for region, imageId := range a.Images {
 		log.Printf("deleting image '%s' from region '%s'", imageId, region)
 		thisClient := a.Session.Copy(region, nil)
+		if !a.DeleteInUse {
+			usage, err := findImageUsage(thisClient, []string{imageId}, a.ProtectionTag, a.SharedAccounts)
+			if err != nil {
+				errors = append(errors, err)
+				continue
+			}
+			if err := usage.Err(imageId); err != nil {
+				errors = append(errors, err)
+				continue
+			}
+		}
+		if err := deleteImage(thisClient, imageId); err != nil {
+			errors = append(errors, err)
+		}
+	}
+	for key, imageId := range a.AccountImages {
+		parts := strings.SplitN(key, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		account, region := parts[0], parts[1]
+		log.Printf("deleting image '%s' from region '%s' in account '%s'", imageId, region, account)
+		roleClient, token, err := assumeRole(a.Session, a.AccountRoles[account], region)
+		if err != nil {
+			errors = append(errors, err)
+			continue
+		}
 		req := &tcapi.DeleteImagesRequest{
 			ImageIds: []string{
 				imageId,
 			},
 		}
-		if err := thisClient.DeleteImages(req); err != nil {
+		if err := callAPIWithToken(roleClient, token, "image", "DeleteImages", req, nil); err != nil {
 			errors = append(errors, err)
 		}
 	}
+
 	if len(errors) > 0 {
 		if len(errors) == 1 {
 			return errors[0]
@@ -83,6 +139,14 @@ func (a *Artifact) stateAtlasMetadata() interface{} {
 		k := fmt.Sprintf("region.%s", region)
 		metadata[k] = imageId
 	}
+	for region, url := range a.Exports {
+		k := fmt.Sprintf("export.%s", region)
+		metadata[k] = url
+	}
+	for key, imageId := range a.AccountImages {
+		k := fmt.Sprintf("account.%s", key)
+		metadata[k] = imageId
+	}
 
 	return metadata
 }
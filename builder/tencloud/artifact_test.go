@@ -0,0 +1,52 @@
+package tencloud
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/3van/tencloud-go"
+)
+
+func TestArtifactDestroy_shared(t *testing.T) {
+	cases := []struct {
+		name    string
+		shared  []string
+		deleted bool
+	}{
+		{"shared by the builder", []string{"100"}, true},
+		{"shared by someone else", []string{"100", "200"}, false},
+		{"not shared", nil, true},
+	}
+
+	for _, c := range cases {
+		images := newFakeImages(&fakeImage{
+			Image:  tcapi.Image{ImageId: "img-1"},
+			Region: "ap-shanghai",
+			Shared: c.shared,
+		})
+		_, tc, restore := useFakeAPI(images.handlers())
+		a := Artifact{
+			Images:         map[string]string{"ap-shanghai": "img-1"},
+			Session:        tc,
+			SharedAccounts: []string{"100"},
+		}
+		err := a.Destroy()
+		restore()
+
+		if c.deleted {
+			if err != nil {
+				t.Fatalf("%s: err: %s", c.name, err)
+			}
+			if images.Get("img-1") != nil {
+				t.Fatalf("%s: image should be deleted", c.name)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), "shared with account '200'") {
+			t.Fatalf("%s: bad: %v", c.name, err)
+		}
+		if image := images.Get("img-1"); image == nil || len(image.Shared) != 2 {
+			t.Fatalf("%s: image should be kept as it was: %#v", c.name, image)
+		}
+	}
+}
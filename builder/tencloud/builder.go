@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"log"
 
+	"github.com/3van/tencloud-go"
 	"github.com/hashicorp/packer/common"
+	"github.com/hashicorp/packer/common/uuid"
 	"github.com/hashicorp/packer/helper/communicator"
 	"github.com/hashicorp/packer/helper/config"
 	"github.com/hashicorp/packer/helper/multistep"
@@ -19,6 +21,7 @@ type Config struct {
 	AuthConfig          `mapstructure:",squash"`
 	ImageConfig         `mapstructure:",squash"`
 	RunConfig           `mapstructure:",squash"`
+	TimeoutConfig       `mapstructure:",squash"`
 
 	ctx interpolate.Context
 }
@@ -32,6 +35,11 @@ func (b *Builder) Prepare(rawVars ...interface{}) ([]string, error) {
 	err := config.Decode(&b.config, &config.DecodeOpts{
 		Interpolate:        true,
 		InterpolateContext: &b.config.ctx,
+		InterpolateFilter: &interpolate.RenderFilter{
+			Exclude: []string{
+				"instance_name",
+			},
+		},
 	}, rawVars...)
 	if err != nil {
 		return nil, err
@@ -41,10 +49,40 @@ func (b *Builder) Prepare(rawVars ...interface{}) ([]string, error) {
 		b.config.ForceDeregister = true
 	}
 
+	b.config.RunConfig.buildUUID = uuid.TimeOrderedUUID()
+	var raw interface{}
+	if len(rawVars) > 0 {
+		raw = rawVars[0]
+	}
+	b.config.RunConfig.buildTags = buildMetadataTags(b.config.RunConfig.buildUUID, b.config.PackerBuildName, raw)
+
 	var errs *packer.MultiError
 	errs = packer.MultiErrorAppend(errs, b.config.AuthConfig.Prepare(&b.config.ctx)...)
 	errs = packer.MultiErrorAppend(errs, b.config.ImageConfig.Prepare(&b.config.ctx)...)
 	errs = packer.MultiErrorAppend(errs, b.config.RunConfig.Prepare(&b.config.ctx)...)
+	errs = packer.MultiErrorAppend(errs, b.config.TimeoutConfig.Prepare()...)
+
+	buildRegions := append([]string{b.config.Region}, b.config.ImageRegions...)
+	if len(b.config.ImageExportBuckets) > 0 {
+		for _, region := range buildRegions {
+			if _, ok := b.config.ImageExportBuckets[region]; !ok {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("image_export_buckets has no bucket for region '%s'", region))
+			}
+		}
+	}
+
+	// target account copies are imported from the export in the same region
+	for i := range b.config.ImageTargetAccounts {
+		target := &b.config.ImageTargetAccounts[i]
+		if len(target.Regions) == 0 {
+			target.Regions = buildRegions
+		}
+		for _, region := range target.Regions {
+			if !stringInSlice(region, buildRegions) {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("image_target_accounts: region '%s' for account '%s' is not one of the image regions", region, target.AccountId))
+			}
+		}
+	}
 
 	if errs != nil && len(errs.Errors) > 0 {
 		return nil, errs
@@ -60,12 +98,107 @@ func (b *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packe
 		return nil, err
 	}
 
+	// a resumed build takes over the UUID of the build it picks up from, so
+	// its resources are tagged and journaled as one
+	var resume *ResumePoint
+	if b.config.Resume {
+		ui.Say("looking for a failed build to resume")
+		resume, err = findResumePoint(tc, &b.config)
+		if err != nil {
+			return nil, err
+		}
+		if resume == nil {
+			ui.Message("no failed build to resume, starting a new build")
+		} else {
+			b.config.RunConfig.adoptBuild(resume.BuildUUID)
+		}
+	}
+
 	state := new(multistep.BasicStateBag)
 	state.Put("config", b.config)
 	state.Put("tc", tc)
 	state.Put("hook", hook)
 	state.Put("ui", ui)
 
+	// finish cleaning up after earlier builds of this template that were
+	// killed before they could, then journal this one. Builds of other
+	// templates sharing the journal are left to their own next run or to
+	// cleanup-journal.
+	var journal *Journal
+	if !b.config.DisableCleanupJournal {
+		template := b.config.buildTags[TemplateHashTag]
+		if template != "" {
+			err := ReplayJournal(tc, b.config.CleanupJournal, ui, ReplayOptions{
+				KeepAborted:      true,
+				Skip:             []string{b.config.BuildUUID()},
+				Template:         template,
+				TerminateTimeout: b.config.InstanceTerminateTimeout,
+			})
+			if err != nil {
+				ui.Error(fmt.Sprintf("could not clean up everything left behind by earlier builds: %s", err))
+			}
+		}
+		journal = NewJournal(b.config.CleanupJournal, b.config.BuildUUID(), template)
+	}
+	state.Put("journal", journal)
+	state.Put("created_images", NewCreatedImages(journal))
+
+	steps := []multistep.Step{}
+	if resume != nil {
+		steps = append(steps, &StepResume{
+			Point: resume,
+		})
+	} else {
+		steps = append(steps, b.launchSteps(tc)...)
+	}
+	if resume == nil || resume.Stage == resumeCreateImage {
+		steps = append(steps, &StepCreateImage{})
+	}
+	steps = append(steps, b.imageSteps()...)
+
+	b.runner = common.NewRunner(steps, b.config.PackerConfig, ui)
+	b.runner.Run(state)
+
+	// -on-error=abort leaves the resources for debugging or resuming, so
+	// the journal mustn't have them cleaned up by the next build
+	_, halted := state.GetOk(multistep.StateHalted)
+	if halted && b.config.PackerOnError == "abort" {
+		journal.Aborted()
+	} else {
+		journal.Done()
+	}
+
+	if rawErr, ok := state.GetOk("error"); ok {
+		return nil, rawErr.(error)
+	}
+	if _, ok := state.GetOk("images"); !ok {
+		return nil, nil
+	}
+	artifact := Artifact{
+		Images:         state.Get("images").(map[string]string),
+		BuilderIdValue: BuilderID,
+		Session:        tc,
+		DeleteInUse:    b.config.ForceDeregisterInUse,
+		ProtectionTag:  b.config.DeletionProtectionTag,
+		SharedAccounts: b.config.ImageShareAccounts,
+	}
+	if exports, ok := state.GetOk("exports"); ok {
+		artifact.Exports = exports.(map[string]string)
+	}
+	if accountImages, ok := state.GetOk("account_images"); ok {
+		artifact.AccountImages = accountImages.(map[string]string)
+		artifact.AccountRoles = make(map[string]string)
+		for _, target := range b.config.ImageTargetAccounts {
+			artifact.AccountRoles[target.AccountId] = target.RoleArn
+		}
+	}
+
+	return artifact, nil
+}
+
+// launchSteps launch and provision the instance the image is made from and
+// make way for the new image
+func (b *Builder) launchSteps(tc *tcapi.Client) []multistep.Step {
 	steps := []multistep.Step{
 		&StepPreValidate{
 			DestImageName:   b.config.ImageName,
@@ -81,6 +214,18 @@ func (b *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packe
 			KeyPairName:          b.config.SSHKeyPairName,
 			TemporaryKeyPairName: b.config.TemporaryKeyPairName,
 			PrivateKeyFile:       b.config.RunConfig.Comm.SSHPrivateKey,
+			PrivateKeyPassphrase: b.config.SSHPrivateKeyPassphrase,
+			KeyPairType:          b.config.TemporaryKeyPairType,
+			KeyPairBits:          b.config.TemporaryKeyPairBits,
+		},
+		&StepSecurityGroup{
+			SecurityGroupIds:           b.config.SecurityGroupIds,
+			TemporarySecurityGroupName: b.config.TemporarySecurityGroupName,
+			SourceCidrs:                b.config.SecurityGroupSourceCidrs,
+			Port:                       b.config.RunConfig.Comm.Port(),
+			Private:                    b.config.RunConfig.connectsPrivately(),
+			VpcId:                      b.config.VpcId,
+			SubnetId:                   b.config.SubnetId,
 		},
 		&StepRunInstance{
 			AvailabilityZone:        b.config.AvailabilityZone,
@@ -95,48 +240,102 @@ func (b *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packe
 			InternetChargeType:      b.config.InternetChargeType,
 			InternetMaxBandwidthOut: b.config.InternetMaxBandwidthOut,
 			PublicIpAssigned:        b.config.PublicIpAssigned,
-			SecurityGroupIds:        b.config.SecurityGroupIds,
 			UserData:                b.config.UserData,
 			UserDataFile:            b.config.UserDataFile,
+			WinRMBootstrap:          b.config.WinRMBootstrap,
+			HostKeyCheck:            b.config.SSHHostKeyCheck,
+			InstanceName:            b.config.InstanceName,
 		},
+	}
+	if b.config.SSHInterface == sshInterfaceEIP {
+		steps = append(steps, &StepElasticIP{})
+	}
+	steps = append(steps,
 		&communicator.StepConnect{
-			Config:    &b.config.RunConfig.Comm,
-			Host:      SSHHost(tc, b.config.SSHInterface),
-			SSHConfig: SSHConfig(b.config.RunConfig.Comm.SSHUsername, b.config.RunConfig.Comm.SSHPassword),
+			Config:      &b.config.RunConfig.Comm,
+			Host:        SSHHost(tc, b.config.SSHInterface),
+			SSHConfig:   SSHConfig(&b.config.RunConfig),
+			WinRMConfig: WinRMConfig(b.config.RunConfig.Comm.WinRMUser),
+			CustomConnect: map[string]multistep.Step{
+				"ssh": &StepConnectSSH{
+					Config:         &b.config.RunConfig.Comm,
+					ProxyType:      b.config.SSHProxyType,
+					HostKeyCheck:   b.config.SSHHostKeyCheck,
+					BastionHostKey: b.config.SSHBastionHostKey,
+					Host:           SSHHost(tc, b.config.SSHInterface),
+					SSHConfig:      SSHConfig(&b.config.RunConfig),
+				},
+			},
 		},
 		&common.StepProvision{},
+	)
+	if b.config.RunConfig.Comm.Type == "winrm" {
+		steps = append(steps, &StepWindowsShutdown{
+			Sysprep: b.config.WindowsSysprep,
+		})
+	}
+	return append(steps,
 		&StepStopInstance{
 			Skip:                false,
 			DisableStopInstance: b.config.DisableStopInstance,
 		},
 		&StepDeregisterImage{
 			ForceDeregister: b.config.ForceDeregister,
+			Mode:            b.config.ForceDeregisterMode,
 			ImageName:       b.config.ImageName,
 			Regions:         b.config.ImageRegions,
+			InUse:           b.config.ForceDeregisterInUse,
+			ProtectionTag:   b.config.DeletionProtectionTag,
+			ShareAccounts:   b.config.ImageShareAccounts,
 		},
-		&StepCreateImage{},
+	)
+}
+
+// imageSteps distribute the image once it's been created
+func (b *Builder) imageSteps() []multistep.Step {
+	return []multistep.Step{
 		&StepImageRegionCopy{
 			Regions: b.config.ImageRegions,
-			Name:    b.config.ImageName,
+			Timeout: b.config.ImageCopyTimeout,
 		},
+		&StepImageTags{
+			Tags: b.config.ImageTags,
+		},
+		&StepImageShare{
+			Accounts: b.config.ImageShareAccounts,
+		},
+		&StepImageExport{
+			Buckets: b.config.ImageExportBuckets,
+			Format:  b.config.ImageExportFormat,
+			Prefix:  b.config.ImageExportPrefix,
+		},
+		&StepImageTargetAccounts{
+			Accounts:     b.config.ImageTargetAccounts,
+			ImageName:    b.config.ImageName,
+			OsType:       b.config.ImageImportOsType,
+			OsVersion:    b.config.ImageImportOsVersion,
+			Architecture: b.config.ImageImportArchitecture,
+		},
+		&StepImageRetention{
+			Retention:     b.config.ImageRetention,
+			Regions:       b.config.ImageRegions,
+			InUse:         b.config.ForceDeregisterInUse,
+			ProtectionTag: b.config.DeletionProtectionTag,
+			ShareAccounts: b.config.ImageShareAccounts,
+			TagDelim:      b.config.ImageDescTagsDelim,
+		},
+		&StepDeregisterBackups{
+			ForceDeregister: b.config.ForceDeregister,
+			Mode:            b.config.ForceDeregisterMode,
+			ImageName:       b.config.ImageName,
+			Regions:         b.config.ImageRegions,
+			Retention:       b.config.ForceDeregisterRetention,
+			InUse:           b.config.ForceDeregisterInUse,
+			ProtectionTag:   b.config.DeletionProtectionTag,
+			ShareAccounts:   b.config.ImageShareAccounts,
+		},
+		&StepImageBuildState{},
 	}
-
-	b.runner = common.NewRunner(steps, b.config.PackerConfig, ui)
-	b.runner.Run(state)
-
-	if rawErr, ok := state.GetOk("error"); ok {
-		return nil, rawErr.(error)
-	}
-	if _, ok := state.GetOk("images"); !ok {
-		return nil, nil
-	}
-	artifact := Artifact{
-		Images:         state.Get("images").(map[string]string),
-		BuilderIdValue: BuilderID,
-		Session:        tc,
-	}
-
-	return artifact, nil
 }
 
 func (b *Builder) Cancel() {
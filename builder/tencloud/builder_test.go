@@ -1,7 +1,9 @@
 package tencloud
 
 import (
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/packer/packer"
 )
@@ -81,3 +83,520 @@ func TestBuilderPrepare_sourceImage(t *testing.T) {
 		t.Fatal("should have errored")
 	}
 }
+
+func TestBuilderPrepare_imageExport(t *testing.T) {
+	var b Builder
+	config := testConfig()
+	config["source_image_id"] = "foo"
+	config["region"] = "ap-guangzhou"
+	config["image_regions"] = []string{"ap-shanghai"}
+	config["image_export_buckets"] = map[string]string{
+		"ap-guangzhou": "images-gz-1250000000",
+	}
+
+	// missing a bucket for one of the image regions, fail
+	_, err := b.Prepare(config)
+	if err == nil {
+		t.Fatal("should have errored")
+	}
+
+	config["image_export_buckets"] = map[string]string{
+		"ap-guangzhou": "images-gz-1250000000",
+		"ap-shanghai":  "images-sh-1250000000",
+	}
+	b = Builder{}
+	if _, err := b.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %v", err)
+	}
+	if b.config.ImageExportFormat != "qcow2" {
+		t.Fatalf("bad export format default: %s", b.config.ImageExportFormat)
+	}
+
+	config["image_export_format"] = "vmdk"
+	b = Builder{}
+	if _, err := b.Prepare(config); err == nil {
+		t.Fatal("should have errored")
+	}
+}
+
+func TestBuilderPrepare_imageTargetAccounts(t *testing.T) {
+	var b Builder
+	config := testConfig()
+	config["source_image_id"] = "foo"
+	config["region"] = "ap-guangzhou"
+	config["image_target_accounts"] = []map[string]interface{}{
+		{
+			"account_id": "100000000001",
+			"role_arn":   "qcs::cam::uin/100000000001:roleName/packer",
+		},
+	}
+
+	// no export to import from, fail
+	_, err := b.Prepare(config)
+	if err == nil {
+		t.Fatal("should have errored")
+	}
+
+	config["image_export_buckets"] = map[string]string{
+		"ap-guangzhou": "images-gz-1250000000",
+	}
+	config["image_import_os_type"] = "CentOS"
+	b = Builder{}
+	if _, err := b.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %v", err)
+	}
+	if regions := b.config.ImageTargetAccounts[0].Regions; len(regions) != 1 || regions[0] != "ap-guangzhou" {
+		t.Fatalf("bad target regions default: %v", regions)
+	}
+
+	config["image_target_accounts"] = []map[string]interface{}{
+		{
+			"account_id": "100000000001",
+			"role_arn":   "qcs::cam::uin/100000000001:roleName/packer",
+			"regions":    []string{"ap-shanghai"},
+		},
+	}
+	b = Builder{}
+	if _, err := b.Prepare(config); err == nil {
+		t.Fatal("should have errored")
+	}
+}
+
+func TestBuilderPrepare_forceDeregisterMode(t *testing.T) {
+	var b Builder
+	config := testConfig()
+	config["source_image_id"] = "foo"
+
+	if _, err := b.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %v", err)
+	}
+	if b.config.ForceDeregisterMode != "delete" {
+		t.Fatalf("bad force_deregister_mode default: %s", b.config.ForceDeregisterMode)
+	}
+
+	config["force_deregister_mode"] = "safe"
+	b = Builder{}
+	if _, err := b.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %v", err)
+	}
+
+	config["force_deregister_mode"] = "rename"
+	b = Builder{}
+	if _, err := b.Prepare(config); err == nil {
+		t.Fatal("should have errored")
+	}
+
+	// backup names don't depend on the length of the image's name
+	config["force_deregister_mode"] = "safe"
+	config["image_name"] = "web-server-20-chars"
+	b = Builder{}
+	if _, err := b.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %v", err)
+	}
+}
+
+func TestBuilderPrepare_imageRetention(t *testing.T) {
+	var b Builder
+	config := testConfig()
+	config["source_image_id"] = "foo"
+
+	// no selector, fail
+	config["image_retention"] = map[string]interface{}{
+		"keep_count": 3,
+	}
+	if _, err := b.Prepare(config); err == nil {
+		t.Fatal("should have errored")
+	}
+
+	// nothing to keep, fail
+	config["image_retention"] = map[string]interface{}{
+		"name_prefix": "nightly-",
+	}
+	b = Builder{}
+	if _, err := b.Prepare(config); err == nil {
+		t.Fatal("should have errored")
+	}
+
+	config["image_retention"] = map[string]interface{}{
+		"tags": map[string]string{
+			"team": "infra",
+		},
+		"keep_days": 14,
+		"dry_run":   true,
+	}
+	b = Builder{}
+	if _, err := b.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %v", err)
+	}
+	if !b.config.ImageRetention.DryRun {
+		t.Fatal("dry_run should be set")
+	}
+}
+
+func TestBuilderPrepare_timeouts(t *testing.T) {
+	var b Builder
+	config := testConfig()
+	config["source_image_id"] = "foo"
+	config["timeout"] = "10m"
+	config["poll_delay"] = "5s"
+	config["image_copy_timeout"] = "1h"
+
+	if _, err := b.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %v", err)
+	}
+	if b.config.PollDelay != 5*time.Second {
+		t.Fatalf("bad poll_delay: %s", b.config.PollDelay)
+	}
+	if b.config.ImageCreateTimeout != 10*time.Minute {
+		t.Fatalf("bad image_create_timeout: %s", b.config.ImageCreateTimeout)
+	}
+	if b.config.ImageCopyTimeout != time.Hour {
+		t.Fatalf("bad image_copy_timeout: %s", b.config.ImageCopyTimeout)
+	}
+
+	config["poll_delay"] = "-1s"
+	b = Builder{}
+	if _, err := b.Prepare(config); err == nil {
+		t.Fatal("should have errored")
+	}
+}
+
+func TestBuilderPrepare_tagsInDescription(t *testing.T) {
+	var b Builder
+	config := testConfig()
+	config["source_image_id"] = "foo"
+	config["image_description"] = "nightly build"
+	config["tags"] = map[string]string{
+		"team": "infra",
+	}
+
+	// resource tags don't use the description, pass
+	if _, err := b.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %v", err)
+	}
+
+	config["tags_in_description"] = true
+	b = Builder{}
+	if _, err := b.Prepare(config); err == nil {
+		t.Fatal("should have errored")
+	}
+}
+
+func TestBuilderPrepare_resourceNames(t *testing.T) {
+	var b Builder
+	config := testConfig()
+	config["source_image_id"] = "foo"
+	config["packer_build_name"] = "web"
+	config["run_tags"] = map[string]string{
+		"team":       "infra",
+		BuildUUIDTag: "bogus",
+	}
+
+	if _, err := b.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %v", err)
+	}
+	uuid := b.config.BuildUUID()
+	if !strings.HasPrefix(b.config.InstanceName, "packer_") {
+		t.Fatalf("bad instance name: %s", b.config.InstanceName)
+	}
+	if !strings.HasPrefix(b.config.TemporaryKeyPairName, "packer_") || !strings.HasSuffix(strings.Replace(uuid, "-", "", -1), strings.TrimPrefix(b.config.TemporaryKeyPairName, "packer_")) {
+		t.Fatalf("bad key pair name: %s", b.config.TemporaryKeyPairName)
+	}
+	tags := b.config.ResourceTags()
+	if tags["team"] != "infra" || tags[BuildUUIDTag] != uuid || tags[BuildNameTag] != "web" || tags[TemplateHashTag] == "" {
+		t.Fatalf("bad resource tags: %#v", tags)
+	}
+
+	config["resource_name_prefix"] = "ci"
+	config["instance_name"] = "{{ .Prefix }}-{{ build_name }}-{{ .BuildUUID }}"
+	b = Builder{}
+	if _, err := b.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %v", err)
+	}
+	if expected := "ci-web-" + b.config.BuildUUID(); b.config.InstanceName != expected {
+		t.Fatalf("bad instance name: %s, expected %s", b.config.InstanceName, expected)
+	}
+
+	config["resource_name_prefix"] = "continuous_x"
+	b = Builder{}
+	if _, err := b.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %v", err)
+	}
+	if name := b.config.TemporaryKeyPairName; len(name) != keyPairNameLen || !strings.HasPrefix(name, "continuo_") {
+		t.Fatalf("bad key pair name: %s", name)
+	}
+
+	config["temporary_key_pair_name"] = "a_key_pair_name_that_is_too_long"
+	b = Builder{}
+	if _, err := b.Prepare(config); err == nil {
+		t.Fatal("should have errored with a long key pair name")
+	}
+	delete(config, "temporary_key_pair_name")
+
+	config["resource_name_prefix"] = "not-valid"
+	b = Builder{}
+	if _, err := b.Prepare(config); err == nil {
+		t.Fatal("should have errored")
+	}
+}
+
+func TestBuilderPrepare_resume(t *testing.T) {
+	var b Builder
+	config := testConfig()
+	config["source_image_id"] = "foo"
+	config["resume_build_uuid"] = "0123"
+
+	if _, err := b.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %v", err)
+	}
+	if !b.config.Resume {
+		t.Fatal("resume should be set")
+	}
+
+	b.config.RunConfig.adoptBuild("0123")
+	if b.config.BuildUUID() != "0123" || b.config.ResourceTags()[BuildUUIDTag] != "0123" {
+		t.Fatalf("bad adopted build: %#v", b.config.ResourceTags())
+	}
+}
+
+func TestBuilderPrepare_resumeTemplateHash(t *testing.T) {
+	var b Builder
+	config := testConfig()
+	config["source_image_id"] = "foo"
+	if _, err := b.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %v", err)
+	}
+	hash := b.config.buildTags[TemplateHashTag]
+	if hash == "" {
+		t.Fatal("template hash should be set")
+	}
+
+	config = testConfig()
+	config["source_image_id"] = "foo"
+	config["resume"] = true
+	config["resume_build_uuid"] = "0123"
+	config["packer_build_name"] = "tencloud"
+	b = Builder{}
+	if _, err := b.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %v", err)
+	}
+	if b.config.buildTags[TemplateHashTag] != hash {
+		t.Fatalf("resuming changed the template hash: %s != %s", b.config.buildTags[TemplateHashTag], hash)
+	}
+
+	config["instance_type"] = "type_bar"
+	b = Builder{}
+	if _, err := b.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %v", err)
+	}
+	if b.config.buildTags[TemplateHashTag] == hash {
+		t.Fatal("a different template should hash differently")
+	}
+}
+
+func TestBuilderPrepare_winrm(t *testing.T) {
+	var b Builder
+	config := testConfig()
+	config["source_image_id"] = "foo"
+	config["communicator"] = "winrm"
+	config["winrm_bootstrap"] = true
+
+	if _, err := b.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %v", err)
+	}
+	comm := b.config.RunConfig.Comm
+	if comm.WinRMUser != "Administrator" || !comm.WinRMUseSSL || comm.WinRMPort != 5986 {
+		t.Fatalf("bad winrm config: %#v", comm)
+	}
+	if b.config.TemporaryKeyPairName != "" {
+		t.Fatalf("windows instances take no key pair: %s", b.config.TemporaryKeyPairName)
+	}
+
+	config["user_data"] = "echo"
+	b = Builder{}
+	if _, err := b.Prepare(config); err == nil {
+		t.Fatal("should have errored")
+	}
+
+	config = testConfig()
+	config["source_image_id"] = "foo"
+	config["windows_sysprep"] = true
+	b = Builder{}
+	if _, err := b.Prepare(config); err == nil {
+		t.Fatal("should have errored")
+	}
+}
+
+func TestBuilderPrepare_sshGeneratePassword(t *testing.T) {
+	var b Builder
+	config := testConfig()
+	config["source_image_id"] = "foo"
+	config["ssh_generate_password"] = true
+
+	if _, err := b.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %v", err)
+	}
+	if b.config.TemporaryKeyPairName != "" {
+		t.Fatalf("no key pair should be made: %s", b.config.TemporaryKeyPairName)
+	}
+
+	config["ssh_password"] = "hunter2"
+	b = Builder{}
+	if _, err := b.Prepare(config); err == nil {
+		t.Fatal("should have errored")
+	}
+}
+
+func TestBuilderPrepare_sshKeyPairName(t *testing.T) {
+	var b Builder
+	config := testConfig()
+	config["source_image_id"] = "foo"
+	config["ssh_keypair_name"] = "deploy"
+
+	if _, err := b.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %v", err)
+	}
+	if b.config.TemporaryKeyPairName != "" {
+		t.Fatalf("no key pair should be made: %s", b.config.TemporaryKeyPairName)
+	}
+	if !b.config.RunConfig.Comm.SSHAgentAuth {
+		t.Fatal("the agent should be used without a private key")
+	}
+}
+
+func TestBuilderPrepare_sshProxy(t *testing.T) {
+	var b Builder
+	config := testConfig()
+	config["source_image_id"] = "foo"
+	config["security_group_ids"] = []string{"sg-1"}
+	config["ssh_username"] = "centos"
+	config["ssh_bastion_host"] = "bastion.example.com"
+	config["ssh_bastion_password"] = "secret"
+
+	if _, err := b.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %v", err)
+	}
+	comm := b.config.RunConfig.Comm
+	if comm.SSHBastionPort != 22 || comm.SSHBastionUsername != "centos" {
+		t.Fatalf("bad bastion config: %#v", comm)
+	}
+
+	config["ssh_bastion_host_key"] = "not a key"
+	b = Builder{}
+	if _, err := b.Prepare(config); err == nil {
+		t.Fatal("should have errored with a bad bastion host key")
+	}
+	delete(config, "ssh_bastion_host_key")
+
+	delete(config, "ssh_bastion_password")
+	b = Builder{}
+	if _, err := b.Prepare(config); err == nil {
+		t.Fatal("should have errored without a way to log into the bastion")
+	}
+
+	config = testConfig()
+	config["source_image_id"] = "foo"
+	config["security_group_ids"] = []string{"sg-1"}
+	config["ssh_proxy_host"] = "proxy.example.com"
+	config["ssh_proxy_type"] = "http"
+	b = Builder{}
+	if _, err := b.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %v", err)
+	}
+	if b.config.RunConfig.Comm.SSHProxyPort != 8080 {
+		t.Fatalf("bad proxy port: %d", b.config.RunConfig.Comm.SSHProxyPort)
+	}
+
+	config["ssh_proxy_type"] = "ftp"
+	b = Builder{}
+	if _, err := b.Prepare(config); err == nil {
+		t.Fatal("should have errored")
+	}
+
+	config["ssh_proxy_type"] = "socks5"
+	config["ssh_bastion_host"] = "bastion.example.com"
+	config["ssh_bastion_password"] = "secret"
+	b = Builder{}
+	if _, err := b.Prepare(config); err == nil {
+		t.Fatal("should have errored with both a bastion and a proxy")
+	}
+}
+
+func TestBuilderPrepare_sshInterface(t *testing.T) {
+	var b Builder
+	config := testConfig()
+	config["source_image_id"] = "foo"
+
+	if _, err := b.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %v", err)
+	}
+	if b.config.SSHInterface != "auto" {
+		t.Fatalf("bad ssh_interface default: %s", b.config.SSHInterface)
+	}
+
+	config["ssh_interface"] = "ipv6"
+	b = Builder{}
+	if _, err := b.Prepare(config); err == nil {
+		t.Fatal("should have errored")
+	}
+
+	config["ssh_interface"] = "eip"
+	config["public_ip_assigned"] = true
+	b = Builder{}
+	if _, err := b.Prepare(config); err == nil {
+		t.Fatal("should have errored")
+	}
+}
+
+func TestBuilderPrepare_temporarySecurityGroup(t *testing.T) {
+	var b Builder
+	config := testConfig()
+	config["source_image_id"] = "foo"
+
+	if _, err := b.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %v", err)
+	}
+	if !strings.HasPrefix(b.config.TemporarySecurityGroupName, "packer_") {
+		t.Fatalf("bad temporary security group name: %s", b.config.TemporarySecurityGroupName)
+	}
+
+	// the default auto connects to the private ip without public_ip_assigned
+	if !b.config.RunConfig.connectsPrivately() {
+		t.Fatal("should connect privately without public_ip_assigned")
+	}
+	config["public_ip_assigned"] = true
+	b = Builder{}
+	if _, err := b.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %v", err)
+	}
+	if b.config.RunConfig.connectsPrivately() {
+		t.Fatal("should connect to the public ip with public_ip_assigned")
+	}
+
+	config["ssh_bastion_host"] = "bastion.example.com"
+	config["ssh_bastion_password"] = "secret"
+	config["ssh_username"] = "centos"
+	b = Builder{}
+	if _, err := b.Prepare(config); err == nil {
+		t.Fatal("should have errored without source cidrs for the bastion")
+	}
+
+	config["temporary_security_group_source_cidrs"] = []string{"10.0.0.0/8"}
+	b = Builder{}
+	if _, err := b.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %v", err)
+	}
+
+	config["temporary_security_group_source_cidrs"] = []string{"10.0.0.0"}
+	b = Builder{}
+	if _, err := b.Prepare(config); err == nil {
+		t.Fatal("should have errored on an invalid cidr")
+	}
+
+	config["temporary_security_group_source_cidrs"] = []string{"10.0.0.0/8"}
+	config["security_group_ids"] = []string{"sg-1"}
+	b = Builder{}
+	if _, err := b.Prepare(config); err == nil {
+		t.Fatal("should have errored with security_group_ids")
+	}
+}
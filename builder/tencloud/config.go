@@ -3,6 +3,7 @@ package tencloud
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
@@ -14,6 +15,7 @@ import (
 	"github.com/hashicorp/packer/common/uuid"
 	"github.com/hashicorp/packer/helper/communicator"
 	"github.com/hashicorp/packer/template/interpolate"
+	"golang.org/x/crypto/ssh"
 )
 
 // authentication configuration
@@ -59,13 +61,38 @@ func (c *AuthConfig) Prepare(ctx *interpolate.Context) []error {
 
 // image configuration
 type ImageConfig struct {
-	ImageName          string   `mapstructure:"image_name"`
-	ImageDescription   string   `mapstructure:"image_description"`
-	ImageDescTags      TagMap   `mapstructure:"tags"`
-	ImageDescTagsDelim string   `mapstructure:"tag_delimiter"`
-	ImageRegions       []string `mapstructure:"image_regions"`
-	ForceDeregister    bool     `mapstructure:"force_deregister"`
-	CleanImageName     bool     `mapstructure:"clean_image_name"`
+	ImageName                string   `mapstructure:"image_name"`
+	ImageDescription         string   `mapstructure:"image_description"`
+	ImageTags                TagMap   `mapstructure:"tags"`
+	ImageTagsInDescription   bool     `mapstructure:"tags_in_description"`
+	ImageDescTagsDelim       string   `mapstructure:"tag_delimiter"`
+	ImageRegions             []string `mapstructure:"image_regions"`
+	ForceDeregister          bool     `mapstructure:"force_deregister"`
+	ForceDeregisterMode      string   `mapstructure:"force_deregister_mode"`
+	ForceDeregisterRetention int      `mapstructure:"force_deregister_backup_retention"`
+	ForceDeregisterInUse     bool     `mapstructure:"force_deregister_in_use"`
+	DeletionProtectionTag    string   `mapstructure:"deletion_protection_tag"`
+	CleanImageName           bool     `mapstructure:"clean_image_name"`
+	ImageShareAccounts       []string `mapstructure:"image_share_accounts"`
+
+	ImageExportBuckets map[string]string `mapstructure:"image_export_buckets"`
+	ImageExportFormat  string            `mapstructure:"image_export_format"`
+	ImageExportPrefix  string            `mapstructure:"image_export_prefix"`
+
+	ImageTargetAccounts     []ImageTargetAccount `mapstructure:"image_target_accounts"`
+	ImageImportOsType       string               `mapstructure:"image_import_os_type"`
+	ImageImportOsVersion    string               `mapstructure:"image_import_os_version"`
+	ImageImportArchitecture string               `mapstructure:"image_import_architecture"`
+
+	ImageRetention ImageRetentionConfig `mapstructure:"image_retention"`
+}
+
+// ImageTargetAccount is an account that receives its own copy of the image,
+// imported from the COS export under a role assumed in that account
+type ImageTargetAccount struct {
+	AccountId string   `mapstructure:"account_id"`
+	RoleArn   string   `mapstructure:"role_arn"`
+	Regions   []string `mapstructure:"regions"`
 }
 
 func (c *ImageConfig) Prepare(ctx *interpolate.Context) []error {
@@ -86,19 +113,97 @@ func (c *ImageConfig) Prepare(ctx *interpolate.Context) []error {
 		c.ImageDescTagsDelim = ":"
 	}
 
-	// Verify that description and imagedesctags aren't both set
-	if c.ImageDescTags.IsSet() && c.ImageDescription != "" {
-		errs = append(errs, fmt.Errorf("cannot set image_description and tags simultaneously"))
+	// Tags are only encoded into the description in compatibility mode, which
+	// leaves no room for image_description
+	if c.ImageTagsInDescription && c.ImageTags.IsSet() && c.ImageDescription != "" {
+		errs = append(errs, fmt.Errorf("cannot set image_description and tags simultaneously when tags_in_description is set"))
 	}
 
-	if c.ImageDescTags.IsSet() {
-		tags := c.ImageDescTags.Flatten(c.ImageDescTagsDelim)
+	if c.ImageTagsInDescription && c.ImageTags.IsSet() {
+		tags := c.ImageTags.Flatten(c.ImageDescTagsDelim)
 		tagLen := len(tags)
-		if tagLen >= 60 {
-			errs = append(errs, fmt.Errorf("description tags cannot exceed 60 characters in total, got (%d): %q", tagLen, tags))
+		if tagLen > 60 {
+			errs = append(errs, fmt.Errorf("encoded description tags cannot exceed 60 characters, got (%d): %q", tagLen, tags))
 		}
 	}
 
+	switch c.ForceDeregisterMode {
+	case "":
+		c.ForceDeregisterMode = "delete"
+	case "delete", "safe":
+	default:
+		errs = append(errs, fmt.Errorf("force_deregister_mode must be one of delete or safe, got %q", c.ForceDeregisterMode))
+	}
+	if c.DeletionProtectionTag == "" {
+		c.DeletionProtectionTag = DefaultProtectionTag
+	}
+	if c.ForceDeregisterRetention < 0 {
+		errs = append(errs, fmt.Errorf("force_deregister_backup_retention cannot be negative"))
+	}
+
+	if len(c.ImageExportBuckets) > 0 {
+		c.ImageExportFormat = strings.ToLower(c.ImageExportFormat)
+		switch c.ImageExportFormat {
+		case "":
+			c.ImageExportFormat = "qcow2"
+		case "qcow2", "vhd", "raw":
+		default:
+			errs = append(errs, fmt.Errorf("image_export_format must be one of qcow2, vhd or raw, got %q", c.ImageExportFormat))
+		}
+	}
+
+	if len(c.ImageTargetAccounts) > 0 {
+		if len(c.ImageExportBuckets) == 0 {
+			errs = append(errs, fmt.Errorf("image_target_accounts requires image_export_buckets to be set"))
+		}
+		if c.ImageImportOsType == "" {
+			errs = append(errs, fmt.Errorf("image_import_os_type must be specified when using image_target_accounts"))
+		}
+		if c.ImageImportArchitecture == "" {
+			c.ImageImportArchitecture = "x86_64"
+		}
+		for i, target := range c.ImageTargetAccounts {
+			if target.AccountId == "" || target.RoleArn == "" {
+				errs = append(errs, fmt.Errorf("image_target_accounts[%d]: 'account_id' and 'role_arn' must both be set", i))
+			}
+		}
+	}
+
+	errs = append(errs, c.ImageRetention.Prepare()...)
+
+	return errs
+}
+
+// ImageRetentionConfig selects older builds of the image to garbage collect
+type ImageRetentionConfig struct {
+	NamePrefix string            `mapstructure:"name_prefix"`
+	Tags       map[string]string `mapstructure:"tags"`
+	KeepCount  int               `mapstructure:"keep_count"`
+	KeepDays   int               `mapstructure:"keep_days"`
+	DryRun     bool              `mapstructure:"dry_run"`
+}
+
+// IsSet determines if image retention is configured or not
+func (c ImageRetentionConfig) IsSet() bool {
+	return c.NamePrefix != "" || len(c.Tags) > 0 || c.KeepCount > 0 || c.KeepDays > 0
+}
+
+func (c *ImageRetentionConfig) Prepare() []error {
+	var errs []error
+	if !c.IsSet() {
+		return errs
+	}
+
+	if c.NamePrefix == "" && len(c.Tags) == 0 {
+		errs = append(errs, fmt.Errorf("image_retention requires 'name_prefix' or 'tags' to select images"))
+	}
+	if c.KeepCount <= 0 && c.KeepDays <= 0 {
+		errs = append(errs, fmt.Errorf("image_retention requires 'keep_count' or 'keep_days' to be greater than 0"))
+	}
+	if c.KeepCount < 0 || c.KeepDays < 0 {
+		errs = append(errs, fmt.Errorf("image_retention 'keep_count' and 'keep_days' cannot be negative"))
+	}
+
 	return errs
 }
 
@@ -123,40 +228,413 @@ func isAlphaNum(b byte) bool {
 	return false
 }
 
+// how long to wait for the operations of a build
+type TimeoutConfig struct {
+	Timeout                  time.Duration `mapstructure:"timeout"`
+	PollDelay                time.Duration `mapstructure:"poll_delay"`
+	InstanceReadyTimeout     time.Duration `mapstructure:"instance_ready_timeout"`
+	InstanceStopTimeout      time.Duration `mapstructure:"instance_stop_timeout"`
+	InstanceTerminateTimeout time.Duration `mapstructure:"instance_terminate_timeout"`
+	ImageCreateTimeout       time.Duration `mapstructure:"image_create_timeout"`
+	ImageCopyTimeout         time.Duration `mapstructure:"image_copy_timeout"`
+}
+
+// Prepare defaults timeout and poll_delay to TimeoutSeconds() and
+// SleepSeconds(), and the operations' timeouts that aren't set to timeout
+func (c *TimeoutConfig) Prepare() []error {
+	var errs []error
+	if c.PollDelay < 0 {
+		errs = append(errs, fmt.Errorf("poll_delay cannot be negative"))
+	}
+	if c.PollDelay == 0 {
+		c.PollDelay = time.Duration(SleepSeconds()) * time.Second
+	}
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("timeout cannot be negative"))
+	}
+	if c.Timeout == 0 {
+		c.Timeout = time.Duration(TimeoutSeconds()) * time.Second
+	}
+
+	timeouts := []struct {
+		name    string
+		timeout *time.Duration
+	}{
+		{"instance_ready_timeout", &c.InstanceReadyTimeout},
+		{"instance_stop_timeout", &c.InstanceStopTimeout},
+		{"instance_terminate_timeout", &c.InstanceTerminateTimeout},
+		{"image_create_timeout", &c.ImageCreateTimeout},
+		{"image_copy_timeout", &c.ImageCopyTimeout},
+	}
+	for _, t := range timeouts {
+		if *t.timeout < 0 {
+			errs = append(errs, fmt.Errorf("%s cannot be negative", t.name))
+		}
+		if *t.timeout == 0 {
+			*t.timeout = c.Timeout
+		}
+	}
+
+	return errs
+}
+
 // instance run configuration
 type RunConfig struct {
-	AvailabilityZone        string           `mapstructure:"availability_zone"`
-	SourceImageId           string           `mapstructure:"source_image_id"`
-	SourceImageFilter       TagFilterOptions `mapstructure:"source_image_filters"`
-	InstanceType            string           `mapstructure:"instance_type"`
-	InstanceChargeType      string           `mapstructure:"instance_charge_type"`
-	SystemDiskType          string           `mapstructure:"system_disk_type"`
-	SystemDiskSize          string           `mapstructure:"system_disk_size"`
-	VpcId                   string           `mapstructure:"vpc_id"`
-	SubnetId                string           `mapstructure:"subnet_id"`
-	InternetChargeType      string           `mapstructure:"internet_charge_type"`
-	InternetMaxBandwidthOut string           `mapstructure:"internet_max_bandwidth_out"`
-	PublicIpAssigned        bool             `mapstructure:"public_ip_assigned"`
-	SecurityGroupIds        []string         `mapstructure:"security_group_ids"`
-	UserData                string           `mapstructure:"user_data"`
-	UserDataFile            string           `mapstructure:"user_data_file"`
-	TemporaryKeyPairName    string           `mapstructure:"temporary_key_pair_name"`
-	DisableStopInstance     bool             `mapstructure:"disable_stop_instance"`
-	SSHKeyPairName          string           `mapstructure:"ssh_keypair_name"`
-	SSHInterface            string           `mapstructure:"ssh_interface"`
+	AvailabilityZone           string           `mapstructure:"availability_zone"`
+	SourceImageId              string           `mapstructure:"source_image_id"`
+	SourceImageFilter          TagFilterOptions `mapstructure:"source_image_filters"`
+	InstanceType               string           `mapstructure:"instance_type"`
+	InstanceChargeType         string           `mapstructure:"instance_charge_type"`
+	SystemDiskType             string           `mapstructure:"system_disk_type"`
+	SystemDiskSize             string           `mapstructure:"system_disk_size"`
+	VpcId                      string           `mapstructure:"vpc_id"`
+	SubnetId                   string           `mapstructure:"subnet_id"`
+	InternetChargeType         string           `mapstructure:"internet_charge_type"`
+	InternetMaxBandwidthOut    string           `mapstructure:"internet_max_bandwidth_out"`
+	PublicIpAssigned           bool             `mapstructure:"public_ip_assigned"`
+	SecurityGroupIds           []string         `mapstructure:"security_group_ids"`
+	SecurityGroupSourceCidrs   []string         `mapstructure:"temporary_security_group_source_cidrs"`
+	TemporarySecurityGroupName string           `mapstructure:"temporary_security_group_name"`
+	UserData                   string           `mapstructure:"user_data"`
+	UserDataFile               string           `mapstructure:"user_data_file"`
+	TemporaryKeyPairName       string           `mapstructure:"temporary_key_pair_name"`
+	TemporaryKeyPairType       string           `mapstructure:"temporary_key_pair_type"`
+	TemporaryKeyPairBits       int              `mapstructure:"temporary_key_pair_bits"`
+	DisableStopInstance        bool             `mapstructure:"disable_stop_instance"`
+	SSHKeyPairName             string           `mapstructure:"ssh_keypair_name"`
+	SSHGeneratePassword        bool             `mapstructure:"ssh_generate_password"`
+	SSHCertificateFile         string           `mapstructure:"ssh_certificate_file"`
+	SSHPrivateKeyPassphrase    string           `mapstructure:"ssh_private_key_passphrase"`
+	SSHHostKeyCheck            string           `mapstructure:"ssh_host_key_check"`
+	SSHInterface               string           `mapstructure:"ssh_interface"`
+	SSHProxyType               string           `mapstructure:"ssh_proxy_type"`
+	SSHBastionHostKey          string           `mapstructure:"ssh_bastion_host_key"`
+	RunTags                    TagMap           `mapstructure:"run_tags"`
+	ResourceNamePrefix         string           `mapstructure:"resource_name_prefix"`
+	InstanceName               string           `mapstructure:"instance_name"`
+	CleanupJournal             string           `mapstructure:"cleanup_journal"`
+	DisableCleanupJournal      bool             `mapstructure:"disable_cleanup_journal"`
+	Resume                     bool             `mapstructure:"resume"`
+	ResumeBuildUUID            string           `mapstructure:"resume_build_uuid"`
+	WinRMBootstrap             bool             `mapstructure:"winrm_bootstrap"`
+	WindowsSysprep             bool             `mapstructure:"windows_sysprep"`
 
 	Comm communicator.Config `mapstructure:",squash"`
+
+	buildUUID string
+	buildTags TagMap
+}
+
+// instanceNameData is the data available to the instance_name template
+type instanceNameData struct {
+	BuildUUID string
+	Prefix    string
+}
+
+// BuildUUID identifies the build on every temporary resource it creates
+func (c *RunConfig) BuildUUID() string {
+	return c.buildUUID
+}
+
+// adoptBuild makes this build carry on as the build with buildUUID
+func (c *RunConfig) adoptBuild(buildUUID string) {
+	c.buildUUID = buildUUID
+	tags := make(TagMap, len(c.buildTags))
+	for k, v := range c.buildTags {
+		tags[k] = v
+	}
+	tags[BuildUUIDTag] = buildUUID
+	c.buildTags = tags
+}
+
+// ResourceTags returns the tags put on every temporary resource: run_tags
+// and the build metadata tags, which win on conflict
+func (c *RunConfig) ResourceTags() TagMap {
+	tags := make(TagMap, len(c.RunTags)+len(c.buildTags))
+	for k, v := range c.RunTags {
+		tags[k] = v
+	}
+	for k, v := range c.buildTags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// Key pair names are limited to keyPairNameLen characters. Temporary ones
+// end in the last keyPairNameSuffixLen characters of the build UUID, which
+// are random, so they stay unique however the prefix is cut short.
+const (
+	keyPairNameLen       = 25
+	keyPairNameSuffixLen = 16
+)
+
+// temporaryKeyPairName names a build's temporary key pair after the resource
+// name prefix, shortened to fit, and the end of the build UUID
+func temporaryKeyPairName(prefix, nameSuffix string) string {
+	if len(nameSuffix) > keyPairNameSuffixLen {
+		nameSuffix = nameSuffix[len(nameSuffix)-keyPairNameSuffixLen:]
+	}
+	if max := keyPairNameLen - len(nameSuffix) - 1; len(prefix) > max {
+		prefix = prefix[:max]
+	}
+	return fmt.Sprintf("%s_%s", prefix, nameSuffix)
+}
+
+// prepareSSH sets the defaults packer's communicator.Config would, which
+// isn't prepared for ssh since it requires ssh_username, and checks how the
+// instance is reached
+func (c *RunConfig) prepareSSH() []error {
+	var errs []error
+	if c.Comm.SSHTimeout == 0 {
+		c.Comm.SSHTimeout = 5 * time.Minute
+	}
+	if c.Comm.SSHKeepAliveInterval == 0 {
+		c.Comm.SSHKeepAliveInterval = 5 * time.Second
+	}
+	if c.Comm.SSHHandshakeAttempts == 0 {
+		c.Comm.SSHHandshakeAttempts = 10
+	}
+	if c.Comm.SSHFileTransferMethod == "" {
+		c.Comm.SSHFileTransferMethod = "scp"
+	}
+	if c.Comm.SSHFileTransferMethod != "scp" && c.Comm.SSHFileTransferMethod != "sftp" {
+		errs = append(errs, fmt.Errorf("ssh_file_transfer_method must be 'scp' or 'sftp'"))
+	}
+
+	if c.Comm.SSHBastionHost != "" {
+		if c.Comm.SSHBastionPort == 0 {
+			c.Comm.SSHBastionPort = 22
+		}
+		if c.Comm.SSHBastionUsername == "" {
+			c.Comm.SSHBastionUsername = c.Comm.SSHUsername
+		}
+		if c.Comm.SSHBastionUsername == "" {
+			errs = append(errs, fmt.Errorf("ssh_bastion_username must be specified"))
+		}
+		if c.Comm.SSHBastionPassword == "" && c.Comm.SSHBastionPrivateKey == "" && !c.Comm.SSHBastionAgentAuth {
+			errs = append(errs, fmt.Errorf("ssh_bastion_password, ssh_bastion_private_key_file or ssh_bastion_agent_auth must be specified"))
+		}
+		if c.Comm.SSHBastionPrivateKey != "" {
+			if contents, err := ioutil.ReadFile(c.Comm.SSHBastionPrivateKey); err != nil {
+				errs = append(errs, fmt.Errorf("ssh_bastion_private_key_file is invalid: %s", err))
+			} else if _, err := parsePrivateKey(contents, ""); err != nil {
+				errs = append(errs, fmt.Errorf("ssh_bastion_private_key_file is invalid: %s", err))
+			}
+		}
+		if c.SSHBastionHostKey != "" {
+			if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(c.SSHBastionHostKey)); err != nil {
+				errs = append(errs, fmt.Errorf("ssh_bastion_host_key is invalid: %s", err))
+			}
+		}
+	} else if c.SSHBastionHostKey != "" {
+		errs = append(errs, fmt.Errorf("ssh_bastion_host_key requires ssh_bastion_host"))
+	}
+
+	if c.Comm.SSHProxyHost != "" {
+		if c.SSHProxyType == "" {
+			c.SSHProxyType = proxyTypeSOCKS5
+		}
+		switch c.SSHProxyType {
+		case proxyTypeSOCKS5:
+			if c.Comm.SSHProxyPort == 0 {
+				c.Comm.SSHProxyPort = 1080
+			}
+		case proxyTypeHTTP:
+			if c.Comm.SSHProxyPort == 0 {
+				c.Comm.SSHProxyPort = 8080
+			}
+		default:
+			errs = append(errs, fmt.Errorf("ssh_proxy_type must be 'socks5' or 'http'"))
+		}
+	} else if c.SSHProxyType != "" {
+		errs = append(errs, fmt.Errorf("ssh_proxy_type requires ssh_proxy_host"))
+	}
+
+	if c.Comm.SSHBastionHost != "" && c.Comm.SSHProxyHost != "" {
+		errs = append(errs, fmt.Errorf("ssh_bastion_host and ssh_proxy_host cannot both be specified"))
+	}
+	return errs
+}
+
+// connectsPrivately reports whether the communicator connects to the
+// instance's private IP, which auto does when it's given no public one
+func (c *RunConfig) connectsPrivately() bool {
+	return c.SSHInterface == sshInterfacePrivateIP || (c.SSHInterface == sshInterfaceAuto && !c.PublicIpAssigned)
 }
 
 func (c *RunConfig) Prepare(ctx *interpolate.Context) []error {
 	var errs []error
-	c.Comm.Type = "ssh"
-	c.Comm.SSHPort = 22
+	switch c.Comm.Type {
+	case "", "ssh":
+		c.Comm.Type = "ssh"
+		c.Comm.SSHPort = 22
+		errs = append(errs, c.prepareSSH()...)
+	case "winrm":
+		// the generated password is set for Administrator
+		if c.Comm.WinRMUser == "" {
+			c.Comm.WinRMUser = "Administrator"
+		}
+		if c.Comm.WinRMUser != "Administrator" && c.Comm.WinRMPassword == "" {
+			errs = append(errs, fmt.Errorf("winrm_password must be specified when winrm_username isn't Administrator"))
+		}
+		// the bootstrapped listener uses a self-signed certificate
+		if c.WinRMBootstrap {
+			c.Comm.WinRMUseSSL = true
+			c.Comm.WinRMInsecure = true
+			if c.UserData != "" || c.UserDataFile != "" {
+				errs = append(errs, fmt.Errorf("winrm_bootstrap cannot be used with user_data or user_data_file"))
+			}
+		}
+		errs = append(errs, c.Comm.Prepare(ctx)...)
+	default:
+		errs = append(errs, fmt.Errorf("communicator must be 'ssh' or 'winrm'"))
+	}
+	if c.Comm.Type != "winrm" && (c.WinRMBootstrap || c.WindowsSysprep) {
+		errs = append(errs, fmt.Errorf("winrm_bootstrap and windows_sysprep can only be used with the winrm communicator"))
+	}
+
+	if c.SSHInterface == "" {
+		c.SSHInterface = sshInterfaceAuto
+	}
+	switch c.SSHInterface {
+	case sshInterfacePublicIP, sshInterfacePrivateIP, sshInterfaceAuto:
+	case sshInterfaceEIP:
+		// an instance with a public IP of its own can't be bound an elastic one
+		if c.PublicIpAssigned {
+			errs = append(errs, fmt.Errorf("ssh_interface eip cannot be used with public_ip_assigned"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("ssh_interface must be 'public_ip', 'private_ip', 'auto' or 'eip'"))
+	}
+
+	if c.buildUUID == "" {
+		c.buildUUID = uuid.TimeOrderedUUID()
+	}
+
+	if c.ResumeBuildUUID != "" {
+		c.Resume = true
+	}
+
+	if c.CleanupJournal == "" {
+		c.CleanupJournal = DefaultCleanupJournal
+	}
+
+	if c.ResourceNamePrefix == "" {
+		c.ResourceNamePrefix = "packer"
+	}
+	if len(c.ResourceNamePrefix) > 12 || strings.Trim(c.ResourceNamePrefix, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_") != "" {
+		errs = append(errs, fmt.Errorf("resource_name_prefix can only contain up to 12 alphanumerics and underscores"))
+	}
+	nameSuffix := strings.Replace(c.buildUUID, "-", "", -1)
+
+	if c.InstanceName == "" {
+		c.InstanceName = fmt.Sprintf("%s_%s", c.ResourceNamePrefix, nameSuffix)
+	} else {
+		nameCtx := *ctx
+		nameCtx.Data = &instanceNameData{
+			BuildUUID: c.buildUUID,
+			Prefix:    c.ResourceNamePrefix,
+		}
+		name, err := interpolate.Render(c.InstanceName, &nameCtx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not render instance_name: %s", err))
+		}
+		c.InstanceName = name
+	}
+	if len(c.InstanceName) > 60 {
+		errs = append(errs, fmt.Errorf("instance_name must be less than 60 characters"))
+	}
+
+	if len(c.SecurityGroupIds) == 0 {
+		if c.TemporarySecurityGroupName == "" {
+			c.TemporarySecurityGroupName = fmt.Sprintf("%s_%s", c.ResourceNamePrefix, nameSuffix)
+		}
+		// connections to the private IP are let in from the VPC, but a
+		// bastion or proxy reaching a public IP is somewhere only the user
+		// knows
+		if len(c.SecurityGroupSourceCidrs) == 0 && !c.connectsPrivately() && (c.Comm.SSHBastionHost != "" || c.Comm.SSHProxyHost != "") {
+			errs = append(errs, fmt.Errorf("temporary_security_group_source_cidrs must be specified with a bastion or a proxy unless connecting to the private ip"))
+		}
+	} else if len(c.SecurityGroupSourceCidrs) > 0 {
+		errs = append(errs, fmt.Errorf("temporary_security_group_source_cidrs cannot be used with security_group_ids"))
+	}
+	for _, cidr := range c.SecurityGroupSourceCidrs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errs = append(errs, fmt.Errorf("temporary_security_group_source_cidrs has an invalid cidr '%s'", cidr))
+		}
+	}
+
+	// without a private key, the instance is logged into with ssh_keypair_name
+	// through the agent
+	if c.SSHKeyPairName != "" && c.Comm.SSHPrivateKey == "" && c.Comm.SSHPassword == "" {
+		c.Comm.SSHAgentAuth = true
+	}
+
+	if c.Comm.SSHPrivateKey != "" {
+		if contents, err := ioutil.ReadFile(c.Comm.SSHPrivateKey); err != nil {
+			errs = append(errs, fmt.Errorf("ssh_private_key_file is invalid: %s", err))
+		} else if _, err := parsePrivateKey(contents, c.SSHPrivateKeyPassphrase); err != nil {
+			errs = append(errs, fmt.Errorf("ssh_private_key_file is invalid: %s", err))
+		}
+	} else if c.SSHPrivateKeyPassphrase != "" {
+		errs = append(errs, fmt.Errorf("ssh_private_key_passphrase requires ssh_private_key_file"))
+	}
+	if c.SSHCertificateFile != "" {
+		if c.Comm.SSHPrivateKey == "" && !c.Comm.SSHAgentAuth {
+			errs = append(errs, fmt.Errorf("ssh_certificate_file requires ssh_private_key_file or ssh_agent_auth"))
+		}
+		if _, err := loadCertificate(c.SSHCertificateFile); err != nil {
+			errs = append(errs, fmt.Errorf("ssh_certificate_file is invalid: %s", err))
+		}
+	}
+
+	if c.SSHHostKeyCheck == "" {
+		c.SSHHostKeyCheck = hostKeyCheckTOFU
+	}
+	switch c.SSHHostKeyCheck {
+	case hostKeyCheckStrict, hostKeyCheckTOFU, hostKeyCheckOff:
+	default:
+		errs = append(errs, fmt.Errorf("ssh_host_key_check must be 'strict', 'tofu' or 'off'"))
+	}
+	if c.SSHHostKeyCheck == hostKeyCheckStrict && c.Comm.Type != "ssh" {
+		errs = append(errs, fmt.Errorf("ssh_host_key_check can only be strict with the ssh communicator"))
+	}
+
+	if c.SSHGeneratePassword {
+		if c.Comm.Type != "ssh" {
+			errs = append(errs, fmt.Errorf("ssh_generate_password can only be used with the ssh communicator"))
+		}
+		if c.Comm.SSHPassword != "" || c.SSHKeyPairName != "" || c.TemporaryKeyPairName != "" || c.Comm.SSHPrivateKey != "" {
+			errs = append(errs, fmt.Errorf("ssh_generate_password cannot be used with ssh_password, a key pair or a private key"))
+		}
+	}
+
+	// the public key of ssh_private_key_file is imported too, so the
+	// instance accepts it without a key pair of its own
+	if c.Comm.Type == "ssh" && !c.SSHGeneratePassword && !c.Comm.SSHAgentAuth && c.SSHKeyPairName == "" && c.TemporaryKeyPairName == "" && c.Comm.SSHPassword == "" {
+		c.TemporaryKeyPairName = temporaryKeyPairName(c.ResourceNamePrefix, nameSuffix)
+	}
+	if len(c.TemporaryKeyPairName) > keyPairNameLen {
+		errs = append(errs, fmt.Errorf("temporary_key_pair_name must be at most %d characters", keyPairNameLen))
+	}
 
-	if c.SSHKeyPairName == "" && c.TemporaryKeyPairName == "" && c.Comm.SSHPrivateKey == "" && c.Comm.SSHPassword == "" {
-		keyName := fmt.Sprintf("packer_%s", uuid.TimeOrderedUUID())
-		keyName = strings.Replace(keyName, "-", "", -1)
-		c.TemporaryKeyPairName = keyName[:24]
+	if c.TemporaryKeyPairType == "" {
+		c.TemporaryKeyPairType = keyTypeRSA
+	}
+	switch c.TemporaryKeyPairType {
+	case keyTypeRSA:
+		if c.TemporaryKeyPairBits == 0 {
+			c.TemporaryKeyPairBits = 4096
+		}
+		if c.TemporaryKeyPairBits < 2048 {
+			errs = append(errs, fmt.Errorf("temporary_key_pair_bits must be at least 2048"))
+		}
+	case keyTypeED25519:
+		if c.TemporaryKeyPairBits != 0 {
+			errs = append(errs, fmt.Errorf("temporary_key_pair_bits can only be set for rsa keys"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("temporary_key_pair_type must be 'rsa' or 'ed25519'"))
 	}
 
 	if c.SourceImageId == "" && c.SourceImageFilter.Empty() {
@@ -0,0 +1,80 @@
+package tencloud
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/3van/tencloud-go"
+)
+
+// cosObjectURL returns the URL of an object in a COS bucket. key may also be
+// a URL already, as the API reports some paths that way.
+func cosObjectURL(bucket, region, key string) string {
+	if strings.HasPrefix(key, "https://") || strings.HasPrefix(key, "http://") {
+		return key
+	}
+	return fmt.Sprintf("https://%s.cos.%s.myqcloud.com/%s", bucket, region, strings.TrimPrefix(key, "/"))
+}
+
+// cosPresign signs a request for rawurl with the client's credentials, so
+// that anyone holding the returned URL can make it until start+expires
+// without credentials of their own. Only the method and path are signed.
+func cosPresign(tc *tcapi.Client, method, rawurl string, start time.Time, expires time.Duration) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+
+	keyTime := fmt.Sprintf("%d;%d", start.Unix(), start.Add(expires).Unix())
+	signKey := hmacSHA1(tc.Secret, keyTime)
+	httpString := fmt.Sprintf("%s\n%s\n\n\n", strings.ToLower(method), u.Path)
+	stringToSign := fmt.Sprintf("sha1\n%s\n%x\n", keyTime, sha1.Sum([]byte(httpString)))
+
+	q := u.Query()
+	q.Set("q-sign-algorithm", "sha1")
+	q.Set("q-ak", tc.SecretId)
+	q.Set("q-sign-time", keyTime)
+	q.Set("q-key-time", keyTime)
+	q.Set("q-header-list", "")
+	q.Set("q-url-param-list", "")
+	q.Set("q-signature", hmacSHA1(signKey, stringToSign))
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func hmacSHA1(key, data string) string {
+	mac := hmac.New(sha1.New, []byte(key))
+	mac.Write([]byte(data))
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
+
+// headCOSObject checks that the object at rawurl exists, returning an error
+// containing "NotFound" if it doesn't
+func headCOSObject(tc *tcapi.Client, rawurl string) error {
+	signed, err := cosPresign(tc, "HEAD", rawurl, time.Now().Add(-time.Minute), 10*time.Minute)
+	if err != nil {
+		return err
+	}
+	httpClient := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+	resp, err := httpClient.Head(signed)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("NotFound: no object at %s", rawurl)
+	default:
+		return fmt.Errorf("checking object at %s: %s", rawurl, resp.Status)
+	}
+}
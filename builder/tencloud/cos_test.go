@@ -0,0 +1,80 @@
+package tencloud
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/3van/tencloud-go"
+)
+
+func TestCOSObjectURL(t *testing.T) {
+	cases := []struct {
+		key      string
+		expected string
+	}{
+		{"images/img-1.qcow2", "https://bucket-125.cos.ap-guangzhou.myqcloud.com/images/img-1.qcow2"},
+		{"/images/img-1.qcow2", "https://bucket-125.cos.ap-guangzhou.myqcloud.com/images/img-1.qcow2"},
+		{"https://other-125.cos.ap-beijing.myqcloud.com/img-1.raw", "https://other-125.cos.ap-beijing.myqcloud.com/img-1.raw"},
+	}
+	for _, c := range cases {
+		if got := cosObjectURL("bucket-125", "ap-guangzhou", c.key); got != c.expected {
+			t.Fatalf("%s: bad: %s", c.key, got)
+		}
+	}
+}
+
+func TestCOSPresign(t *testing.T) {
+	tc := &tcapi.Client{SecretId: "AKIDexample", Secret: "secret"}
+	start := time.Unix(1557989151, 0)
+
+	signed, err := cosPresign(tc, "GET", "https://bucket-125.cos.ap-guangzhou.myqcloud.com/img-1.qcow2", start, 2*time.Hour)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	q := u.Query()
+	if q.Get("q-ak") != "AKIDexample" || q.Get("q-sign-algorithm") != "sha1" || q.Get("q-key-time") != "1557989151;1557996351" {
+		t.Fatalf("bad: %s", signed)
+	}
+	if len(q.Get("q-signature")) != 40 {
+		t.Fatalf("bad signature: %s", signed)
+	}
+
+	// the signature covers the method and the path
+	other, _ := cosPresign(tc, "HEAD", "https://bucket-125.cos.ap-guangzhou.myqcloud.com/img-1.qcow2", start, 2*time.Hour)
+	if o, _ := url.Parse(other); o.Query().Get("q-signature") == q.Get("q-signature") {
+		t.Fatal("method not signed")
+	}
+	other, _ = cosPresign(tc, "GET", "https://bucket-125.cos.ap-guangzhou.myqcloud.com/img-2.qcow2", start, 2*time.Hour)
+	if o, _ := url.Parse(other); o.Query().Get("q-signature") == q.Get("q-signature") {
+		t.Fatal("path not signed")
+	}
+}
+
+func TestHeadCOSObject(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" || r.URL.Query().Get("q-signature") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/img-1.qcow2" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}))
+	defer server.Close()
+
+	tc := &tcapi.Client{SecretId: "AKIDexample", Secret: "secret"}
+	if err := headCOSObject(tc, server.URL+"/img-1.qcow2"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := headCOSObject(tc, server.URL+"/img-2.qcow2"); err == nil || !isNotFound(err) {
+		t.Fatalf("should be not found: %v", err)
+	}
+}
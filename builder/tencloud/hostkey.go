@@ -0,0 +1,147 @@
+package tencloud
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net"
+	"net/textproto"
+	"strings"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"golang.org/x/crypto/ssh"
+)
+
+// Ways of checking the instance's SSH host key
+const (
+	hostKeyCheckStrict = "strict"
+	hostKeyCheckTOFU   = "tofu"
+	hostKeyCheckOff    = "off"
+)
+
+// hostKeyUserData generates the instance's SSH host key on the build host
+// and adds it to userData as cloud-config, in a multipart message alongside
+// the user data there was. It returns the new user data and the host key to
+// pin.
+func hostKeyUserData(userData string) (string, ssh.PublicKey, error) {
+	privateKey, publicKey, err := generateKeyPair(keyTypeED25519, 0)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not generate host key: %s", err)
+	}
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil {
+		return "", nil, fmt.Errorf("could not generate host key: %s", err)
+	}
+
+	cloudConfig := "#cloud-config\nssh_keys:\n  ed25519_private: |\n"
+	for _, line := range strings.Split(strings.TrimSpace(privateKey), "\n") {
+		cloudConfig += "    " + line + "\n"
+	}
+	cloudConfig += "  ed25519_public: " + publicKey + "\n"
+
+	// user data that's valid base64 is taken as already encoded
+	if decoded, err := base64.StdEncoding.DecodeString(userData); err == nil {
+		userData = string(decoded)
+	}
+	if userData == "" {
+		return cloudConfig, hostKey, nil
+	}
+
+	// cloud-init works out the type of text/plain parts from their content
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=\"%s\"\nMIME-Version: 1.0\n\n", w.Boundary())
+	parts := []struct {
+		contentType string
+		body        string
+	}{
+		{"text/cloud-config", cloudConfig},
+		{"text/plain", userData},
+	}
+	for _, part := range parts {
+		pw, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {part.contentType + "; charset=\"utf-8\""},
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		if _, err := pw.Write([]byte(part.body)); err != nil {
+			return "", nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return "", nil, err
+	}
+
+	return buf.String(), hostKey, nil
+}
+
+// sshHostKeyCallback checks the instance's host key: against the one put in
+// its user data when strict, against the first one seen when tofu, and not at
+// all when off
+func sshHostKeyCallback(mode string, state multistep.StateBag) (ssh.HostKeyCallback, error) {
+	switch mode {
+	case hostKeyCheckStrict:
+		hostKey, ok := state.GetOk("hostKey")
+		if !ok {
+			return nil, fmt.Errorf("no host key was set for the instance")
+		}
+		return ssh.FixedHostKey(hostKey.(ssh.PublicKey)), nil
+
+	case hostKeyCheckTOFU:
+		return tofuHostKeyCallback(state, "hostKey"), nil
+	}
+
+	return ssh.InsecureIgnoreHostKey(), nil
+}
+
+// bastionHostKeyCallback checks the bastion's host key: against pinned if
+// it's set, and otherwise against the first one seen unless mode is off. The
+// builder can't put a host key on a bastion it didn't create, so strict
+// takes the first one seen as well.
+func bastionHostKeyCallback(mode, pinned string, state multistep.StateBag) (ssh.HostKeyCallback, error) {
+	if pinned != "" {
+		hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pinned))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse bastion host key: %s", err)
+		}
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if !bytes.Equal(hostKey.Marshal(), key.Marshal()) {
+				return fmt.Errorf("%s: host key of bastion %s is %s, expected %s", hostKeyMismatch, hostname, ssh.FingerprintSHA256(key), ssh.FingerprintSHA256(hostKey))
+			}
+			return nil
+		}, nil
+	}
+	if mode == hostKeyCheckOff {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	return tofuHostKeyCallback(state, "bastionHostKey"), nil
+}
+
+// tofuHostKeyCallback trusts the first host key seen, keeping it in state
+// under stateKey, and rejects any other after it
+func tofuHostKeyCallback(state multistep.StateBag, stateKey string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if pinned, ok := state.GetOk(stateKey); ok {
+			if !bytes.Equal(pinned.(ssh.PublicKey).Marshal(), key.Marshal()) {
+				return fmt.Errorf("%s: host key of %s changed from %s to %s", hostKeyMismatch, hostname, ssh.FingerprintSHA256(pinned.(ssh.PublicKey)), ssh.FingerprintSHA256(key))
+			}
+			return nil
+		}
+		log.Printf("trusting host key %s of %s on first use", ssh.FingerprintSHA256(key), hostname)
+		state.Put(stateKey, key)
+		return nil
+	}
+}
+
+// hostKeyMismatch is in the errors of every host key check that fails,
+// including ssh.FixedHostKey's
+const hostKeyMismatch = "host key mismatch"
+
+// isHostKeyMismatch reports whether err is a host key check failing, which
+// retrying won't fix
+func isHostKeyMismatch(err error) bool {
+	return strings.Contains(err.Error(), hostKeyMismatch)
+}
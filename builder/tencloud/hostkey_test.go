@@ -0,0 +1,109 @@
+package tencloud
+
+import (
+	"bufio"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestHostKeyUserData(t *testing.T) {
+	userData, hostKey, err := hostKeyUserData("")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.HasPrefix(userData, "#cloud-config\n") || !strings.Contains(userData, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(hostKey)))) {
+		t.Fatalf("bad user data: %s", userData)
+	}
+
+	userData, _, err = hostKeyUserData("#!/bin/sh\necho hello\n")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	msg, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(userData)))
+	if err != nil {
+		t.Fatalf("bad multipart user data: %s", err)
+	}
+	if !strings.HasPrefix(msg.Header.Get("Content-Type"), "multipart/mixed") {
+		t.Fatalf("bad content type: %s", msg.Header.Get("Content-Type"))
+	}
+	if !strings.Contains(userData, "echo hello") || !strings.Contains(userData, "ed25519_private") {
+		t.Fatalf("parts missing: %s", userData)
+	}
+}
+
+func TestSSHHostKeyCallback_tofu(t *testing.T) {
+	_, first, _ := generateKeyPair(keyTypeED25519, 0)
+	_, second, _ := generateKeyPair(keyTypeED25519, 0)
+	firstKey, _, _, _, _ := ssh.ParseAuthorizedKey([]byte(first))
+	secondKey, _, _, _, _ := ssh.ParseAuthorizedKey([]byte(second))
+
+	state := new(multistep.BasicStateBag)
+	callback, err := sshHostKeyCallback(hostKeyCheckTOFU, state)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := callback("instance", nil, firstKey); err != nil {
+		t.Fatalf("first key should be trusted: %s", err)
+	}
+	if err := callback("instance", nil, firstKey); err != nil {
+		t.Fatalf("pinned key should be trusted: %s", err)
+	}
+	if err := callback("instance", nil, secondKey); err == nil || !isHostKeyMismatch(err) {
+		t.Fatalf("changed key should be rejected as a mismatch: %v", err)
+	}
+
+	if _, err := sshHostKeyCallback(hostKeyCheckStrict, new(multistep.BasicStateBag)); err == nil {
+		t.Fatal("strict needs a host key")
+	}
+}
+
+func TestBastionHostKeyCallback(t *testing.T) {
+	_, first, _ := generateKeyPair(keyTypeED25519, 0)
+	_, second, _ := generateKeyPair(keyTypeED25519, 0)
+	firstKey, _, _, _, _ := ssh.ParseAuthorizedKey([]byte(first))
+	secondKey, _, _, _, _ := ssh.ParseAuthorizedKey([]byte(second))
+
+	// the bastion's key is pinned apart from the instance's
+	state := new(multistep.BasicStateBag)
+	state.Put("hostKey", secondKey)
+	for _, mode := range []string{hostKeyCheckTOFU, hostKeyCheckStrict} {
+		callback, err := bastionHostKeyCallback(mode, "", state)
+		if err != nil {
+			t.Fatalf("%s: err: %s", mode, err)
+		}
+		if err := callback("bastion", nil, firstKey); err != nil {
+			t.Fatalf("%s: first key should be trusted: %s", mode, err)
+		}
+		if err := callback("bastion", nil, secondKey); err == nil || !isHostKeyMismatch(err) {
+			t.Fatalf("%s: changed key should be rejected as a mismatch: %v", mode, err)
+		}
+	}
+
+	callback, err := bastionHostKeyCallback(hostKeyCheckOff, "", new(multistep.BasicStateBag))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := callback("bastion", nil, secondKey); err != nil {
+		t.Fatalf("off should accept any key: %s", err)
+	}
+
+	// a configured key is checked even when off
+	callback, err = bastionHostKeyCallback(hostKeyCheckOff, first, new(multistep.BasicStateBag))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := callback("bastion", nil, firstKey); err != nil {
+		t.Fatalf("configured key should be trusted: %s", err)
+	}
+	if err := callback("bastion", nil, secondKey); err == nil || !isHostKeyMismatch(err) {
+		t.Fatalf("other key should be rejected as a mismatch: %v", err)
+	}
+
+	if _, err := bastionHostKeyCallback(hostKeyCheckTOFU, "not a key", state); err == nil {
+		t.Fatal("should have error")
+	}
+}
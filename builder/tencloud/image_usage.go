@@ -0,0 +1,129 @@
+package tencloud
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/3van/tencloud-go"
+)
+
+// DefaultProtectionTag is the tag key that marks an image as protected from
+// deletion when deletion_protection_tag isn't set
+const DefaultProtectionTag = "packer-protected"
+
+// ImageUsage lists what still references each image of a region, keyed by
+// image ID. Images that nothing references are absent.
+type ImageUsage map[string][]string
+
+// findImageUsage looks for scaling configurations and launch templates that
+// launch from any of imageIds, accounts other than ownShares the images are
+// shared with and the protection tag, all of which make an image unsafe to
+// delete. ownShares are the accounts the builder itself shares images with,
+// deleteImage revokes those shares.
+func findImageUsage(tc *tcapi.Client, imageIds []string, protectionTag string, ownShares []string) (ImageUsage, error) {
+	usage := make(ImageUsage)
+	if len(imageIds) == 0 {
+		return usage, nil
+	}
+
+	for offset := 0; ; offset += 100 {
+		resp, err := tc.DescribeScalingConfiguration(&tcapi.DescribeScalingConfigurationRequest{
+			Offset: offset,
+			Limit:  100,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not list scaling configurations: %s", err)
+		}
+		for _, sc := range resp.ScalingConfigurationSet {
+			if stringInSlice(sc.ImageId, imageIds) {
+				usage.add(sc.ImageId, fmt.Sprintf("scaling configuration '%s' (%s)", sc.ScalingConfigurationId, sc.ScalingConfigurationName))
+			}
+		}
+		if len(resp.ScalingConfigurationSet) == 0 || offset+100 >= resp.TotalCount {
+			break
+		}
+	}
+
+	for offset := 0; ; offset += 100 {
+		resp, err := describeLaunchTemplates(tc, &describeLaunchTemplatesRequest{
+			Offset: offset,
+			Limit:  100,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not list launch templates: %s", err)
+		}
+		for _, lt := range resp.LaunchTemplateSet {
+			if err := usage.addLaunchTemplate(tc, lt, imageIds); err != nil {
+				return nil, err
+			}
+		}
+		if len(resp.LaunchTemplateSet) == 0 || offset+100 >= resp.TotalCount {
+			break
+		}
+	}
+
+	for _, imageId := range imageIds {
+		shared, err := imageSharedAccounts(tc, imageId)
+		if err != nil {
+			return nil, fmt.Errorf("could not list accounts image '%s' is shared with: %s", imageId, err)
+		}
+		for _, account := range shared {
+			if stringInSlice(account, ownShares) {
+				continue
+			}
+			usage.add(imageId, fmt.Sprintf("shared with account '%s'", account))
+		}
+	}
+
+	if protectionTag != "" {
+		tags, err := imageResourceTags(tc, imageIds)
+		if err != nil {
+			return nil, err
+		}
+		for _, imageId := range imageIds {
+			if value, ok := tags[imageId][protectionTag]; ok {
+				usage.add(imageId, fmt.Sprintf("protection tag '%s=%s'", protectionTag, value))
+			}
+		}
+	}
+
+	return usage, nil
+}
+
+func (u ImageUsage) add(imageId, ref string) {
+	u[imageId] = append(u[imageId], ref)
+}
+
+func (u ImageUsage) addLaunchTemplate(tc *tcapi.Client, lt launchTemplate, imageIds []string) error {
+	for offset := 0; ; offset += 100 {
+		resp, err := describeLaunchTemplateVersions(tc, &describeLaunchTemplateVersionsRequest{
+			LaunchTemplateId: lt.LaunchTemplateId,
+			Offset:           offset,
+			Limit:            100,
+		})
+		if err != nil {
+			return fmt.Errorf("could not list versions of launch template '%s': %s", lt.LaunchTemplateId, err)
+		}
+		for _, v := range resp.LaunchTemplateVersionSet {
+			if imageId := v.LaunchTemplateVersionData.ImageId; stringInSlice(imageId, imageIds) {
+				u.add(imageId, fmt.Sprintf("launch template '%s' (%s) version %d", lt.LaunchTemplateId, lt.LaunchTemplateName, v.LaunchTemplateVersion))
+			}
+		}
+		if len(resp.LaunchTemplateVersionSet) == 0 || offset+100 >= resp.TotalCount {
+			return nil
+		}
+	}
+}
+
+// Err returns an error naming everything that references imageId, or nil if
+// nothing does
+func (u ImageUsage) Err(imageId string) error {
+	refs := u[imageId]
+	if len(refs) == 0 {
+		return nil
+	}
+	sorted := append([]string(nil), refs...)
+	sort.Strings(sorted)
+	return fmt.Errorf("image '%s' is in use (set force_deregister_in_use to delete it anyway): %s", imageId, strings.Join(sorted, ", "))
+}
@@ -0,0 +1,257 @@
+package tencloud
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/3van/tencloud-go"
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// CreatedImages records every image a build creates, by region, as soon as
+// its ID is known, so a failed build can remove all of them. That includes
+// the copies imported into target accounts.
+type CreatedImages struct {
+	mu       sync.Mutex
+	images   map[string][]string
+	accounts []accountImage
+	journal  *Journal
+}
+
+// accountImage is an image imported into another account, which the role
+// gives access to
+type accountImage struct {
+	Account string
+	Role    string
+	Region  string
+	ImageId string
+}
+
+func NewCreatedImages(journal *Journal) *CreatedImages {
+	return &CreatedImages{
+		images:  make(map[string][]string),
+		journal: journal,
+	}
+}
+
+// Add records an image created in region
+func (c *CreatedImages) Add(region, imageId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if imageId == "" || stringInSlice(imageId, c.images[region]) {
+		return
+	}
+	c.images[region] = append(c.images[region], imageId)
+	c.journal.Created(journalImage, region, imageId)
+}
+
+// AddAccountImage records an image imported into account in region, which
+// role gives access to
+func (c *CreatedImages) AddAccountImage(account, role, region, imageId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, a := range c.accounts {
+		if a.Region == region && a.ImageId == imageId {
+			return
+		}
+	}
+	c.accounts = append(c.accounts, accountImage{
+		Account: account,
+		Role:    role,
+		Region:  region,
+		ImageId: imageId,
+	})
+	c.journal.CreatedInAccount(role, journalAccountImage, region, imageId)
+}
+
+// Regions returns the regions images were created in, sorted
+func (c *CreatedImages) Regions() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	regions := make([]string, 0, len(c.images))
+	for region := range c.images {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	return regions
+}
+
+// Get returns the images created in region
+func (c *CreatedImages) Get(region string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.images[region]...)
+}
+
+// Rollback deletes every recorded image, first waiting for copies that are
+// still syncing to settle, and returns the images it couldn't remove.
+func (c *CreatedImages) Rollback(state multistep.StateBag) error {
+	tc := state.Get("tc").(*tcapi.Client)
+	ui := state.Get("ui").(packer.Ui)
+
+	errs := new(packer.MultiError)
+	for _, region := range c.Regions() {
+		imageIds := c.Get(region)
+		thisClient := tc.Copy(region, nil)
+
+		if err := waitForImagesToSettle(thisClient, imageIds); err != nil {
+			ui.Error(fmt.Sprintf("images in region '%s' didn't settle, deleting anyway: %s", region, err))
+		}
+
+		for _, imageId := range imageIds {
+			ui.Message(fmt.Sprintf("deleting image '%s' from region '%s'", imageId, region))
+			if err := deleteImage(thisClient, imageId); err != nil {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("could not delete image '%s' in region '%s': %s", imageId, region, err))
+				continue
+			}
+			c.journal.Deleted(journalImage, region, imageId)
+		}
+	}
+
+	if len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// waitForImagesToSettle waits until none of imageIds are still being created
+// or synced, as images in those states can't be deleted.
+func waitForImagesToSettle(tc *tcapi.Client, imageIds []string) error {
+	stateChange := StateChangeConf{
+		Pending: []string{"busy"},
+		Target:  "settled",
+		Refresh: func() (interface{}, string, error) {
+			resp, err := tc.DescribeImages(&tcapi.DescribeImagesRequest{
+				ImageIds: imageIds,
+				Limit:    len(imageIds),
+			})
+			if err != nil {
+				return nil, "", err
+			}
+
+			busy := 0
+			for _, image := range resp.ImageSet {
+				switch image.ImageState {
+				case "SYNCING", "CREATING", "PENDING":
+					log.Printf("image '%s' is still %s", image.ImageId, image.ImageState)
+					busy++
+				}
+			}
+			if busy > 0 {
+				return resp.ImageSet, "busy", nil
+			}
+			return resp.ImageSet, "settled", nil
+		},
+	}
+	_, err := WaitForState(&stateChange)
+	return err
+}
+
+// deleteImage revokes any shares of an image, which would otherwise block
+// its deletion, and deletes it.
+func deleteImage(tc *tcapi.Client, imageId string) error {
+	shared, err := imageSharedAccounts(tc, imageId)
+	if err != nil {
+		return err
+	}
+	if len(shared) > 0 {
+		log.Printf("unsharing image '%s' from accounts %v", imageId, shared)
+		err := tc.ModifyImageSharePermission(&tcapi.ModifyImageSharePermissionRequest{
+			ImageId:    imageId,
+			AccountIds: shared,
+			Permission: "CANCEL",
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return tc.DeleteImages(&tcapi.DeleteImagesRequest{
+		ImageIds: []string{
+			imageId,
+		},
+	})
+}
+
+// RollbackAccounts deletes every recorded image in other accounts, and
+// returns the images it couldn't remove.
+func (c *CreatedImages) RollbackAccounts(state multistep.StateBag) error {
+	tc := state.Get("tc").(*tcapi.Client)
+	ui := state.Get("ui").(packer.Ui)
+
+	errs := new(packer.MultiError)
+	c.mu.Lock()
+	accounts := append([]accountImage(nil), c.accounts...)
+	c.mu.Unlock()
+	for _, a := range accounts {
+		ui.Message(fmt.Sprintf("deleting image '%s' from account '%s' in region '%s'", a.ImageId, a.Account, a.Region))
+		roleClient, token, err := assumeRole(tc, a.Role, a.Region)
+		if err == nil {
+			err = deleteAccountImage(roleClient, token, a.ImageId)
+		}
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("could not delete image '%s' from account '%s' in region '%s': %s", a.ImageId, a.Account, a.Region, err))
+			continue
+		}
+		c.journal.DeletedInAccount(a.Role, journalAccountImage, a.Region, a.ImageId)
+	}
+
+	if len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// deleteAccountImage deletes an image in another account using temporary
+// credentials and token, doing nothing if it's already gone
+func deleteAccountImage(tc *tcapi.Client, token, imageId string) error {
+	resp := new(tcapi.DescribeImagesResponse)
+	err := callAPIWithToken(tc, token, "image", "DescribeImages", &tcapi.DescribeImagesRequest{
+		ImageIds: []string{
+			imageId,
+		},
+	}, resp)
+	if err != nil {
+		return err
+	}
+	if len(resp.ImageSet) == 0 {
+		return nil
+	}
+	return callAPIWithToken(tc, token, "image", "DeleteImages", &tcapi.DeleteImagesRequest{
+		ImageIds: []string{
+			imageId,
+		},
+	}, nil)
+}
+
+// tagImageBuildState tags images in region with the build's UUID, name and
+// template hash and the state of the build, which is "incomplete" until every
+// step has run.
+func tagImageBuildState(state multistep.StateBag, region string, imageIds []string, buildState string) error {
+	tc := state.Get("tc").(*tcapi.Client)
+	config := state.Get("config").(Config)
+	if len(imageIds) == 0 {
+		return nil
+	}
+
+	uin, err := ownerUin(state)
+	if err != nil {
+		return err
+	}
+	resources := make([]string, 0, len(imageIds))
+	for _, imageId := range imageIds {
+		resources = append(resources, resourceName(region, uin, "image", imageId))
+	}
+	return tagResources(tc, &tagResourcesRequest{
+		ResourceList: resources,
+		Tags: TagMap{
+			BuildUUIDTag:    config.BuildUUID(),
+			BuildNameTag:    config.buildTags[BuildNameTag],
+			TemplateHashTag: config.buildTags[TemplateHashTag],
+			BuildStateTag:   buildState,
+		}.tcTags(),
+	})
+}
@@ -0,0 +1,73 @@
+package tencloud
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/3van/tencloud-go"
+)
+
+func TestCreatedImagesRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tc-images")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	images := newFakeImages(
+		&fakeImage{Image: tcapi.Image{ImageId: "img-1"}, Region: "ap-guangzhou", Shared: []string{"100"}},
+		&fakeImage{Image: tcapi.Image{ImageId: "img-2"}, Region: "ap-shanghai"},
+		&fakeImage{Image: tcapi.Image{ImageId: "img-3"}, Region: "ap-shanghai"},
+	)
+	handlers := images.handlers()
+	deleteImages := handlers["DeleteImages"]
+	handlers["DeleteImages"] = func(params url.Values) (interface{}, error) {
+		if stringInSlice("img-3", paramList(params, "ImageIds")) {
+			return nil, errors.New("InvalidImageId.InUse")
+		}
+		return deleteImages(params)
+	}
+	_, client, restore := useFakeAPI(handlers)
+	defer restore()
+
+	path := filepath.Join(dir, "journal")
+	created := NewCreatedImages(NewJournal(path, "build", "t1"))
+	created.Add("ap-guangzhou", "img-1")
+	created.Add("ap-shanghai", "img-2")
+	created.Add("ap-shanghai", "img-3")
+
+	err = created.Rollback(testStepState(client))
+	if err == nil || !strings.Contains(err.Error(), "img-3") {
+		t.Fatalf("error should name img-3: %v", err)
+	}
+
+	// the shared image is unshared so it can be deleted, and every region is
+	// rolled back despite the failure
+	for _, imageId := range []string{"img-1", "img-2"} {
+		if images.Get(imageId) != nil {
+			t.Fatalf("%s should have been deleted", imageId)
+		}
+	}
+	if images.Get("img-3") == nil {
+		t.Fatal("img-3 should still exist")
+	}
+
+	builds, err := readJournal(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	remaining := make([]string, 0)
+	for _, b := range builds {
+		for _, e := range b.Pending {
+			remaining = append(remaining, e.Id)
+		}
+	}
+	if strings.Join(remaining, ",") != "img-3" {
+		t.Fatalf("journal still has %v, expected only img-3", remaining)
+	}
+}
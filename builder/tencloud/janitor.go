@@ -0,0 +1,317 @@
+package tencloud
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/3van/tencloud-go"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+// JanitorConfig selects the resources the janitor treats as leftovers of
+// builds that were killed before they could clean up after themselves
+type JanitorConfig struct {
+	Regions   []string
+	OlderThan time.Duration
+	Prefix    string
+	Apply     bool
+}
+
+// Leftover is a temporary resource of a build that was never removed
+type Leftover struct {
+	Region  string
+	Kind    string
+	Id      string
+	Name    string
+	Created time.Time
+	Match   string
+}
+
+// RunJanitor finds the instances, key pairs, images and security groups that
+// builds left behind in the configured regions and reports them to out. They
+// are only deleted if Apply is set.
+func RunJanitor(tc *tcapi.Client, c JanitorConfig, out io.Writer) error {
+	if c.Prefix == "" {
+		c.Prefix = "packer"
+	}
+	cutoff := time.Now().Add(-c.OlderThan)
+
+	errs := new(packer.MultiError)
+	leftovers := make([]Leftover, 0)
+	hints := make([]Leftover, 0)
+	for _, region := range c.Regions {
+		found, named, err := findLeftovers(tc.Copy(region, nil), c.Prefix+"_", cutoff)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("could not scan region '%s': %s", region, err))
+		}
+		leftovers = append(leftovers, found...)
+		hints = append(hints, named...)
+	}
+
+	if len(hints) > 0 {
+		fmt.Fprintf(out, "these resources are named like build resources but carry no build tags, so they are left alone:\n")
+		for _, l := range hints {
+			fmt.Fprintf(out, "  %s '%s' (%s) in region '%s', created %s\n", l.Kind, l.Id, l.Name, l.Region, l.Created.Format(time.RFC3339))
+		}
+	}
+
+	if len(leftovers) == 0 {
+		fmt.Fprintf(out, "no leftovers older than %s found\n", c.OlderThan)
+	} else {
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "REGION\tKIND\tID\tNAME\tCREATED\tMATCHED BY")
+		for _, l := range leftovers {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", l.Region, l.Kind, l.Id, l.Name, l.Created.Format(time.RFC3339), l.Match)
+		}
+		w.Flush()
+
+		if c.Apply {
+			for _, err := range deleteLeftovers(tc, leftovers, out) {
+				errs = packer.MultiErrorAppend(errs, err)
+			}
+		} else {
+			fmt.Fprintf(out, "%d leftovers found, run again with --apply to delete them\n", len(leftovers))
+		}
+	}
+
+	if len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// leftoverSelector sorts a region's resources into leftovers, which carry
+// the build tags and were created before cutoff, and hints, which only have a
+// name starting with namePrefix. Hints are reported but never deleted, as
+// the name alone doesn't tell a killed build apart from anything else named
+// the same way.
+type leftoverSelector struct {
+	region     string
+	namePrefix string
+	cutoff     time.Time
+
+	leftovers []Leftover
+	hints     []Leftover
+}
+
+func (s *leftoverSelector) add(kind, id, name, created string, tags map[string]string) error {
+	uuid := tags[BuildUUIDTag]
+	named := s.namePrefix != "" && strings.HasPrefix(name, s.namePrefix)
+	if uuid == "" && !named {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, created)
+	if err != nil {
+		return fmt.Errorf("getting %s (%s) created time: %v", kind, id, err)
+	}
+	if t.After(s.cutoff) {
+		return nil
+	}
+
+	l := Leftover{
+		Region:  s.region,
+		Kind:    kind,
+		Id:      id,
+		Name:    name,
+		Created: t,
+	}
+	if uuid == "" {
+		l.Match = "name only"
+		s.hints = append(s.hints, l)
+		return nil
+	}
+	l.Match = fmt.Sprintf("build %s", uuid)
+	if creator := tags[CreatorTag]; creator != "" {
+		l.Match += fmt.Sprintf(" by %s", creator)
+	}
+	s.leftovers = append(s.leftovers, l)
+	return nil
+}
+
+// findLeftovers lists a region's resources created before cutoff that carry
+// the build tags, and separately the ones that merely have a name starting
+// with namePrefix
+func findLeftovers(tc *tcapi.Client, namePrefix string, cutoff time.Time) ([]Leftover, []Leftover, error) {
+	s := &leftoverSelector{
+		region:     tc.Region,
+		namePrefix: namePrefix,
+		cutoff:     cutoff,
+	}
+	instances := make([]tcapi.Instance, 0)
+	for offset := 0; ; offset += 100 {
+		resp, err := tc.DescribeInstances(&tcapi.DescribeInstancesRequest{
+			Offset: offset,
+			Limit:  100,
+		})
+		if err != nil {
+			return s.leftovers, s.hints, fmt.Errorf("could not list instances: %s", err)
+		}
+		instances = append(instances, resp.InstanceSet...)
+		if len(resp.InstanceSet) == 0 || offset+100 >= resp.TotalCount {
+			break
+		}
+	}
+	instanceIds := make([]string, 0, len(instances))
+	for _, instance := range instances {
+		instanceIds = append(instanceIds, instance.InstanceId)
+	}
+	instanceTags, err := resourceTags(tc, "cvm", "instance", instanceIds)
+	if err != nil {
+		return s.leftovers, s.hints, err
+	}
+	for _, instance := range instances {
+		if instance.InstanceState == "TERMINATING" {
+			continue
+		}
+		if err := s.add("instance", instance.InstanceId, instance.InstanceName, instance.CreatedTime, instanceTags[instance.InstanceId]); err != nil {
+			return s.leftovers, s.hints, err
+		}
+	}
+
+	keyPairs := make([]tcapi.KeyPair, 0)
+	for offset := 0; ; offset += 100 {
+		resp, err := tc.DescribeKeyPairs(&tcapi.DescribeKeyPairsRequest{
+			Offset: offset,
+			Limit:  100,
+		})
+		if err != nil {
+			return s.leftovers, s.hints, fmt.Errorf("could not list key pairs: %s", err)
+		}
+		keyPairs = append(keyPairs, resp.KeyPairSet...)
+		if len(resp.KeyPairSet) == 0 || offset+100 >= resp.TotalCount {
+			break
+		}
+	}
+	keyIds := make([]string, 0, len(keyPairs))
+	for _, keyPair := range keyPairs {
+		keyIds = append(keyIds, keyPair.KeyId)
+	}
+	keyTags, err := resourceTags(tc, "cvm", "keypair", keyIds)
+	if err != nil {
+		return s.leftovers, s.hints, err
+	}
+	for _, keyPair := range keyPairs {
+		if err := s.add("keypair", keyPair.KeyId, keyPair.KeyName, keyPair.CreatedTime, keyTags[keyPair.KeyId]); err != nil {
+			return s.leftovers, s.hints, err
+		}
+	}
+
+	// images are the product of a build rather than temporary, so only the
+	// ones still marked incomplete are leftovers
+	images, err := privateImagesNamed(tc, "")
+	if err != nil {
+		return s.leftovers, s.hints, fmt.Errorf("could not list images: %s", err)
+	}
+	imageIds := make([]string, 0, len(images))
+	for _, image := range images {
+		imageIds = append(imageIds, image.ImageId)
+	}
+	imageTags, err := imageResourceTags(tc, imageIds)
+	if err != nil {
+		return s.leftovers, s.hints, err
+	}
+	for _, image := range images {
+		tags := imageTags[image.ImageId]
+		if tags[BuildStateTag] != "incomplete" {
+			continue
+		}
+		if err := s.add("image", image.ImageId, image.ImageName, image.CreatedTime, tags); err != nil {
+			return s.leftovers, s.hints, err
+		}
+	}
+
+	for offset := 0; ; offset += 100 {
+		resp, err := describeSecurityGroups(tc, &describeSecurityGroupsRequest{
+			Offset: strconv.Itoa(offset),
+			Limit:  "100",
+		})
+		if err != nil {
+			return s.leftovers, s.hints, fmt.Errorf("could not list security groups: %s", err)
+		}
+		for _, sg := range resp.SecurityGroupSet {
+			tags := make(map[string]string)
+			for _, tag := range sg.TagSet {
+				tags[tag.Key] = tag.Value
+			}
+			// security groups report their created time in Beijing time,
+			// without a zone
+			created := sg.CreatedTime
+			if t, err := time.ParseInLocation("2006-01-02 15:04:05", created, time.FixedZone("CST", 8*60*60)); err == nil {
+				created = t.Format(time.RFC3339)
+			}
+			if err := s.add("security group", sg.SecurityGroupId, sg.SecurityGroupName, created, tags); err != nil {
+				return s.leftovers, s.hints, err
+			}
+		}
+		if len(resp.SecurityGroupSet) == 0 || offset+100 >= resp.TotalCount {
+			break
+		}
+	}
+
+	return s.leftovers, s.hints, nil
+}
+
+// deleteLeftovers removes leftovers, instances first as they hold on to the
+// key pairs and security groups
+func deleteLeftovers(tc *tcapi.Client, leftovers []Leftover, out io.Writer) []error {
+	order := map[string]int{
+		"instance":       0,
+		"image":          1,
+		"keypair":        2,
+		"security group": 3,
+	}
+	sorted := append([]Leftover(nil), leftovers...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return order[sorted[i].Kind] < order[sorted[j].Kind]
+	})
+
+	var errs []error
+	for _, l := range sorted {
+		thisClient := tc.Copy(l.Region, nil)
+
+		var err error
+		switch l.Kind {
+		case "instance":
+			err = thisClient.TerminateInstances(&tcapi.TerminateInstancesRequest{
+				InstanceIds: []string{
+					l.Id,
+				},
+			})
+		case "image":
+			var usage ImageUsage
+			usage, err = findImageUsage(thisClient, []string{l.Id}, DefaultProtectionTag, nil)
+			if err == nil {
+				err = usage.Err(l.Id)
+			}
+			if err == nil {
+				err = deleteImage(thisClient, l.Id)
+			}
+		case "keypair":
+			err = thisClient.DeleteKeyPairs(&tcapi.DeleteKeyPairsRequest{
+				KeyIds: []string{
+					l.Id,
+				},
+			})
+		case "security group":
+			err = deleteSecurityGroup(thisClient, &deleteSecurityGroupRequest{
+				SecurityGroupId: l.Id,
+			})
+		}
+		if err != nil {
+			if l.Kind == "keypair" || l.Kind == "security group" {
+				err = fmt.Errorf("%s (it may still be used by an instance that's terminating, run again later)", err)
+			}
+			errs = append(errs, fmt.Errorf("could not delete %s '%s' in region '%s': %s", l.Kind, l.Id, l.Region, err))
+			continue
+		}
+		fmt.Fprintf(out, "deleted %s '%s' (%s) in region '%s'\n", l.Kind, l.Id, l.Name, l.Region)
+	}
+
+	return errs
+}
@@ -0,0 +1,74 @@
+package tencloud
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLeftoverSelector(t *testing.T) {
+	cutoff := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	old := "2020-01-01T00:00:00Z"
+	recent := "2020-01-03T00:00:00Z"
+
+	cases := []struct {
+		name    string
+		created string
+		tags    map[string]string
+		match   string
+		hint    bool
+	}{
+		{"packer_1", old, map[string]string{BuildUUIDTag: "abc", CreatorTag: "ci"}, "build abc by ci", false},
+		{"packer_2", old, map[string]string{BuildUUIDTag: "abc"}, "build abc", false},
+		{"renamed", old, map[string]string{BuildUUIDTag: "abc"}, "build abc", false},
+		{"packer_3", old, nil, "name only", true},
+		{"packer_4", old, map[string]string{CreatorTag: "ci"}, "name only", true},
+		{"packer_5", recent, map[string]string{BuildUUIDTag: "abc"}, "", false},
+		{"packer_6", recent, nil, "", false},
+		{"web", old, nil, "", false},
+		{"web", old, map[string]string{"app": "web"}, "", false},
+	}
+
+	for _, c := range cases {
+		s := &leftoverSelector{
+			region:     "ap-guangzhou",
+			namePrefix: "packer_",
+			cutoff:     cutoff,
+		}
+		if err := s.add("instance", "ins-1", c.name, c.created, c.tags); err != nil {
+			t.Fatalf("%s: err: %s", c.name, err)
+		}
+
+		found := s.leftovers
+		if c.hint {
+			found = s.hints
+		}
+		if len(s.leftovers)+len(s.hints) > 1 {
+			t.Fatalf("%s: selected more than once: %#v %#v", c.name, s.leftovers, s.hints)
+		}
+		if c.match == "" {
+			if len(s.leftovers)+len(s.hints) != 0 {
+				t.Fatalf("%s: should not be selected: %#v %#v", c.name, s.leftovers, s.hints)
+			}
+			continue
+		}
+		if len(found) != 1 {
+			t.Fatalf("%s: bad selection, hint %t: %#v %#v", c.name, c.hint, s.leftovers, s.hints)
+		}
+		if found[0].Match != c.match || found[0].Region != "ap-guangzhou" || found[0].Id != "ins-1" {
+			t.Fatalf("%s: bad: %#v", c.name, found[0])
+		}
+	}
+}
+
+func TestLeftoverSelector_badCreatedTime(t *testing.T) {
+	s := &leftoverSelector{
+		namePrefix: "packer_",
+		cutoff:     time.Now(),
+	}
+	if err := s.add("keypair", "skey-1", "packer_1", "yesterday", nil); err == nil {
+		t.Fatal("should have error")
+	}
+	if err := s.add("keypair", "skey-2", "other", "yesterday", nil); err != nil {
+		t.Fatalf("unselected resource should not be parsed: %s", err)
+	}
+}
@@ -0,0 +1,536 @@
+package tencloud
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/3van/tencloud-go"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+// DefaultCleanupJournal is where the cleanup journal is kept when
+// cleanup_journal isn't set
+const DefaultCleanupJournal = "tc_cleanup.journal"
+
+// Kinds of resources recorded in the cleanup journal
+const (
+	journalInstance      = "instance"
+	journalKeyPair       = "keypair"
+	journalImage         = "image"
+	journalSecurityGroup = "security_group"
+	journalAddress       = "eip"
+	journalAccountImage  = "account_image"
+)
+
+// JournalEntry is one line of the cleanup journal
+type JournalEntry struct {
+	Time     time.Time `json:"time"`
+	Build    string    `json:"build"`
+	Template string    `json:"template,omitempty"`
+	Host     string    `json:"host"`
+	Pid      int       `json:"pid"`
+	Op       string    `json:"op"`
+	Kind     string    `json:"kind,omitempty"`
+	Region   string    `json:"region,omitempty"`
+	Id       string    `json:"id,omitempty"`
+	// Role is assumed to delete resources in other accounts
+	Role string `json:"role,omitempty"`
+}
+
+// Journal appends the resources a build creates and deletes to a file as it
+// goes, so that whatever a crashed build leaves behind can be removed by a
+// later run. A nil Journal records nothing.
+type Journal struct {
+	mu       sync.Mutex
+	path     string
+	build    string
+	template string
+	host     string
+	pid      int
+}
+
+// NewJournal returns a journal for the build with the given UUID, recording
+// the hash of its template so a later build only cleans up after its own
+func NewJournal(path, build, template string) *Journal {
+	host, _ := os.Hostname()
+	return &Journal{
+		path:     path,
+		build:    build,
+		template: template,
+		host:     host,
+		pid:      os.Getpid(),
+	}
+}
+
+// Created records a resource the build created
+func (j *Journal) Created(kind, region, id string) {
+	j.append("create", kind, region, id, "")
+}
+
+// Deleted records a resource the build deleted
+func (j *Journal) Deleted(kind, region, id string) {
+	j.append("delete", kind, region, id, "")
+}
+
+// CreatedInAccount records a resource the build created in another account,
+// which role gives access to
+func (j *Journal) CreatedInAccount(role, kind, region, id string) {
+	j.append("create", kind, region, id, role)
+}
+
+// DeletedInAccount records a resource the build deleted in another account
+func (j *Journal) DeletedInAccount(role, kind, region, id string) {
+	j.append("delete", kind, region, id, role)
+}
+
+// Aborted records that the build failed and left its resources in place on
+// purpose, as it does with -on-error=abort
+func (j *Journal) Aborted() {
+	j.append("abort", "", "", "", "")
+}
+
+// Done records that the build finished and ran its cleanup. The images it
+// didn't delete by then are its product.
+func (j *Journal) Done() {
+	j.append("done", "", "", "", "")
+}
+
+// append writes an entry and syncs it, so it survives the process being
+// killed right after. The build carries on if the journal can't be written.
+func (j *Journal) append(op, kind, region, id, role string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	line, err := json.Marshal(&JournalEntry{
+		Time:     time.Now().UTC(),
+		Build:    j.build,
+		Template: j.template,
+		Host:     j.host,
+		Pid:      j.pid,
+		Op:       op,
+		Kind:     kind,
+		Region:   region,
+		Id:       id,
+		Role:     role,
+	})
+	if err != nil {
+		log.Printf("could not encode cleanup journal entry: %s", err)
+		return
+	}
+
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("could not open cleanup journal '%s': %s", j.path, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("could not write cleanup journal '%s': %s", j.path, err)
+		return
+	}
+	if err := f.Sync(); err != nil {
+		log.Printf("could not sync cleanup journal '%s': %s", j.path, err)
+	}
+}
+
+// journalBuild is what the journal knows about one build
+type journalBuild struct {
+	Id       string
+	Template string
+	Host     string
+	Pid      int
+	Done     bool
+	Aborted  bool
+	Pending  []JournalEntry
+}
+
+// ReplayOptions select the builds ReplayJournal leaves alone
+type ReplayOptions struct {
+	// KeepAborted skips builds that were aborted with -on-error=abort
+	KeepAborted bool
+	// Skip lists the UUIDs of builds to skip
+	Skip []string
+	// Template only replays the builds of the template with this hash, if
+	// set
+	Template string
+	// TerminateTimeout is how long to wait for instances to terminate, the
+	// default timeout if not set
+	TerminateTimeout time.Duration
+}
+
+// readJournal returns the builds in the journal at path with the resources
+// each created and didn't delete, in the order they were created
+func readJournal(path string) ([]*journalBuild, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries, _ := parseJournal(path, data)
+	return journalBuilds(entries), nil
+}
+
+// parseJournal returns the entries of the journal at path, and the lines
+// they were read from
+func parseJournal(path string, data []byte) ([]JournalEntry, [][]byte) {
+	entries := make([]JournalEntry, 0)
+	lines := make([][]byte, 0)
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var e JournalEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			// a crash can leave the last line half written
+			log.Printf("skipping line %d of cleanup journal '%s': %s", i+1, path, err)
+			continue
+		}
+		entries = append(entries, e)
+		lines = append(lines, line)
+	}
+	return entries, lines
+}
+
+// journalBuilds sums up the journal entries by build
+func journalBuilds(entries []JournalEntry) []*journalBuild {
+	builds := make(map[string]*journalBuild)
+	order := make([]string, 0)
+	for _, e := range entries {
+		b, ok := builds[e.Build]
+		if !ok {
+			b = &journalBuild{Id: e.Build}
+			builds[e.Build] = b
+			order = append(order, e.Build)
+		}
+		b.Template, b.Host, b.Pid = e.Template, e.Host, e.Pid
+
+		switch e.Op {
+		case "create":
+			if !journalHas(b.Pending, e) {
+				b.Pending = append(b.Pending, e)
+			}
+		case "delete":
+			for i, p := range b.Pending {
+				if p.Kind == e.Kind && p.Region == e.Region && p.Id == e.Id {
+					b.Pending = append(b.Pending[:i], b.Pending[i+1:]...)
+					break
+				}
+			}
+		case "abort":
+			b.Aborted = true
+		case "done":
+			b.Done = true
+			b.Aborted = false
+		}
+	}
+
+	result := make([]*journalBuild, 0, len(order))
+	for _, id := range order {
+		result = append(result, builds[id])
+	}
+	return result
+}
+
+// finished reports whether there's nothing left to clean up after the
+// build: it's done, and only its images, which are its product, remain
+func (b *journalBuild) finished() bool {
+	if !b.Done {
+		return false
+	}
+	for _, e := range b.Pending {
+		if e.Kind != journalImage && e.Kind != journalAccountImage {
+			return false
+		}
+	}
+	return true
+}
+
+func journalHas(entries []JournalEntry, e JournalEntry) bool {
+	for _, p := range entries {
+		if p.Kind == e.Kind && p.Region == e.Region && p.Id == e.Id {
+			return true
+		}
+	}
+	return false
+}
+
+// running reports whether the build's process might still be running, in
+// which case its resources are left alone. Packer runs the builds of a
+// template in parallel in one process, so another build of this process is
+// running.
+func (b *journalBuild) running() bool {
+	host, _ := os.Hostname()
+	if b.Host != host || b.Pid == os.Getpid() {
+		return true
+	}
+	p, err := os.FindProcess(b.Pid)
+	if err != nil {
+		return false
+	}
+	// os reports a process that's gone as "process already finished" rather
+	// than ESRCH in most versions
+	err = p.Signal(syscall.Signal(0))
+	if err == nil {
+		return true
+	}
+	return !(err == syscall.ESRCH || err.Error() == "os: process already finished")
+}
+
+// ReplayJournal deletes what the builds in the journal at path left behind:
+// the temporary resources their cleanup didn't remove, and the images of
+// builds that never finished. Builds that may still be running are skipped.
+// The builds that are finished with are dropped from the journal afterwards.
+func ReplayJournal(tc *tcapi.Client, path string, ui packer.Ui, opts ReplayOptions) error {
+	builds, err := readJournal(path)
+	if err != nil {
+		return fmt.Errorf("could not read cleanup journal '%s': %s", path, err)
+	}
+
+	errs := new(packer.MultiError)
+	for _, b := range builds {
+		if stringInSlice(b.Id, opts.Skip) || (opts.Template != "" && b.Template != opts.Template) {
+			continue
+		}
+		pending := make([]JournalEntry, 0, len(b.Pending))
+		for _, e := range b.Pending {
+			if b.Done && (e.Kind == journalImage || e.Kind == journalAccountImage) {
+				continue
+			}
+			pending = append(pending, e)
+		}
+		if len(pending) == 0 {
+			continue
+		}
+		if b.Aborted && opts.KeepAborted {
+			ui.Message(fmt.Sprintf("skipping build '%s' in the cleanup journal, it was aborted and its resources kept", b.Id))
+			continue
+		}
+		if !b.Done && !b.Aborted && b.running() {
+			ui.Message(fmt.Sprintf("skipping build '%s' in the cleanup journal, it may still be running on '%s' (pid %d)", b.Id, b.Host, b.Pid))
+			continue
+		}
+
+		ui.Say(fmt.Sprintf("cleaning up after build '%s' from the cleanup journal", b.Id))
+		journal := &Journal{path: path, build: b.Id, template: b.Template, host: b.Host, pid: b.Pid}
+
+		// instances go first, as they hold on to the key pairs, security
+		// groups and elastic IPs
+		order := map[string]int{
+			journalInstance:      0,
+			journalImage:         1,
+			journalAccountImage:  1,
+			journalKeyPair:       2,
+			journalSecurityGroup: 3,
+			journalAddress:       4,
+		}
+		sort.SliceStable(pending, func(i, j int) bool {
+			return order[pending[i].Kind] < order[pending[j].Kind]
+		})
+
+		failed := 0
+		for _, e := range pending {
+			err := deleteJournalResource(tc.Copy(e.Region, nil), e, opts.TerminateTimeout)
+			if err == errImageComplete {
+				ui.Message(fmt.Sprintf("keeping image '%s' in region '%s', its build marked it complete", e.Id, e.Region))
+				continue
+			}
+			if err != nil && !isNotFound(err) {
+				failed++
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("could not delete %s '%s' in region '%s' of build '%s': %s", e.Kind, e.Id, e.Region, b.Id, err))
+				continue
+			}
+			ui.Message(fmt.Sprintf("deleted %s '%s' in region '%s'", e.Kind, e.Id, e.Region))
+			journal.append("delete", e.Kind, e.Region, e.Id, e.Role)
+		}
+		if failed == 0 && !b.Done {
+			journal.Done()
+		}
+	}
+
+	if err := compactJournal(path); err != nil {
+		log.Printf("could not compact cleanup journal '%s': %s", path, err)
+	}
+
+	if len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// compactJournal drops the entries of finished builds from the journal at
+// path, so it doesn't grow with every build. It gives up rather than lose
+// them if another build appends to the journal in the meantime.
+func compactJournal(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	entries, lines := parseJournal(path, data)
+	finished := make(map[string]bool)
+	for _, b := range journalBuilds(entries) {
+		if b.finished() {
+			finished[b.Id] = true
+		}
+	}
+	if len(finished) == 0 {
+		return nil
+	}
+
+	var kept bytes.Buffer
+	for i, e := range entries {
+		if finished[e.Build] {
+			continue
+		}
+		kept.Write(lines[i])
+		kept.WriteByte('\n')
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, kept.Bytes(), 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() != int64(len(data)) {
+		os.Remove(tmp)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("journal changed while compacting it")
+	}
+	return os.Rename(tmp, path)
+}
+
+// errImageComplete is returned for images the journal has no delete for
+// that their build still marked complete before it was killed
+var errImageComplete = errors.New("image is complete")
+
+// deleteJournalResource deletes a resource recorded in the journal, doing
+// nothing if it's already gone
+func deleteJournalResource(tc *tcapi.Client, e JournalEntry, terminateTimeout time.Duration) error {
+	switch e.Kind {
+	case journalInstance:
+		resp, err := tc.DescribeInstances(&tcapi.DescribeInstancesRequest{
+			InstanceIds: []string{
+				e.Id,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if len(resp.InstanceSet) == 0 {
+			return nil
+		}
+		if resp.InstanceSet[0].InstanceState != "TERMINATING" {
+			err := tc.TerminateInstances(&tcapi.TerminateInstancesRequest{
+				InstanceIds: []string{
+					e.Id,
+				},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		_, err = WaitForDoesNotExist(&StateChangeConf{
+			Pending: []string{"TERMINATING"},
+			Target:  "TERMINATED",
+			Refresh: InstanceStateRefreshFunc(tc, e.Id),
+			Timeout: terminateTimeout,
+		})
+		return err
+
+	case journalImage:
+		resp, err := tc.DescribeImages(&tcapi.DescribeImagesRequest{
+			ImageIds: []string{
+				e.Id,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if len(resp.ImageSet) == 0 {
+			return nil
+		}
+		tags, err := imageResourceTags(tc, []string{e.Id})
+		if err != nil {
+			return err
+		}
+		if tags[e.Id][BuildStateTag] == "complete" {
+			return errImageComplete
+		}
+		if err := waitForImagesToSettle(tc, []string{e.Id}); err != nil {
+			return err
+		}
+		return deleteImage(tc, e.Id)
+
+	case journalKeyPair:
+		resp, err := tc.DescribeKeyPairs(&tcapi.DescribeKeyPairsRequest{
+			KeyIds: []string{
+				e.Id,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if len(resp.KeyPairSet) == 0 {
+			return nil
+		}
+		return tc.DeleteKeyPairs(&tcapi.DeleteKeyPairsRequest{
+			KeyIds: []string{
+				e.Id,
+			},
+		})
+
+	case journalSecurityGroup:
+		resp, err := describeSecurityGroups(tc, &describeSecurityGroupsRequest{
+			SecurityGroupIds: []string{
+				e.Id,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if len(resp.SecurityGroupSet) == 0 {
+			return nil
+		}
+		return deleteSecurityGroup(tc, &deleteSecurityGroupRequest{
+			SecurityGroupId: e.Id,
+		})
+
+	case journalAddress:
+		return releaseAddress(tc, e.Id, terminateTimeout)
+
+	case journalAccountImage:
+		roleClient, token, err := assumeRole(tc, e.Role, e.Region)
+		if err != nil {
+			return err
+		}
+		return deleteAccountImage(roleClient, token, e.Id)
+	}
+
+	return fmt.Errorf("unknown resource kind '%s'", e.Kind)
+}
+
+// isNotFound reports whether err is the API saying a resource doesn't exist
+func isNotFound(err error) bool {
+	return strings.Contains(err.Error(), "NotFound")
+}
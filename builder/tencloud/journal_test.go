@@ -0,0 +1,239 @@
+package tencloud
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+func TestJournal_pending(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tc-journal")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+
+	crashed := NewJournal(path, "crashed", "t1")
+	crashed.Created(journalKeyPair, "ap-guangzhou", "skey-1")
+	crashed.Created(journalInstance, "ap-guangzhou", "ins-1")
+	crashed.Created(journalImage, "ap-guangzhou", "img-1")
+	crashed.Deleted(journalKeyPair, "ap-guangzhou", "skey-1")
+
+	finished := NewJournal(path, "finished", "t1")
+	finished.Created(journalInstance, "ap-guangzhou", "ins-2")
+	finished.Deleted(journalInstance, "ap-guangzhou", "ins-2")
+	finished.Done()
+
+	// a half written line from a crash is skipped
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	f.WriteString(`{"build":"crashed","op":"cre`)
+	f.Close()
+
+	builds, err := readJournal(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(builds) != 2 {
+		t.Fatalf("bad: %#v", builds)
+	}
+
+	if b := builds[0]; b.Id != "crashed" || b.Done || len(b.Pending) != 2 || b.Pending[0].Id != "ins-1" || b.Pending[1].Id != "img-1" {
+		t.Fatalf("bad crashed build: %#v", b)
+	}
+	if b := builds[1]; b.Id != "finished" || !b.Done || len(b.Pending) != 0 {
+		t.Fatalf("bad finished build: %#v", b)
+	}
+	if !builds[1].running() {
+		t.Fatal("another build of this process may be running")
+	}
+}
+
+func TestJournal_nil(t *testing.T) {
+	var j *Journal
+	j.Created(journalInstance, "ap-guangzhou", "ins-1")
+	j.Done()
+
+	builds, err := readJournal(filepath.Join(os.TempDir(), "tc-journal-does-not-exist"))
+	if err != nil || len(builds) != 0 {
+		t.Fatalf("bad: %#v, %v", builds, err)
+	}
+}
+
+func TestJournal_resumed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tc-journal")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+
+	failed := NewJournal(path, "build", "t1")
+	failed.Created(journalInstance, "ap-guangzhou", "ins-1")
+	failed.Created(journalImage, "ap-guangzhou", "img-1")
+	failed.Aborted()
+
+	builds, err := readJournal(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(builds) != 1 || !builds[0].Aborted || builds[0].Done {
+		t.Fatalf("bad: %#v", builds)
+	}
+
+	// the resumed build takes over the image and removes the instance
+	resumed := NewJournal(path, "build", "t1")
+	resumed.Created(journalImage, "ap-guangzhou", "img-1")
+	resumed.Deleted(journalInstance, "ap-guangzhou", "ins-1")
+	resumed.Done()
+
+	builds, err = readJournal(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if b := builds[0]; b.Aborted || !b.Done || len(b.Pending) != 1 || b.Pending[0].Id != "img-1" {
+		t.Fatalf("bad: %#v", b)
+	}
+}
+
+func TestJournal_compact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tc-journal")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+
+	finished := NewJournal(path, "finished", "t1")
+	finished.Created(journalInstance, "ap-guangzhou", "ins-1")
+	finished.Created(journalImage, "ap-guangzhou", "img-1")
+	finished.Deleted(journalInstance, "ap-guangzhou", "ins-1")
+	finished.Done()
+
+	// its cleanup failed to delete the key pair, so it isn't finished with
+	leaked := NewJournal(path, "leaked", "t1")
+	leaked.Created(journalKeyPair, "ap-guangzhou", "skey-1")
+	leaked.Done()
+
+	crashed := NewJournal(path, "crashed", "t2")
+	crashed.Created(journalInstance, "ap-guangzhou", "ins-2")
+
+	if err := compactJournal(path); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	builds, err := readJournal(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(builds) != 2 || builds[0].Id != "leaked" || builds[1].Id != "crashed" {
+		t.Fatalf("bad: %#v", builds)
+	}
+	if b := builds[1]; b.Template != "t2" || len(b.Pending) != 1 || b.Pending[0].Id != "ins-2" {
+		t.Fatalf("bad crashed build: %#v", b)
+	}
+
+	// nothing left to drop
+	if err := compactJournal(path); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := compactJournal(filepath.Join(dir, "does-not-exist")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestJournalBuild_running(t *testing.T) {
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("could not run a process: %s", err)
+	}
+	host, _ := os.Hostname()
+
+	if b := (&journalBuild{Host: host, Pid: cmd.Process.Pid}); b.running() {
+		t.Fatal("a process that exited shouldn't be running")
+	}
+	if b := (&journalBuild{Host: host, Pid: os.Getppid()}); !b.running() {
+		t.Fatal("the parent process should be running")
+	}
+	if b := (&journalBuild{Host: host + "-other", Pid: cmd.Process.Pid}); !b.running() {
+		t.Fatal("a build on another host may be running")
+	}
+}
+
+func TestReplayJournal_parallelBuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tc-journal")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+
+	// a builder of the same template running alongside in this process
+	sibling := NewJournal(path, "sibling", "t1")
+	sibling.Created(journalInstance, "ap-guangzhou", "ins-1")
+	sibling.Created(journalKeyPair, "ap-guangzhou", "skey-1")
+
+	f, tc, restore := useFakeAPI(nil)
+	defer restore()
+	ui := &packer.BasicUi{
+		Reader:      new(bytes.Buffer),
+		Writer:      ioutil.Discard,
+		ErrorWriter: ioutil.Discard,
+	}
+	if err := ReplayJournal(tc, path, ui, ReplayOptions{Skip: []string{"self"}, Template: "t1"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if n := f.Calls("TerminateInstances") + f.Calls("DeleteKeyPairs"); n != 0 {
+		t.Fatalf("deleted the resources of a running build: %d calls", n)
+	}
+	builds, err := readJournal(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(builds) != 1 || len(builds[0].Pending) != 2 {
+		t.Fatalf("bad: %#v", builds)
+	}
+}
+
+func TestJournal_accountImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tc-journal")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+
+	role := "qcs::cam::uin/100:roleName/importer"
+	created := NewCreatedImages(NewJournal(path, "crashed", "t1"))
+	created.AddAccountImage("100", role, "ap-guangzhou", "img-1")
+	created.AddAccountImage("100", role, "ap-guangzhou", "img-1")
+
+	builds, err := readJournal(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(builds) != 1 || len(builds[0].Pending) != 1 {
+		t.Fatalf("bad: %#v", builds)
+	}
+	if e := builds[0].Pending[0]; e.Kind != journalAccountImage || e.Role != role || e.Id != "img-1" {
+		t.Fatalf("bad entry: %#v", e)
+	}
+
+	// once the build is done, the copy is its product like its own images
+	NewJournal(path, "crashed", "t1").Done()
+	builds, err = readJournal(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !builds[0].finished() {
+		t.Fatalf("bad: %#v", builds[0])
+	}
+}
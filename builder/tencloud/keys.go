@@ -0,0 +1,168 @@
+package tencloud
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// Types of the temporary key pairs generated for SSH
+const (
+	keyTypeRSA     = "rsa"
+	keyTypeED25519 = "ed25519"
+)
+
+// generateKeyPair generates a key pair on the build host, returning the
+// private key in PEM and the public key in authorized_keys format
+func generateKeyPair(keyType string, bits int) (privateKey, publicKey string, err error) {
+	var block *pem.Block
+	var pub ssh.PublicKey
+	switch keyType {
+	case keyTypeRSA:
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return "", "", fmt.Errorf("could not generate rsa key: %s", err)
+		}
+		block = &pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		}
+		pub, err = ssh.NewPublicKey(&key.PublicKey)
+		if err != nil {
+			return "", "", err
+		}
+
+	case keyTypeED25519:
+		edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", "", fmt.Errorf("could not generate ed25519 key: %s", err)
+		}
+		pub, err = ssh.NewPublicKey(edPub)
+		if err != nil {
+			return "", "", err
+		}
+		block, err = marshalED25519PrivateKey(pub, edPriv)
+		if err != nil {
+			return "", "", err
+		}
+
+	default:
+		return "", "", fmt.Errorf("unknown key type '%s'", keyType)
+	}
+
+	return string(pem.EncodeToMemory(block)), strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))), nil
+}
+
+// marshalED25519PrivateKey encodes an ed25519 private key in the OpenSSH
+// format, the only one ssh.ParsePrivateKey reads them in
+func marshalED25519PrivateKey(pub ssh.PublicKey, priv ed25519.PrivateKey) (*pem.Block, error) {
+	var check [4]byte
+	if _, err := rand.Read(check[:]); err != nil {
+		return nil, err
+	}
+	checkInt := binary.BigEndian.Uint32(check[:])
+
+	key := struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+		Pub     []byte
+		Priv    []byte
+		Comment string
+		Pad     []byte `ssh:"rest"`
+	}{
+		Check1:  checkInt,
+		Check2:  checkInt,
+		Keytype: ssh.KeyAlgoED25519,
+		Pub:     []byte(priv.Public().(ed25519.PublicKey)),
+		Priv:    []byte(priv),
+	}
+	// the private block is padded to the cipher block size, 8 without one
+	for i := 1; len(ssh.Marshal(key))%8 != 0; i++ {
+		key.Pad = append(key.Pad, byte(i))
+	}
+
+	w := struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{
+		CipherName:   "none",
+		KdfName:      "none",
+		NumKeys:      1,
+		PubKey:       pub.Marshal(),
+		PrivKeyBlock: ssh.Marshal(key),
+	}
+
+	return &pem.Block{
+		Type:  "OPENSSH PRIVATE KEY",
+		Bytes: append([]byte("openssh-key-v1\x00"), ssh.Marshal(w)...),
+	}, nil
+}
+
+// publicKeyOf derives the public key of a PEM private key, in
+// authorized_keys format
+func publicKeyOf(privateKey []byte, passphrase string) (string, error) {
+	signer, err := parsePrivateKey(privateKey, passphrase)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))), nil
+}
+
+// parsePrivateKey parses a PEM private key, decrypting it with passphrase if
+// it's set
+func parsePrivateKey(privateKey []byte, passphrase string) (ssh.Signer, error) {
+	var signer ssh.Signer
+	var err error
+	if passphrase == "" {
+		signer, err = ssh.ParsePrivateKey(privateKey)
+	} else {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(privateKey, []byte(passphrase))
+	}
+	switch {
+	case err == x509.IncorrectPasswordError:
+		return nil, errors.New("wrong ssh_private_key_passphrase")
+	case err != nil && strings.Contains(err.Error(), "cannot decode encrypted private keys"):
+		if passphrase == "" {
+			return nil, errors.New("the key is encrypted, set ssh_private_key_passphrase")
+		}
+		// only PEM encryption can be undone, not the OpenSSH format's
+		return nil, errors.New("encrypted keys in the OpenSSH format aren't supported, convert the key to PEM with 'ssh-keygen -p -m PEM'")
+	}
+	return signer, err
+}
+
+// loadCertificate reads an SSH certificate in authorized_keys format, as
+// ssh-keygen writes them, failing if it's expired
+func loadCertificate(path string) (*ssh.Certificate, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(contents)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("not an SSH certificate")
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && time.Now().After(time.Unix(int64(cert.ValidBefore), 0)) {
+		return nil, fmt.Errorf("certificate expired at %s", time.Unix(int64(cert.ValidBefore), 0).Format(time.RFC3339))
+	}
+	return cert, nil
+}
@@ -0,0 +1,214 @@
+package tencloud
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestGenerateKeyPair(t *testing.T) {
+	for _, keyType := range []string{keyTypeRSA, keyTypeED25519} {
+		privateKey, publicKey, err := generateKeyPair(keyType, 2048)
+		if err != nil {
+			t.Fatalf("%s: err: %s", keyType, err)
+		}
+
+		derived, err := publicKeyOf([]byte(privateKey), "")
+		if err != nil {
+			t.Fatalf("%s: could not parse private key: %s", keyType, err)
+		}
+		if derived != publicKey {
+			t.Fatalf("%s: public key mismatch: %q, expected %q", keyType, derived, publicKey)
+		}
+	}
+
+	_, publicKey, _ := generateKeyPair(keyTypeED25519, 0)
+	if !strings.HasPrefix(publicKey, "ssh-ed25519 ") {
+		t.Fatalf("bad public key: %q", publicKey)
+	}
+
+	if _, _, err := generateKeyPair("dsa", 1024); err == nil {
+		t.Fatal("should have errored")
+	}
+}
+
+func TestParsePrivateKey_passphrase(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key), []byte("secret"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	encrypted := pem.EncodeToMemory(block)
+
+	if _, err := parsePrivateKey(encrypted, "secret"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := parsePrivateKey(encrypted, ""); err == nil || !strings.Contains(err.Error(), "ssh_private_key_passphrase") {
+		t.Fatalf("bad: %v", err)
+	}
+	if _, err := parsePrivateKey(encrypted, "wrong"); err == nil || !strings.Contains(err.Error(), "wrong") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestSSHConfig_certificate(t *testing.T) {
+	privateKey, _, err := generateKeyPair(keyTypeED25519, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	signer, _ := parsePrivateKey([]byte(privateKey), "")
+	_, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	ca, _ := ssh.NewSignerFromKey(caKey)
+
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"root"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	f, err := ioutil.TempFile("", "cert")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(ssh.MarshalAuthorizedKey(cert))
+	f.Close()
+
+	config := &RunConfig{SSHCertificateFile: f.Name()}
+	config.Comm.SSHUsername = "root"
+	state := new(multistep.BasicStateBag)
+	state.Put("privateKey", privateKey)
+	if _, err := SSHConfig(config)(state); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// the certificate is useless without its key
+	state = new(multistep.BasicStateBag)
+	if _, err := SSHConfig(config)(state); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	config.SSHCertificateFile = ""
+	if _, err := SSHConfig(config)(state); err == nil {
+		t.Fatal("should have errored without any way to log in")
+	}
+}
+
+func TestSameAuthorizedKey(t *testing.T) {
+	_, first, err := generateKeyPair(keyTypeED25519, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, second, err := generateKeyPair(keyTypeED25519, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	cases := []struct {
+		a, b     string
+		expected bool
+	}{
+		{first, first, true},
+		{first, strings.TrimSpace(first) + " packer@build\n", true},
+		{first, second, false},
+		{first, "", false},
+		{"not a key", "not a key", false},
+	}
+	for i, c := range cases {
+		if got := sameAuthorizedKey(c.a, c.b); got != c.expected {
+			t.Fatalf("case %d: bad: %t", i, got)
+		}
+	}
+}
+
+func TestTemporaryKeyPairName(t *testing.T) {
+	suffix := "5f3c2a1b0123456789abcdef01234567"
+	cases := []struct {
+		prefix   string
+		expected string
+	}{
+		{"packer", "packer_89abcdef01234567"},
+		{"ci", "ci_89abcdef01234567"},
+		{"continuous", "continuo_89abcdef01234567"},
+	}
+	for _, c := range cases {
+		got := temporaryKeyPairName(c.prefix, suffix)
+		if got != c.expected || len(got) > keyPairNameLen {
+			t.Fatalf("%s: bad: %s, expected %s", c.prefix, got, c.expected)
+		}
+	}
+}
+
+func TestSSHConfig_agent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tc-agent")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	keyring := agent.NewKeyring()
+	keyring.Add(agent.AddedKey{PrivateKey: key})
+
+	socket := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer l.Close()
+	var dialled int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&dialled, 1)
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	os.Setenv("SSH_AUTH_SOCK", socket)
+
+	config := &RunConfig{}
+	config.Comm.SSHUsername = "root"
+	config.Comm.SSHAgentAuth = true
+	state := new(multistep.BasicStateBag)
+	if _, err := SSHConfig(config)(state); err == nil {
+		t.Fatal("should have errored before the agent is dialled")
+	}
+
+	a, err := dialSSHAgent()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer a.Close()
+	state.Put("sshAgent", a)
+	for i := 0; i < 3; i++ {
+		if _, err := SSHConfig(config)(state); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if n := atomic.LoadInt32(&dialled); n != 1 {
+		t.Fatalf("agent dialled %d times", n)
+	}
+}
@@ -0,0 +1,62 @@
+package tencloud
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Characters of the generated instance passwords. Only the special
+// characters both Linux and Windows instances accept are used, less quotes,
+// slashes and backticks, so the password survives being pasted into a shell.
+const (
+	passwordLower   = "abcdefghijklmnopqrstuvwxyz"
+	passwordUpper   = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	passwordDigits  = "0123456789"
+	passwordSpecial = "()~!@#$%^&*-+=|{}[]:;,.?"
+)
+
+// instancePassword generates a random login password for an instance.
+// Instances want up to 30 characters, at least 12 on Windows, from at least
+// three of lowercase, uppercase, digits and special characters, so there's
+// one of each in a password of 24.
+func instancePassword() (string, error) {
+	classes := []string{passwordLower, passwordUpper, passwordDigits, passwordSpecial}
+	all := passwordLower + passwordUpper + passwordDigits + passwordSpecial
+
+	password := make([]byte, 24)
+	for i := range password {
+		set := all
+		if i < len(classes) {
+			set = classes[i]
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(set))))
+		if err != nil {
+			return "", fmt.Errorf("could not generate password: %s", err)
+		}
+		password[i] = set[n.Int64()]
+	}
+
+	// the one of each class shouldn't always come first
+	for i := len(password) - 1; i > 0; i-- {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", fmt.Errorf("could not generate password: %s", err)
+		}
+		j := n.Int64()
+		password[i], password[j] = password[j], password[i]
+	}
+
+	return string(password), nil
+}
+
+// redactPassword keeps a password out of an error that may echo the request
+// it was sent in
+func redactPassword(err error, password string) error {
+	if err == nil || password == "" || !strings.Contains(err.Error(), password) {
+		return err
+	}
+	return errors.New(strings.Replace(err.Error(), password, "<redacted>", -1))
+}
@@ -0,0 +1,39 @@
+package tencloud
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestInstancePassword(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		password, err := instancePassword()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if len(password) != 24 {
+			t.Fatalf("bad length: %d", len(password))
+		}
+		for _, class := range []string{passwordLower, passwordUpper, passwordDigits, passwordSpecial} {
+			if !strings.ContainsAny(password, class) {
+				t.Fatalf("%q has none of %q", password, class)
+			}
+		}
+		if seen[password] {
+			t.Fatalf("repeated password: %q", password)
+		}
+		seen[password] = true
+	}
+}
+
+func TestRedactPassword(t *testing.T) {
+	err := redactPassword(errors.New("InvalidPassword: 'hunter2' is too short"), "hunter2")
+	if strings.Contains(err.Error(), "hunter2") {
+		t.Fatalf("password not redacted: %s", err)
+	}
+	if redactPassword(nil, "hunter2") != nil {
+		t.Fatal("nil error should stay nil")
+	}
+}
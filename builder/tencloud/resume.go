@@ -0,0 +1,258 @@
+package tencloud
+
+import (
+	"fmt"
+
+	"github.com/3van/tencloud-go"
+)
+
+// Stages a failed build can be resumed at
+const (
+	resumeCreateImage = "create_image"
+	resumeImageCopy   = "image_copy"
+)
+
+// ResumePoint is what's left of a failed build that a new build can pick up
+// from: its stopped instance, key pair and the images it had finished.
+type ResumePoint struct {
+	BuildUUID string
+	Stage     string
+	Instance  *tcapi.Instance
+	KeyId     string
+	KeyName   string
+	Images    map[string]string
+}
+
+// findResumePoint looks for what's left of the build named by
+// resume_build_uuid or, if that isn't set, of the latest failed build of the
+// same template. It returns nil if there's nothing to resume, and an error
+// if the resources found don't belong to a build of this template.
+func findResumePoint(tc *tcapi.Client, config *Config) (*ResumePoint, error) {
+	buildUUID := config.ResumeBuildUUID
+
+	instances := make([]tcapi.Instance, 0)
+	for offset := 0; ; offset += 100 {
+		resp, err := tc.DescribeInstances(&tcapi.DescribeInstancesRequest{
+			Offset: offset,
+			Limit:  100,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not list instances: %s", err)
+		}
+		instances = append(instances, resp.InstanceSet...)
+		if len(resp.InstanceSet) == 0 || offset+100 >= resp.TotalCount {
+			break
+		}
+	}
+	instanceIds := make([]string, 0, len(instances))
+	for _, instance := range instances {
+		instanceIds = append(instanceIds, instance.InstanceId)
+	}
+	instanceTags, err := resourceTags(tc, "cvm", "instance", instanceIds)
+	if err != nil {
+		return nil, err
+	}
+
+	var instance *tcapi.Instance
+	for i := range instances {
+		tags := instanceTags[instances[i].InstanceId]
+		if !resumeCandidate(tags, buildUUID, config) {
+			continue
+		}
+		switch instances[i].InstanceState {
+		case "TERMINATING", "TERMINATED", "SHUTDOWN":
+			continue
+		}
+		if instance == nil || instances[i].CreatedTime > instance.CreatedTime {
+			instance = &instances[i]
+		}
+	}
+	if instance != nil {
+		buildUUID = instanceTags[instance.InstanceId][BuildUUIDTag]
+	}
+
+	images, err := privateImagesNamed(tc, config.ImageName)
+	if err != nil {
+		return nil, fmt.Errorf("could not query image '%s': %s", config.ImageName, err)
+	}
+	imageIds := make([]string, 0, len(images))
+	for _, image := range images {
+		imageIds = append(imageIds, image.ImageId)
+	}
+	imageTags, err := imageResourceTags(tc, imageIds)
+	if err != nil {
+		return nil, err
+	}
+
+	var image *tcapi.Image
+	for i := range images {
+		tags := imageTags[images[i].ImageId]
+		if tags[BuildStateTag] != "incomplete" || !resumeCandidate(tags, buildUUID, config) {
+			continue
+		}
+		if image == nil || images[i].CreatedTime > image.CreatedTime {
+			image = &images[i]
+		}
+	}
+	if buildUUID == "" && image != nil {
+		buildUUID = imageTags[image.ImageId][BuildUUIDTag]
+	}
+
+	if buildUUID == "" {
+		return nil, nil
+	}
+	if instance != nil {
+		if err := checkResumeOwner("instance", instance.InstanceId, instanceTags[instance.InstanceId], config); err != nil {
+			return nil, err
+		}
+	}
+	if image != nil {
+		if err := checkResumeOwner("image", image.ImageId, imageTags[image.ImageId], config); err != nil {
+			return nil, err
+		}
+	}
+
+	point := &ResumePoint{
+		BuildUUID: buildUUID,
+		Instance:  instance,
+		Images:    make(map[string]string),
+	}
+
+	if image != nil {
+		// an image that's still being made is waited for, one that failed
+		// is made again
+		if err := waitForImagesToSettle(tc, []string{image.ImageId}); err != nil {
+			return nil, fmt.Errorf("image '%s' of build '%s' didn't settle: %s", image.ImageId, buildUUID, err)
+		}
+		resp, err := tc.DescribeImages(&tcapi.DescribeImagesRequest{
+			ImageIds: []string{
+				image.ImageId,
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not query image '%s': %s", image.ImageId, err)
+		}
+		if len(resp.ImageSet) > 0 && resp.ImageSet[0].ImageState == "NORMAL" {
+			point.Stage = resumeImageCopy
+			point.Images[config.Region] = image.ImageId
+		} else if len(resp.ImageSet) > 0 {
+			if err := deleteImage(tc, image.ImageId); err != nil {
+				return nil, fmt.Errorf("could not delete failed image '%s' of build '%s': %s", image.ImageId, buildUUID, err)
+			}
+		}
+	}
+
+	if point.Stage == resumeImageCopy {
+		for _, region := range config.ImageRegions {
+			if _, ok := point.Images[region]; ok {
+				continue
+			}
+			imageId, err := resumeImageCopyIn(tc.Copy(region, nil), buildUUID, config)
+			if err != nil {
+				return nil, fmt.Errorf("could not query copies of image '%s' in region '%s': %s", config.ImageName, region, err)
+			}
+			if imageId != "" {
+				point.Images[region] = imageId
+			}
+		}
+	} else {
+		if instance == nil {
+			return nil, fmt.Errorf("neither the instance nor the image of build '%s' was found, it can't be resumed", buildUUID)
+		}
+		switch {
+		case instance.InstanceState == "STOPPED":
+		case instance.InstanceState == "RUNNING" && config.DisableStopInstance:
+		default:
+			return nil, fmt.Errorf("instance '%s' of build '%s' is %s, it can only be resumed once the instance is stopped", instance.InstanceId, buildUUID, instance.InstanceState)
+		}
+		point.Stage = resumeCreateImage
+	}
+
+	keyPairs := make([]tcapi.KeyPair, 0)
+	for offset := 0; ; offset += 100 {
+		resp, err := tc.DescribeKeyPairs(&tcapi.DescribeKeyPairsRequest{
+			Offset: offset,
+			Limit:  100,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not list key pairs: %s", err)
+		}
+		keyPairs = append(keyPairs, resp.KeyPairSet...)
+		if len(resp.KeyPairSet) == 0 || offset+100 >= resp.TotalCount {
+			break
+		}
+	}
+	keyIds := make([]string, 0, len(keyPairs))
+	for _, keyPair := range keyPairs {
+		keyIds = append(keyIds, keyPair.KeyId)
+	}
+	keyTags, err := resourceTags(tc, "cvm", "keypair", keyIds)
+	if err != nil {
+		return nil, err
+	}
+	for _, keyPair := range keyPairs {
+		if keyTags[keyPair.KeyId][BuildUUIDTag] == buildUUID {
+			point.KeyId = keyPair.KeyId
+			point.KeyName = keyPair.KeyName
+			break
+		}
+	}
+
+	return point, nil
+}
+
+// resumeCandidate reports whether a resource with tags may belong to the
+// build being resumed
+func resumeCandidate(tags map[string]string, buildUUID string, config *Config) bool {
+	if tags[BuildUUIDTag] == "" {
+		return false
+	}
+	if buildUUID != "" {
+		return tags[BuildUUIDTag] == buildUUID
+	}
+	return tags[BuildNameTag] == config.buildTags[BuildNameTag] && tags[TemplateHashTag] == config.buildTags[TemplateHashTag]
+}
+
+// checkResumeOwner makes sure a resource of the build being resumed was made
+// by a build of the same name from the same template
+func checkResumeOwner(kind, id string, tags map[string]string, config *Config) error {
+	if tags[BuildNameTag] != config.buildTags[BuildNameTag] {
+		return fmt.Errorf("%s '%s' belongs to build '%s', not '%s', it can't be resumed", kind, id, tags[BuildNameTag], config.buildTags[BuildNameTag])
+	}
+	if tags[TemplateHashTag] != config.buildTags[TemplateHashTag] {
+		return fmt.Errorf("%s '%s' was made from a different template, it can't be resumed", kind, id)
+	}
+	return nil
+}
+
+// resumeImageCopyIn returns the finished copy of the build's image in the
+// client's region, if there is one
+func resumeImageCopyIn(tc *tcapi.Client, buildUUID string, config *Config) (string, error) {
+	images, err := privateImagesNamed(tc, config.ImageName)
+	if err != nil {
+		return "", err
+	}
+	imageIds := make([]string, 0, len(images))
+	for _, image := range images {
+		imageIds = append(imageIds, image.ImageId)
+	}
+	tags, err := imageResourceTags(tc, imageIds)
+	if err != nil {
+		return "", err
+	}
+
+	var found *tcapi.Image
+	for i := range images {
+		t := tags[images[i].ImageId]
+		if images[i].ImageState != "NORMAL" || t[BuildUUIDTag] != buildUUID || checkResumeOwner("image", images[i].ImageId, t, config) != nil {
+			continue
+		}
+		if found == nil || images[i].CreatedTime > found.CreatedTime {
+			found = &images[i]
+		}
+	}
+	if found == nil {
+		return "", nil
+	}
+	return found.ImageId, nil
+}
@@ -0,0 +1,57 @@
+package tencloud
+
+import (
+	"testing"
+)
+
+func TestResumeCandidate(t *testing.T) {
+	config := &Config{}
+	config.RunConfig.buildTags = TagMap{
+		BuildNameTag:    "tencloud",
+		TemplateHashTag: "abc",
+	}
+
+	cases := []struct {
+		name      string
+		tags      map[string]string
+		buildUUID string
+		want      bool
+	}{
+		{"untagged", map[string]string{}, "", false},
+		{"same template", map[string]string{BuildUUIDTag: "1", BuildNameTag: "tencloud", TemplateHashTag: "abc"}, "", true},
+		{"other template", map[string]string{BuildUUIDTag: "1", BuildNameTag: "tencloud", TemplateHashTag: "def"}, "", false},
+		{"other build name", map[string]string{BuildUUIDTag: "1", BuildNameTag: "other", TemplateHashTag: "abc"}, "", false},
+		{"named build", map[string]string{BuildUUIDTag: "1", TemplateHashTag: "def"}, "1", true},
+		{"other named build", map[string]string{BuildUUIDTag: "2", BuildNameTag: "tencloud", TemplateHashTag: "abc"}, "1", false},
+	}
+	for _, c := range cases {
+		if got := resumeCandidate(c.tags, c.buildUUID, config); got != c.want {
+			t.Errorf("%s: got %t, wanted %t", c.name, got, c.want)
+		}
+	}
+}
+
+func TestCheckResumeOwner(t *testing.T) {
+	config := &Config{}
+	config.RunConfig.buildTags = TagMap{
+		BuildNameTag:    "tencloud",
+		TemplateHashTag: "abc",
+	}
+
+	cases := []struct {
+		name    string
+		tags    map[string]string
+		wantErr bool
+	}{
+		{"same template", map[string]string{BuildNameTag: "tencloud", TemplateHashTag: "abc"}, false},
+		{"other template", map[string]string{BuildNameTag: "tencloud", TemplateHashTag: "def"}, true},
+		{"other build name", map[string]string{BuildNameTag: "other", TemplateHashTag: "abc"}, true},
+		{"untagged", map[string]string{}, true},
+	}
+	for _, c := range cases {
+		err := checkResumeOwner("instance", "ins-1", c.tags, config)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: got error %v, wanted error %t", c.name, err, c.wantErr)
+		}
+	}
+}
@@ -1,33 +1,62 @@
 package tencloud
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"net"
+	"os"
 	"time"
 
 	"github.com/3van/tencloud-go"
 	packerssh "github.com/hashicorp/packer/communicator/ssh"
 	"github.com/hashicorp/packer/helper/multistep"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
+// Interfaces the instance can be reached on
+const (
+	sshInterfacePublicIP  = "public_ip"
+	sshInterfacePrivateIP = "private_ip"
+	sshInterfaceAuto      = "auto"
+	sshInterfaceEIP       = "eip"
+)
+
+// SSHHost returns the address to reach the instance on: its public or
+// private IP, the public IP if it has one and the private one otherwise with
+// auto, or the elastic IP bound to it with eip
 func SSHHost(tc *tcapi.Client, sshInterface string) func(multistep.StateBag) (string, error) {
 	return func(state multistep.StateBag) (string, error) {
+		if sshInterface == sshInterfaceEIP {
+			eip, ok := state.GetOk("eip")
+			if !ok {
+				return "", errors.New("no elastic ip was bound to the instance")
+			}
+			return eip.(string), nil
+		}
+
 		const tries = 2
 		for j := 0; j <= tries; j++ {
 			host := ""
 			i := state.Get("instance").(tcapi.Instance)
 			switch sshInterface {
-			case "public_ip":
-				if i.PublicIpAddresses != nil && len(i.PublicIpAddresses) > 0 {
+			case sshInterfacePublicIP:
+				if len(i.PublicIpAddresses) > 0 {
 					host = i.PublicIpAddresses[0]
 				}
-			case "private_ip":
-				if i.PrivateIpAddresses != nil && len(i.PrivateIpAddresses) > 0 {
+			case sshInterfacePrivateIP:
+				if len(i.PrivateIpAddresses) > 0 {
+					host = i.PrivateIpAddresses[0]
+				}
+			case sshInterfaceAuto:
+				if len(i.PublicIpAddresses) > 0 {
+					host = i.PublicIpAddresses[0]
+				} else if len(i.PrivateIpAddresses) > 0 {
 					host = i.PrivateIpAddresses[0]
 				}
 			default:
-				panic(fmt.Sprintf("unknown SSH interface type '%s'", sshInterface))
+				return "", fmt.Errorf("unknown ssh_interface '%s'", sshInterface)
 			}
 
 			if host != "" {
@@ -56,31 +85,146 @@ func SSHHost(tc *tcapi.Client, sshInterface string) func(multistep.StateBag) (st
 	}
 }
 
-func SSHConfig(username, password string) func(multistep.StateBag) (*ssh.ClientConfig, error) {
+// SSHConfig returns the client configuration for logging into the instance
+// with every method that's set up: the agent, the private key, with the
+// certificate if there is one, and the password. Errors name the method that
+// couldn't be set up.
+func SSHConfig(config *RunConfig) func(multistep.StateBag) (*ssh.ClientConfig, error) {
 	return func(state multistep.StateBag) (*ssh.ClientConfig, error) {
-		privateKey, hasKey := state.GetOk("privateKey")
-		if hasKey {
-			signer, err := ssh.ParsePrivateKey([]byte(privateKey.(string)))
+		var cert *ssh.Certificate
+		if config.SSHCertificateFile != "" {
+			var err error
+			cert, err = loadCertificate(config.SSHCertificateFile)
 			if err != nil {
-				return nil, fmt.Errorf("error establishing SSH configuration: %s", err)
+				return nil, fmt.Errorf("error establishing SSH configuration: could not use certificate '%s': %s", config.SSHCertificateFile, err)
 			}
-			return &ssh.ClientConfig{
-				User: username,
-				Auth: []ssh.AuthMethod{
-					ssh.PublicKeys(signer),
-				},
-				HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-			}, nil
-		} else {
-			return &ssh.ClientConfig{
-				User: username,
-				Auth: []ssh.AuthMethod{
-					ssh.Password(password),
-					ssh.KeyboardInteractive(
-						packerssh.PasswordKeyboardInteractive(password)),
-				},
-				HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-			}, nil
 		}
+
+		var signers []ssh.Signer
+		if privateKey, ok := state.GetOk("privateKey"); ok {
+			signer, err := parsePrivateKey([]byte(privateKey.(string)), config.SSHPrivateKeyPassphrase)
+			if err != nil {
+				return nil, fmt.Errorf("error establishing SSH configuration: could not use private key: %s", err)
+			}
+			if cert != nil {
+				signer, err = ssh.NewCertSigner(cert, signer)
+				if err != nil {
+					return nil, fmt.Errorf("error establishing SSH configuration: could not use certificate '%s' with private key: %s", config.SSHCertificateFile, err)
+				}
+				cert = nil
+			}
+			signers = append(signers, signer)
+		}
+
+		if config.Comm.SSHAgentAuth {
+			agentSigners, err := sshAgentSigners(state)
+			if err != nil {
+				return nil, fmt.Errorf("error establishing SSH configuration: could not use ssh-agent: %s", err)
+			}
+			// a certificate not issued for the private key is for a key in
+			// the agent
+			if cert != nil {
+				certSigners := make([]ssh.Signer, 0, 1)
+				for _, signer := range agentSigners {
+					if bytes.Equal(signer.PublicKey().Marshal(), cert.Key.Marshal()) {
+						certSigner, err := ssh.NewCertSigner(cert, signer)
+						if err != nil {
+							return nil, fmt.Errorf("error establishing SSH configuration: could not use certificate '%s' with ssh-agent: %s", config.SSHCertificateFile, err)
+						}
+						certSigners = append(certSigners, certSigner)
+					}
+				}
+				if len(certSigners) == 0 {
+					return nil, fmt.Errorf("error establishing SSH configuration: ssh-agent holds no key for certificate '%s'", config.SSHCertificateFile)
+				}
+				agentSigners = append(certSigners, agentSigners...)
+				cert = nil
+			}
+			signers = append(signers, agentSigners...)
+		}
+
+		if cert != nil {
+			return nil, fmt.Errorf("error establishing SSH configuration: certificate '%s' needs a private key or ssh-agent", config.SSHCertificateFile)
+		}
+
+		auth := make([]ssh.AuthMethod, 0, 3)
+		if len(signers) > 0 {
+			auth = append(auth, ssh.PublicKeys(signers...))
+		}
+		password := config.Comm.SSHPassword
+		if generated, ok := state.GetOk("password"); ok {
+			password = generated.(string)
+		}
+		if password != "" {
+			auth = append(auth,
+				ssh.Password(password),
+				ssh.KeyboardInteractive(
+					packerssh.PasswordKeyboardInteractive(password)),
+			)
+		}
+		if len(auth) == 0 {
+			return nil, errors.New("error establishing SSH configuration: no private key, ssh-agent or password to log in with")
+		}
+
+		hostKeyCallback, err := sshHostKeyCallback(config.SSHHostKeyCheck, state)
+		if err != nil {
+			return nil, fmt.Errorf("error establishing SSH configuration: %s", err)
+		}
+		clientConfig := &ssh.ClientConfig{
+			User:            config.Comm.SSHUsername,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+		}
+		// the instance has other host keys than the pinned one
+		if config.SSHHostKeyCheck == hostKeyCheckStrict {
+			clientConfig.HostKeyAlgorithms = []string{
+				ssh.KeyAlgoED25519,
+			}
+		}
+		return clientConfig, nil
+	}
+}
+
+// sshAgent is a connection to the running ssh-agent and the keys it holds.
+// The keys sign through the connection, so it stays open until the connect
+// step is cleaned up.
+type sshAgent struct {
+	conn    net.Conn
+	signers []ssh.Signer
+}
+
+// dialSSHAgent connects to the running ssh-agent and lists its keys
+func dialSSHAgent() (*sshAgent, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, errors.New("SSH_AUTH_SOCK is not set, is ssh-agent running?")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to ssh-agent: %s", err)
+	}
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not list ssh-agent keys: %s", err)
+	}
+	if len(signers) == 0 {
+		conn.Close()
+		return nil, errors.New("ssh-agent holds no keys")
+	}
+	return &sshAgent{conn: conn, signers: signers}, nil
+}
+
+func (a *sshAgent) Close() error {
+	return a.conn.Close()
+}
+
+// sshAgentSigners returns the keys held by the ssh-agent the connect step
+// dialled
+func sshAgentSigners(state multistep.StateBag) ([]ssh.Signer, error) {
+	a, ok := state.GetOk("sshAgent")
+	if !ok {
+		return nil, errors.New("not connected to ssh-agent")
 	}
+	return a.(*sshAgent).signers, nil
 }
@@ -0,0 +1,186 @@
+package tencloud
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	packerssh "github.com/hashicorp/packer/communicator/ssh"
+	"github.com/hashicorp/packer/helper/communicator"
+	"github.com/hashicorp/packer/helper/multistep"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/proxy"
+)
+
+// Kinds of proxy SSH can be tunnelled through
+const (
+	proxyTypeSOCKS5 = "socks5"
+	proxyTypeHTTP   = "http"
+)
+
+const sshDialTimeout = 30 * time.Second
+
+// sshDialFunc connects to an address the instance's SSH server listens on
+type sshDialFunc func(address string) (net.Conn, error)
+
+// sshDialer returns how to reach the instance: through the bastion host,
+// whose host key bastionHostKey checks, or the proxy if one is configured,
+// directly otherwise
+func sshDialer(config *communicator.Config, proxyType string, bastionHostKey ssh.HostKeyCallback, state multistep.StateBag) (sshDialFunc, error) {
+	if config.SSHBastionHost != "" {
+		bastionConfig, err := sshBastionConfig(config, bastionHostKey, state)
+		if err != nil {
+			return nil, fmt.Errorf("could not configure bastion: %s", err)
+		}
+		bastion := net.JoinHostPort(config.SSHBastionHost, strconv.Itoa(config.SSHBastionPort))
+		return func(address string) (net.Conn, error) {
+			client, err := ssh.Dial("tcp", bastion, bastionConfig)
+			if err != nil {
+				return nil, fmt.Errorf("could not connect to bastion %s: %s", bastion, err)
+			}
+			conn, err := client.Dial("tcp", address)
+			if err != nil {
+				client.Close()
+				return nil, fmt.Errorf("could not connect to %s through bastion %s: %s", address, bastion, err)
+			}
+			return &bastionConn{Conn: conn, client: client}, nil
+		}, nil
+	}
+
+	if config.SSHProxyHost != "" {
+		proxyAddress := net.JoinHostPort(config.SSHProxyHost, strconv.Itoa(config.SSHProxyPort))
+		if proxyType == proxyTypeHTTP {
+			return func(address string) (net.Conn, error) {
+				return httpConnect(proxyAddress, config.SSHProxyUsername, config.SSHProxyPassword, address)
+			}, nil
+		}
+
+		var auth *proxy.Auth
+		if config.SSHProxyUsername != "" {
+			auth = &proxy.Auth{
+				User:     config.SSHProxyUsername,
+				Password: config.SSHProxyPassword,
+			}
+		}
+		dialer, err := proxy.SOCKS5("tcp", proxyAddress, auth, &net.Dialer{Timeout: sshDialTimeout})
+		if err != nil {
+			return nil, fmt.Errorf("could not configure proxy: %s", err)
+		}
+		return func(address string) (net.Conn, error) {
+			conn, err := dialer.Dial("tcp", address)
+			if err != nil {
+				return nil, fmt.Errorf("could not connect to %s through proxy %s: %s", address, proxyAddress, err)
+			}
+			return conn, nil
+		}, nil
+	}
+
+	return func(address string) (net.Conn, error) {
+		return net.DialTimeout("tcp", address, sshDialTimeout)
+	}, nil
+}
+
+// sshBastionConfig logs into the bastion host with every method that's set
+// up for it, using the ssh-agent connection in state
+func sshBastionConfig(config *communicator.Config, hostKeyCallback ssh.HostKeyCallback, state multistep.StateBag) (*ssh.ClientConfig, error) {
+	auth := make([]ssh.AuthMethod, 0, 3)
+	if config.SSHBastionPassword != "" {
+		auth = append(auth,
+			ssh.Password(config.SSHBastionPassword),
+			ssh.KeyboardInteractive(
+				packerssh.PasswordKeyboardInteractive(config.SSHBastionPassword)),
+		)
+	}
+	if config.SSHBastionPrivateKey != "" {
+		contents, err := ioutil.ReadFile(config.SSHBastionPrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not use private key: %s", err)
+		}
+		signer, err := parsePrivateKey(contents, "")
+		if err != nil {
+			return nil, fmt.Errorf("could not use private key: %s", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if config.SSHBastionAgentAuth {
+		signers, err := sshAgentSigners(state)
+		if err != nil {
+			return nil, fmt.Errorf("could not use ssh-agent: %s", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+
+	return &ssh.ClientConfig{
+		User:            config.SSHBastionUsername,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         sshDialTimeout,
+	}, nil
+}
+
+// bastionConn is a connection through the bastion host, closing the
+// connection to the bastion with it
+type bastionConn struct {
+	net.Conn
+	client *ssh.Client
+}
+
+func (c *bastionConn) Close() error {
+	c.Conn.Close()
+	return c.client.Close()
+}
+
+// httpConnect opens a tunnel to address through an HTTP proxy with CONNECT
+func httpConnect(proxyAddress, username, password, address string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", proxyAddress, sshDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to proxy %s: %s", proxyAddress, err)
+	}
+
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", address, address)
+	if username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		req += fmt.Sprintf("Proxy-Authorization: Basic %s\r\n", credentials)
+	}
+	req += "\r\n"
+
+	conn.SetDeadline(time.Now().Add(sshDialTimeout))
+	if _, err := conn.Write([]byte(req)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not connect to %s through proxy %s: %s", address, proxyAddress, err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not connect to %s through proxy %s: %s", address, proxyAddress, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("could not connect to %s through proxy %s: %s", address, proxyAddress, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// the SSH server may have sent its banner already, and it's buffered
+	if r.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads what was buffered while reading the proxy's response
+// before reading from the connection
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,67 @@
+package tencloud
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestHTTPConnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	requests := make(chan *http.Request, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			req, err := http.ReadRequest(bufio.NewReader(conn))
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			requests <- req
+			if req.Header.Get("Proxy-Authorization") == "" {
+				conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+				conn.Close()
+				continue
+			}
+			// the banner comes in the same packet as the response
+			conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nSSH-2.0-test\r\n"))
+			conn.Close()
+		}
+	}()
+
+	if _, err := httpConnect(l.Addr().String(), "", "", "10.0.0.5:22"); err == nil {
+		t.Fatal("should have errored without credentials")
+	}
+	<-requests
+
+	conn, err := httpConnect(l.Addr().String(), "ci", "secret", "10.0.0.5:22")
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	defer conn.Close()
+	req := <-requests
+	if req.Method != http.MethodConnect || req.Host != "10.0.0.5:22" {
+		t.Fatalf("bad request: %s %s", req.Method, req.Host)
+	}
+	if user, password, ok := (&http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}).BasicAuth(); !ok || user != "ci" || password != "secret" {
+		t.Fatalf("bad credentials: %s", req.Header.Get("Proxy-Authorization"))
+	}
+
+	banner, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(banner) != "SSH-2.0-test\r\n" {
+		t.Fatalf("bad banner: %q", banner)
+	}
+}
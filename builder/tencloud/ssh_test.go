@@ -0,0 +1,51 @@
+package tencloud
+
+import (
+	"testing"
+
+	"github.com/3van/tencloud-go"
+	"github.com/hashicorp/packer/helper/multistep"
+)
+
+func TestSSHHost(t *testing.T) {
+	instance := tcapi.Instance{
+		InstanceId:         "ins-1",
+		PrivateIpAddresses: []string{"10.0.0.5"},
+		PublicIpAddresses:  []string{"203.0.113.5"},
+	}
+	private := instance
+	private.PublicIpAddresses = nil
+
+	cases := []struct {
+		sshInterface string
+		instance     tcapi.Instance
+		want         string
+	}{
+		{sshInterfacePublicIP, instance, "203.0.113.5"},
+		{sshInterfacePrivateIP, instance, "10.0.0.5"},
+		{sshInterfaceAuto, instance, "203.0.113.5"},
+		{sshInterfaceAuto, private, "10.0.0.5"},
+		{sshInterfaceEIP, private, "198.51.100.5"},
+	}
+	for _, c := range cases {
+		state := new(multistep.BasicStateBag)
+		state.Put("instance", c.instance)
+		state.Put("eip", "198.51.100.5")
+		host, err := SSHHost(nil, c.sshInterface)(state)
+		if err != nil {
+			t.Fatalf("%s: should not have error: %s", c.sshInterface, err)
+		}
+		if host != c.want {
+			t.Fatalf("%s: got %s, wanted %s", c.sshInterface, host, c.want)
+		}
+	}
+
+	state := new(multistep.BasicStateBag)
+	state.Put("instance", instance)
+	if _, err := SSHHost(nil, "ipv6")(state); err == nil {
+		t.Fatal("should have errored on an unknown interface")
+	}
+	if _, err := SSHHost(nil, sshInterfaceEIP)(state); err == nil {
+		t.Fatal("should have errored without an elastic ip")
+	}
+}
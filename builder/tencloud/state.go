@@ -1,6 +1,7 @@
 package tencloud
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -12,6 +13,15 @@ import (
 	"github.com/hashicorp/packer/helper/multistep"
 )
 
+// Defaults for the StateChangeConf fields that are left unset, when there's
+// no build config to take timeout and poll_delay from
+const (
+	defaultTimeout          = 300 * time.Second
+	defaultPollDelay        = 2 * time.Second
+	defaultMaxPollDelay     = 30 * time.Second
+	defaultMaxRefreshErrors = 5
+)
+
 type StateRefreshFunc func() (result interface{}, state string, err error)
 
 type StateChangeConf struct {
@@ -19,6 +29,18 @@ type StateChangeConf struct {
 	Refresh   StateRefreshFunc
 	StepState multistep.StateBag
 	Target    string
+
+	// Context ends the wait early when it's done
+	Context context.Context
+	// Timeout is how long to wait for, the build's timeout if not set
+	Timeout time.Duration
+	// PollDelay is the wait before the second refresh, doubling after each
+	// one up to MaxPollDelay. It defaults to the build's poll_delay.
+	PollDelay    time.Duration
+	MaxPollDelay time.Duration
+	// MaxRefreshErrors is how many transient refresh errors in a row are
+	// tolerated before giving up
+	MaxRefreshErrors int
 }
 
 func ImageStateRefreshFunc(tc *tcapi.Client, imageId string) StateRefreshFunc {
@@ -26,9 +48,12 @@ func ImageStateRefreshFunc(tc *tcapi.Client, imageId string) StateRefreshFunc {
 		resp, err := tc.DescribeImages(&tcapi.DescribeImagesRequest{
 			ImageIds: []string{imageId},
 		})
-		if err != nil {
+		if err != nil && isNotFound(err) {
 			return nil, "", nil
 		}
+		if err != nil {
+			return nil, "", err
+		}
 
 		if resp == nil || len(resp.ImageSet) == 0 {
 			return nil, "", nil
@@ -58,9 +83,12 @@ func ImageExistsRefreshFunc(tc *tcapi.Client, imageName string) StateRefreshFunc
 			Limit: 1,
 		}
 		resp, err := tc.DescribeImages(req)
-		if err != nil {
+		if err != nil && isNotFound(err) {
 			return nil, "", nil
 		}
+		if err != nil {
+			return nil, "", err
+		}
 
 		if resp == nil || len(resp.ImageSet) == 0 {
 			return nil, "", nil
@@ -70,14 +98,88 @@ func ImageExistsRefreshFunc(tc *tcapi.Client, imageName string) StateRefreshFunc
 	}
 }
 
+// NewImageRefreshFunc looks for a private image named imageName that isn't
+// one of the existing image IDs
+func NewImageRefreshFunc(tc *tcapi.Client, imageName string, existing []string) StateRefreshFunc {
+	return func() (interface{}, string, error) {
+		image, err := newImageNamed(tc, imageName, existing)
+		if err != nil {
+			return nil, "", err
+		}
+		if image == nil {
+			return nil, "", nil
+		}
+		return *image, image.ImageState, nil
+	}
+}
+
+// newImageNamed returns the private image named imageName that isn't one of
+// the existing image IDs, or nil if there's none
+func newImageNamed(tc *tcapi.Client, imageName string, existing []string) (*tcapi.Image, error) {
+	images, err := privateImagesNamed(tc, imageName)
+	if err != nil {
+		return nil, err
+	}
+	for i := range images {
+		if images[i].ImageName == imageName && !stringInSlice(images[i].ImageId, existing) {
+			return &images[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// ImportedImageRefreshFunc looks for the private image an import tagged with
+// ImportTag set to importId made, using temporary credentials and token.
+func ImportedImageRefreshFunc(tc *tcapi.Client, token, importId string) StateRefreshFunc {
+	return func() (interface{}, string, error) {
+		req := &tcapi.DescribeImagesRequest{
+			Filters: []tcapi.Filter{
+				{
+					Name: "image-type",
+					Values: []string{
+						"PRIVATE_IMAGE",
+					},
+				},
+				{
+					Name: "tag:" + ImportTag,
+					Values: []string{
+						importId,
+					},
+				},
+			},
+			Limit: 100,
+		}
+		for {
+			resp := new(tcapi.DescribeImagesResponse)
+			err := callAPIWithToken(tc, token, "image", "DescribeImages", req, resp)
+			if err != nil && isNotFound(err) {
+				return nil, "", nil
+			}
+			if err != nil {
+				return nil, "", err
+			}
+			if len(resp.ImageSet) > 0 {
+				return resp.ImageSet[0], resp.ImageSet[0].ImageState, nil
+			}
+			if req.Offset+req.Limit >= resp.TotalCount {
+				return nil, "", nil
+			}
+			req.Offset += req.Limit
+		}
+	}
+}
+
 func InstanceStateRefreshFunc(tc *tcapi.Client, instanceId string) StateRefreshFunc {
 	return func() (interface{}, string, error) {
 		resp, err := tc.DescribeInstances(&tcapi.DescribeInstancesRequest{
 			InstanceIds: []string{instanceId},
 		})
-		if err != nil {
+		if err != nil && isNotFound(err) {
 			return nil, "", nil
 		}
+		if err != nil {
+			return nil, "", err
+		}
 
 		if resp == nil || len(resp.InstanceSet) == 0 {
 			return nil, "", nil
@@ -87,110 +189,170 @@ func InstanceStateRefreshFunc(tc *tcapi.Client, instanceId string) StateRefreshF
 	}
 }
 
-func WaitForState(conf *StateChangeConf) (i interface{}, err error) {
-	log.Printf("Waiting for state to become: %s", conf.Target)
-
-	sleepSeconds := SleepSeconds()
-	maxTicks := TimeoutSeconds()/sleepSeconds + 1
-	notfoundTick := 0
-
-	for {
-		var currentState string
-		i, currentState, err = conf.Refresh()
+// AddressStateRefreshFunc refreshes an elastic IP's status
+func AddressStateRefreshFunc(tc *tcapi.Client, addressId string) StateRefreshFunc {
+	return func() (interface{}, string, error) {
+		resp, err := describeAddresses(tc, &describeAddressesRequest{
+			AddressIds: []string{addressId},
+		})
+		if err != nil && isNotFound(err) {
+			return nil, "", nil
+		}
 		if err != nil {
-			return
+			return nil, "", err
 		}
 
-		if i == nil {
-			notfoundTick += 1
-			if notfoundTick > maxTicks {
-				return nil, errors.New("couldn't find resource")
-			}
-		} else {
-			notfoundTick = 0
-
-			if currentState == conf.Target {
-				return
-			}
-
-			if conf.StepState != nil {
-				if _, ok := conf.StepState.GetOk(multistep.StateCancelled); ok {
-					return nil, errors.New("interrupted")
-				}
-			}
-
-			found := false
-			for _, allowed := range conf.Pending {
-				if currentState == allowed {
-					found = true
-					break
-				}
-			}
-
-			if !found {
-				err := fmt.Errorf("unexpected state '%s', wanted target '%s'", currentState, conf.Target)
-				return nil, err
-			}
+		if resp == nil || len(resp.AddressSet) == 0 {
+			return nil, "", nil
 		}
 
-		time.Sleep(time.Duration(sleepSeconds) * time.Second)
+		return resp.AddressSet[0], resp.AddressSet[0].AddressStatus, nil
 	}
 }
 
-func WaitForExists(conf *StateChangeConf) (i interface{}, err error) {
-	log.Printf("Waiting for resource to exist")
-
-	sleepSeconds := SleepSeconds()
-	maxTicks := TimeoutSeconds()/sleepSeconds + 1
-	notfoundTick := 0
+// WaitForState waits for the resource to reach the target state, failing if
+// it's in a state that's neither pending nor the target
+func WaitForState(conf *StateChangeConf) (interface{}, error) {
+	log.Printf("Waiting for state to become: %s", conf.Target)
 
-	for {
-		i, _, err = conf.Refresh()
-		if err != nil {
-			return nil, errors.New("couldn't find resource")
+	return conf.wait(fmt.Sprintf("state '%s'", conf.Target), func(i interface{}, state string) (bool, error) {
+		if i == nil {
+			return false, nil
 		}
-
-		if i != nil {
-			return
-		} else {
-			notfoundTick += 1
-			if notfoundTick > maxTicks {
-				return nil, errors.New("couldn't find resource")
-			}
+		if state == conf.Target {
+			return true, nil
+		}
+		if !stringInSlice(state, conf.Pending) {
+			return false, fmt.Errorf("unexpected state '%s', wanted target '%s'", state, conf.Target)
 		}
+		return false, nil
+	})
+}
 
-		time.Sleep(time.Duration(sleepSeconds) * time.Second)
-	}
+func WaitForExists(conf *StateChangeConf) (interface{}, error) {
+	log.Printf("Waiting for resource to exist")
+
+	return conf.wait("resource to exist", func(i interface{}, _ string) (bool, error) {
+		return i != nil, nil
+	})
 }
 
-func WaitForDoesNotExist(conf *StateChangeConf) (i interface{}, err error) {
+func WaitForDoesNotExist(conf *StateChangeConf) (interface{}, error) {
 	log.Printf("Waiting for resource to cease to exist")
 
-	sleepSeconds := SleepSeconds()
-	maxTicks := TimeoutSeconds()/sleepSeconds + 1
-	foundTick := 0
+	return conf.wait("resource to cease to exist", func(i interface{}, _ string) (bool, error) {
+		return i == nil, nil
+	})
+}
 
+// wait refreshes the resource until done reports it's finished or fails,
+// backing off exponentially in between. Transient refresh errors are
+// tolerated up to MaxRefreshErrors in a row, any other ends the wait.
+func (conf *StateChangeConf) wait(what string, done func(i interface{}, state string) (bool, error)) (interface{}, error) {
+	ctx := conf.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	timeout := conf.Timeout
+	delay := conf.PollDelay
+	if conf.StepState != nil {
+		if config, ok := conf.StepState.GetOk("config"); ok {
+			if timeout <= 0 {
+				timeout = config.(Config).Timeout
+			}
+			if delay <= 0 {
+				delay = config.(Config).PollDelay
+			}
+		}
+	}
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	if delay <= 0 {
+		delay = defaultPollDelay
+	}
+	maxDelay := conf.MaxPollDelay
+	if maxDelay <= 0 {
+		maxDelay = defaultMaxPollDelay
+	}
+	if maxDelay < delay {
+		maxDelay = delay
+	}
+	maxErrors := conf.MaxRefreshErrors
+	if maxErrors <= 0 {
+		maxErrors = defaultMaxRefreshErrors
+	}
+
+	start := time.Now()
+	lastState := "unknown"
+	var lastErr error
+	refreshErrors := 0
 	for {
-		i, _, err = conf.Refresh()
+		i, state, err := conf.Refresh()
 		if err != nil {
-			return nil, errors.New("couldn't find resource")
+			refreshErrors++
+			if !isRetryable(err) || refreshErrors > maxErrors {
+				return nil, fmt.Errorf("error waiting for %s, last state '%s': %s", what, lastState, err)
+			}
+			log.Printf("error refreshing state, retrying (%d of %d): %s", refreshErrors, maxErrors, err)
+			lastErr = err
+		} else {
+			refreshErrors = 0
+			lastErr = nil
+			if i == nil {
+				state = "not found"
+			}
+			if state != lastState {
+				log.Printf("state is now '%s' after %s", state, time.Since(start).Round(time.Second))
+			}
+			lastState = state
+
+			finished, err := done(i, state)
+			if err != nil {
+				return nil, err
+			}
+			if finished {
+				return i, nil
+			}
 		}
 
-		if i == nil {
-			return
-		} else {
-			foundTick += 1
-			if foundTick > maxTicks {
-				return nil, errors.New("resource still exists after timeout")
+		if conf.StepState != nil {
+			if _, ok := conf.StepState.GetOk(multistep.StateCancelled); ok {
+				return nil, errors.New("interrupted")
+			}
+		}
+
+		remaining := timeout - time.Since(start)
+		if remaining <= 0 {
+			err := fmt.Errorf("timed out after %s waiting for %s, last state '%s'", timeout, what, lastState)
+			if lastErr != nil {
+				err = fmt.Errorf("%s, last error: %s", err, lastErr)
 			}
+			return nil, err
+		}
+		if delay > remaining {
+			delay = remaining
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("interrupted: %s", ctx.Err())
+		case <-timer.C:
 		}
 
-		time.Sleep(time.Duration(sleepSeconds) * time.Second)
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
 	}
 }
 
+// TimeoutSeconds is the default for timeout, which TC_TIMEOUT_SECONDS set
+// before it could be configured
 func TimeoutSeconds() (seconds int) {
-	seconds = 300
+	seconds = int(defaultTimeout / time.Second)
 
 	override := os.Getenv("TC_TIMEOUT_SECONDS")
 	if override != "" {
@@ -201,13 +363,13 @@ func TimeoutSeconds() (seconds int) {
 			seconds = n
 		}
 	}
-
-	log.Printf("Allowing %ds to complete (change with TC_TIMEOUT_SECONDS)", seconds)
 	return seconds
 }
 
+// SleepSeconds is the default for poll_delay, which TC_POLL_DELAY_SECONDS set
+// before it could be configured
 func SleepSeconds() (seconds int) {
-	seconds = 2
+	seconds = int(defaultPollDelay / time.Second)
 
 	override := os.Getenv("TC_POLL_DELAY_SECONDS")
 	if override != "" {
@@ -218,7 +380,5 @@ func SleepSeconds() (seconds int) {
 			seconds = n
 		}
 	}
-
-	log.Printf("Using %ds as polling delay (change with TC_POLL_DELAY_SECONDS)", seconds)
 	return seconds
 }
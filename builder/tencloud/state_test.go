@@ -0,0 +1,145 @@
+package tencloud
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/3van/tencloud-go"
+)
+
+// refreshSequence returns a StateRefreshFunc that reports states in order,
+// repeating the last one. An "error:" state is returned as an error.
+func refreshSequence(states ...string) StateRefreshFunc {
+	n := 0
+	return func() (interface{}, string, error) {
+		state := states[n]
+		if n < len(states)-1 {
+			n++
+		}
+		if strings.HasPrefix(state, "error:") {
+			return nil, "", errors.New(strings.TrimPrefix(state, "error:"))
+		}
+		if state == "" {
+			return nil, "", nil
+		}
+		return state, state, nil
+	}
+}
+
+func TestWaitForState(t *testing.T) {
+	_, err := WaitForState(&StateChangeConf{
+		Pending:   []string{"PENDING"},
+		Target:    "RUNNING",
+		Refresh:   refreshSequence("", "PENDING", "error:request failed: timeout", "RUNNING"),
+		Timeout:   time.Second,
+		PollDelay: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestWaitForState_unexpected(t *testing.T) {
+	_, err := WaitForState(&StateChangeConf{
+		Pending:   []string{"PENDING"},
+		Target:    "RUNNING",
+		Refresh:   refreshSequence("PENDING", "LAUNCH_FAILED"),
+		Timeout:   time.Second,
+		PollDelay: time.Millisecond,
+	})
+	if err == nil || !strings.Contains(err.Error(), "LAUNCH_FAILED") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestWaitForState_refreshErrors(t *testing.T) {
+	_, err := WaitForState(&StateChangeConf{
+		Pending:   []string{"PENDING"},
+		Target:    "RUNNING",
+		Refresh:   refreshSequence("PENDING", "error:API returned an error (AuthFailure - ): denied"),
+		Timeout:   time.Second,
+		PollDelay: time.Millisecond,
+	})
+	if err == nil || !strings.Contains(err.Error(), "AuthFailure") || !strings.Contains(err.Error(), "last state 'PENDING'") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	_, err = WaitForState(&StateChangeConf{
+		Pending:          []string{"PENDING"},
+		Target:           "RUNNING",
+		Refresh:          refreshSequence("error:API returned an error (InternalError - ): oops"),
+		Timeout:          time.Second,
+		PollDelay:        time.Millisecond,
+		MaxRefreshErrors: 3,
+	})
+	if err == nil || !strings.Contains(err.Error(), "InternalError") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestWaitForState_timeout(t *testing.T) {
+	start := time.Now()
+	_, err := WaitForState(&StateChangeConf{
+		Pending:   []string{"PENDING"},
+		Target:    "RUNNING",
+		Refresh:   refreshSequence("PENDING"),
+		Timeout:   50 * time.Millisecond,
+		PollDelay: 10 * time.Millisecond,
+	})
+	if err == nil || !strings.Contains(err.Error(), "last state 'PENDING'") {
+		t.Fatalf("bad: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("timeout not honoured, took %s", elapsed)
+	}
+}
+
+func TestWaitForDoesNotExist_context(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := WaitForDoesNotExist(&StateChangeConf{
+		Refresh:   refreshSequence("TERMINATING"),
+		Context:   ctx,
+		Timeout:   time.Minute,
+		PollDelay: time.Minute,
+	})
+	if err == nil || !strings.Contains(err.Error(), "interrupted") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestImportedImageRefreshFunc(t *testing.T) {
+	// another import under the same name, and more private images than fit
+	// on a page
+	imported := map[string]tcapi.Image{
+		"import-1": {ImageId: "img-1", ImageName: "web", ImageState: "IMPORTING"},
+		"import-2": {ImageId: "img-2", ImageName: "web", ImageState: "NORMAL"},
+	}
+	_, tc, restore := useFakeAPI(map[string]func(url.Values) (interface{}, error){
+		"DescribeImages": func(params url.Values) (interface{}, error) {
+			if params.Get("Filters.0.Values.0") != "PRIVATE_IMAGE" || params.Get("Filters.1.Name") != "tag:"+ImportTag {
+				return nil, errors.New("InvalidFilter")
+			}
+			resp := &tcapi.DescribeImagesResponse{TotalCount: 150}
+			if params.Get("Offset") == "100" {
+				if image, ok := imported[params.Get("Filters.1.Values.0")]; ok {
+					resp.ImageSet = append(resp.ImageSet, image)
+				}
+			}
+			return resp, nil
+		},
+	})
+	defer restore()
+
+	image, state, err := ImportedImageRefreshFunc(tc, "token", "import-1")()
+	if err != nil || image.(tcapi.Image).ImageId != "img-1" || state != "IMPORTING" {
+		t.Fatalf("bad: %#v, %s, %v", image, state, err)
+	}
+	if image, _, err := ImportedImageRefreshFunc(tc, "token", "import-3")(); err != nil || image != nil {
+		t.Fatalf("bad: %#v, %v", image, err)
+	}
+}
@@ -0,0 +1,178 @@
+package tencloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	packerssh "github.com/hashicorp/packer/communicator/ssh"
+	"github.com/hashicorp/packer/helper/communicator"
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+	"golang.org/x/crypto/ssh"
+)
+
+// StepConnectSSH connects to the instance over SSH, directly or through the
+// bastion host or proxy set in Config. It replaces packer's own step, which
+// has no HTTP proxies and logs into SOCKS5 proxies as the bastion user.
+type StepConnectSSH struct {
+	Config         *communicator.Config
+	ProxyType      string
+	HostKeyCheck   string
+	BastionHostKey string
+	Host           func(multistep.StateBag) (string, error)
+	SSHConfig      func(multistep.StateBag) (*ssh.ClientConfig, error)
+
+	agent *sshAgent
+}
+
+// sshResult is what waiting for SSH came to
+type sshResult struct {
+	comm packer.Communicator
+	err  error
+}
+
+func (step *StepConnectSSH) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+
+	// the agent is dialled once, however many times logging in is tried
+	if step.Config.SSHAgentAuth || (step.Config.SSHBastionHost != "" && step.Config.SSHBastionAgentAuth) {
+		agent, err := dialSSHAgent()
+		if err != nil {
+			state.Put("error", fmt.Errorf("could not use ssh-agent: %s", err))
+			return multistep.ActionHalt
+		}
+		step.agent = agent
+		state.Put("sshAgent", agent)
+	}
+
+	bastionHostKey, err := bastionHostKeyCallback(step.HostKeyCheck, step.BastionHostKey, state)
+	if err != nil {
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+	dial, err := sshDialer(step.Config, step.ProxyType, bastionHostKey, state)
+	if err != nil {
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+
+	cancel := make(chan struct{})
+	// buffered so the wait can finish after Run has given up on it
+	waitDone := make(chan sshResult, 1)
+	go func() {
+		switch {
+		case step.Config.SSHBastionHost != "":
+			ui.Say(fmt.Sprintf("waiting for ssh through bastion %s", step.Config.SSHBastionHost))
+		case step.Config.SSHProxyHost != "":
+			ui.Say(fmt.Sprintf("waiting for ssh through %s proxy %s", step.ProxyType, step.Config.SSHProxyHost))
+		default:
+			ui.Say("waiting for ssh")
+		}
+		comm, err := step.waitForSSH(state, dial, cancel)
+		waitDone <- sshResult{comm, err}
+	}()
+
+	timeout := time.After(step.Config.SSHTimeout)
+	for {
+		select {
+		case result := <-waitDone:
+			if result.err != nil {
+				state.Put("error", fmt.Errorf("could not connect to ssh: %s", result.err))
+				return multistep.ActionHalt
+			}
+			ui.Say("connected to ssh")
+			state.Put("communicator", result.comm)
+			return multistep.ActionContinue
+		case <-timeout:
+			close(cancel)
+			state.Put("error", fmt.Errorf("timed out after %s waiting for ssh", step.Config.SSHTimeout))
+			return multistep.ActionHalt
+		case <-ctx.Done():
+			close(cancel)
+			state.Put("error", errors.New("interrupted while waiting for ssh"))
+			return multistep.ActionHalt
+		case <-time.After(time.Second):
+			if _, ok := state.GetOk(multistep.StateCancelled); ok {
+				close(cancel)
+				state.Put("error", errors.New("interrupted while waiting for ssh"))
+				return multistep.ActionHalt
+			}
+		}
+	}
+}
+
+func (step *StepConnectSSH) waitForSSH(state multistep.StateBag, dial sshDialFunc, cancel <-chan struct{}) (packer.Communicator, error) {
+	handshakeAttempts := 0
+	for first := true; ; first = false {
+		if !first {
+			select {
+			case <-cancel:
+				return nil, errors.New("cancelled")
+			case <-time.After(5 * time.Second):
+			}
+		}
+
+		host, err := step.Host(state)
+		if err != nil {
+			log.Printf("could not get ssh address: %s", err)
+			continue
+		}
+		sshConfig, err := step.SSHConfig(state)
+		if err != nil {
+			log.Printf("could not get ssh config: %s", err)
+			continue
+		}
+
+		address := net.JoinHostPort(host, strconv.Itoa(step.Config.SSHPort))
+		conn, err := dial(address)
+		if err != nil {
+			// a bastion presenting another host key won't change its mind
+			if isHostKeyMismatch(err) {
+				return nil, err
+			}
+			log.Printf("could not connect to %s: %s", address, err)
+			continue
+		}
+		conn.Close()
+
+		comm, err := packerssh.New(address, &packerssh.Config{
+			SSHConfig:              sshConfig,
+			Connection:             func() (net.Conn, error) { return dial(address) },
+			Pty:                    step.Config.SSHPty,
+			DisableAgentForwarding: step.Config.SSHDisableAgentForwarding,
+			UseSftp:                step.Config.SSHFileTransferMethod == "sftp",
+			KeepAliveInterval:      step.Config.SSHKeepAliveInterval,
+			Timeout:                step.Config.SSHReadWriteTimeout,
+		})
+		if err != nil {
+			log.Printf("ssh handshake with %s failed: %s", address, err)
+			if isHostKeyMismatch(err) {
+				return nil, err
+			}
+			// only failed logins count as attempts, not the server not being up
+			if !strings.Contains(err.Error(), "authenticate") {
+				continue
+			}
+			handshakeAttempts++
+			if handshakeAttempts < step.Config.SSHHandshakeAttempts {
+				time.Sleep(2 * time.Second)
+				continue
+			}
+			return nil, err
+		}
+		return comm, nil
+	}
+}
+
+func (step *StepConnectSSH) Cleanup(_ multistep.StateBag) {
+	if step.agent != nil {
+		step.agent.Close()
+		step.agent = nil
+	}
+}
@@ -11,24 +11,52 @@ import (
 	"github.com/hashicorp/packer/packer"
 )
 
-type StepCreateImage struct {
-	Image tcapi.Image
-}
+type StepCreateImage struct{}
 
 func (step *StepCreateImage) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
 	config := state.Get("config").(Config)
 	tc := state.Get("tc").(*tcapi.Client)
 	instance := state.Get("instance").(tcapi.Instance)
 	ui := state.Get("ui").(packer.Ui)
+	created := state.Get("created_images").(*CreatedImages)
 
 	imageDesc := config.ImageDescription
-	if config.ImageDescTags.IsSet() {
-		imageDesc = config.ImageDescTags.Flatten(config.ImageDescTagsDelim)
+	if config.ImageTagsInDescription && config.ImageTags.IsSet() {
+		imageDesc = config.ImageTags.Flatten(config.ImageDescTagsDelim)
+	}
+
+	// CreateImage takes no idempotency token, so the images already named
+	// like the new one are noted to tell apart one made by an attempt we never
+	// heard back from
+	existing, err := privateImagesNamed(tc, config.ImageName)
+	if err != nil {
+		state.Put("error", fmt.Errorf("could not query image '%s': %s", config.ImageName, err))
+		return multistep.ActionHalt
+	}
+	existingIds := make([]string, 0, len(existing))
+	for _, image := range existing {
+		existingIds = append(existingIds, image.ImageId)
 	}
 
 	// oh cool i guess we'll do a retry loop here too because that's fun 😥
-	created := false
-	err := retry.Retry(0.2, 30, 11, func(_ uint) (bool, error) {
+	var imageId string
+	done := false
+	err = retry.Retry(0.2, 30, 11, func(i uint) (bool, error) {
+		if i > 0 {
+			image, err := newImageNamed(tc, config.ImageName, existingIds)
+			if err != nil {
+				ui.Error(fmt.Sprintf("error looking for image made by a failed attempt: %v", err))
+				return false, nil
+			}
+			if image != nil {
+				ui.Message(fmt.Sprintf("a failed attempt created image '%s' after all", image.ImageId))
+				imageId = image.ImageId
+				created.Add(config.Region, imageId)
+				done = true
+				return true, nil
+			}
+		}
+
 		ui.Say(fmt.Sprintf("creating image '%s'", config.ImageName))
 		req := &tcapi.CreateImageRequest{
 			InstanceId:       instance.InstanceId,
@@ -36,43 +64,61 @@ func (step *StepCreateImage) Run(ctx context.Context, state multistep.StateBag)
 			ImageDescription: imageDesc,
 		}
 
-		if err := tc.CreateImage(req); err != nil {
+		resp, err := createImage(tc, req)
+		if err != nil {
 			ui.Error(fmt.Sprintf("error creating image: %v", err))
+			if !isRetryable(err) {
+				return false, err
+			}
 			return false, nil
 		}
 
-		created = true
+		imageId = resp.ImageId
+		created.Add(config.Region, imageId)
+		done = true
 		return true, nil
 	})
-	if !created || err != nil {
+	if !done || err != nil {
 		state.Put("error", fmt.Errorf("error creating image: %s", err))
 		return multistep.ActionHalt
 	}
 
-	stateChange := StateChangeConf{
-		Pending:   []string{"SYNCING", "PENDING", "CREATING"},
-		Target:    "NORMAL",
-		Refresh:   ImageExistsRefreshFunc(tc, config.ImageName),
-		StepState: state,
-	}
-	image, err := WaitForExists(&stateChange)
-	if err != nil {
-		state.Put("error", fmt.Errorf("error waiting for image: %s", err))
-		return multistep.ActionHalt
+	// older API versions don't report the new image's ID, so fall back to
+	// looking it up by name
+	if imageId == "" {
+		stateChange := StateChangeConf{
+			Pending:   []string{"SYNCING", "PENDING", "CREATING"},
+			Target:    "NORMAL",
+			Refresh:   NewImageRefreshFunc(tc, config.ImageName, existingIds),
+			StepState: state,
+			Context:   ctx,
+			Timeout:   config.ImageCreateTimeout,
+		}
+		image, err := WaitForExists(&stateChange)
+		if err != nil {
+			state.Put("error", fmt.Errorf("error waiting for image: %s", err))
+			return multistep.ActionHalt
+		}
+		imageId = image.(tcapi.Image).ImageId
+		created.Add(config.Region, imageId)
 	}
 
-	imageInst := image.(tcapi.Image)
-	ui.Message(fmt.Sprintf("image ID: %s", imageInst.ImageId))
+	ui.Message(fmt.Sprintf("image ID: %s", imageId))
+	if err := tagImageBuildState(state, config.Region, []string{imageId}, "incomplete"); err != nil {
+		ui.Error(fmt.Sprintf("could not tag image '%s': %s", imageId, err))
+	}
 	images := make(map[string]string)
-	images[config.Region] = imageInst.ImageId
+	images[config.Region] = imageId
 	state.Put("images", images)
 
 	ui.Say("waiting for image to become ready")
-	stateChange = StateChangeConf{
+	stateChange := StateChangeConf{
 		Pending:   []string{"SYNCING", "PENDING", "CREATING"},
 		Target:    "NORMAL",
-		Refresh:   ImageStateRefreshFunc(tc, imageInst.ImageId),
+		Refresh:   ImageStateRefreshFunc(tc, imageId),
 		StepState: state,
+		Context:   ctx,
+		Timeout:   config.ImageCreateTimeout,
 	}
 	if _, err := WaitForState(&stateChange); err != nil {
 		ui.Say(fmt.Sprintf("failed to wait for image: %v", err))
@@ -80,8 +126,6 @@ func (step *StepCreateImage) Run(ctx context.Context, state multistep.StateBag)
 		return multistep.ActionHalt
 	}
 
-	step.Image = imageInst
-
 	return multistep.ActionContinue
 }
 
@@ -92,13 +136,14 @@ func (step *StepCreateImage) Cleanup(state multistep.StateBag) {
 		return
 	}
 
-	tc := state.Get("tc").(*tcapi.Client)
 	ui := state.Get("ui").(packer.Ui)
-
-	ui.Say("deleting image because of cancellation")
-	req := &tcapi.DeleteImagesRequest{ImageIds: []string{step.Image.ImageId}}
-	if err := tc.DeleteImages(req); err != nil {
-		ui.Error(fmt.Sprintf("could not delete image: %s", err))
+	created := state.Get("created_images").(*CreatedImages)
+	if len(created.Regions()) == 0 {
 		return
 	}
+
+	ui.Say("deleting images because of cancellation")
+	if err := created.Rollback(state); err != nil {
+		ui.Error(fmt.Sprintf("could not delete all images, remove these manually: %s", err))
+	}
 }
@@ -2,7 +2,12 @@ package tencloud
 
 import (
 	"context"
+	"crypto/sha1"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/3van/tencloud-go"
 
@@ -10,10 +15,23 @@ import (
 	"github.com/hashicorp/packer/packer"
 )
 
+// backupImage is an existing image that safe mode renamed out of the way
+type backupImage struct {
+	Region  string
+	ImageId string
+	Name    string
+}
+
 type StepDeregisterImage struct {
 	ForceDeregister bool
+	Mode            string
 	ImageName       string
 	Regions         []string
+	InUse           bool
+	ProtectionTag   string
+	ShareAccounts   []string
+
+	backups []backupImage
 }
 
 func (step *StepDeregisterImage) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
@@ -24,38 +42,68 @@ func (step *StepDeregisterImage) Run(ctx context.Context, state multistep.StateB
 	ui := state.Get("ui").(packer.Ui)
 	tc := state.Get("tc").(*tcapi.Client)
 	config := state.Get("config").(Config)
-	regions := append(step.Regions, config.Region)
+	regions := append(append([]string(nil), step.Regions...), config.Region)
+	backupName := backupImageName(step.ImageName, time.Now())
 
+	existing := make(map[string][]tcapi.Image)
 	for _, region := range regions {
-		thisClient := tc.Copy(region, nil)
-		req := &tcapi.DescribeImagesRequest{
-			Filters: []tcapi.Filter{
-				{
-					Name: "image-type",
-					Values: []string{
-						"PRIVATE_IMAGE",
-					},
-				},
-				{
-					Name: "image-name",
-					Values: []string{
-						step.ImageName,
-					},
-				},
-			},
-		}
-		resp, err := thisClient.DescribeImages(req)
+		images, err := privateImagesNamed(tc.Copy(region, nil), step.ImageName)
 		if err != nil {
 			state.Put("error", fmt.Errorf("could not query image '%s' in region '%s': %s", step.ImageName, region, err))
 			return multistep.ActionHalt
 		}
-		for _, image := range resp.ImageSet {
-			err := thisClient.DeleteImages(&tcapi.DeleteImagesRequest{
-				ImageIds: []string{
-					image.ImageId,
-				},
-			})
+		existing[region] = images
+	}
+
+	// check every region before anything is deleted, so an image that's still
+	// in use doesn't leave the others half deregistered
+	if step.Mode != "safe" && !step.InUse {
+		errs := new(packer.MultiError)
+		for _, region := range regions {
+			imageIds := make([]string, 0, len(existing[region]))
+			for _, image := range existing[region] {
+				imageIds = append(imageIds, image.ImageId)
+			}
+			usage, err := findImageUsage(tc.Copy(region, nil), imageIds, step.ProtectionTag, step.ShareAccounts)
 			if err != nil {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("could not check usage of images in region '%s': %s", region, err))
+				continue
+			}
+			for _, imageId := range imageIds {
+				if err := usage.Err(imageId); err != nil {
+					errs = packer.MultiErrorAppend(errs, fmt.Errorf("region '%s': %s", region, err))
+				}
+			}
+		}
+		if len(errs.Errors) > 0 {
+			state.Put("error", errs)
+			ui.Error(errs.Error())
+			return multistep.ActionHalt
+		}
+	}
+
+	for _, region := range regions {
+		thisClient := tc.Copy(region, nil)
+		for _, image := range existing[region] {
+			if step.Mode == "safe" {
+				err := thisClient.ModifyImageAttribute(&tcapi.ModifyImageAttributeRequest{
+					ImageId:   image.ImageId,
+					ImageName: backupName,
+				})
+				if err != nil {
+					state.Put("error", fmt.Errorf("could not rename image '%s' in region '%s': %s", step.ImageName, region, err))
+					return multistep.ActionHalt
+				}
+				step.backups = append(step.backups, backupImage{
+					Region:  region,
+					ImageId: image.ImageId,
+					Name:    image.ImageName,
+				})
+				ui.Say(fmt.Sprintf("renamed image '%s' (ID '%s') in region '%s' to '%s'", step.ImageName, image.ImageId, region, backupName))
+				continue
+			}
+
+			if err := deleteImage(thisClient, image.ImageId); err != nil {
 				state.Put("error", fmt.Errorf("could not delete image '%s' in region '%s': %s", step.ImageName, region, err))
 				return multistep.ActionHalt
 			}
@@ -66,6 +114,189 @@ func (step *StepDeregisterImage) Run(ctx context.Context, state multistep.StateB
 	return multistep.ActionContinue
 }
 
-func (step *StepDeregisterImage) Cleanup(_ multistep.StateBag) {
+func (step *StepDeregisterImage) Cleanup(state multistep.StateBag) {
+	_, cancelled := state.GetOk(multistep.StateCancelled)
+	_, halted := state.GetOk(multistep.StateHalted)
+	if (!cancelled && !halted) || len(step.backups) == 0 {
+		return
+	}
+
+	tc := state.Get("tc").(*tcapi.Client)
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say("restoring names of the images that were to be replaced")
+	for _, backup := range step.backups {
+		err := tc.Copy(backup.Region, nil).ModifyImageAttribute(&tcapi.ModifyImageAttributeRequest{
+			ImageId:   backup.ImageId,
+			ImageName: backup.Name,
+		})
+		if err != nil {
+			ui.Error(fmt.Sprintf("could not restore name '%s' of image '%s' in region '%s': %s", backup.Name, backup.ImageId, backup.Region, err))
+		}
+	}
+}
+
+// StepDeregisterBackups deletes the backups made by a safe force deregister
+// once the new images are in place, keeping the newest Retention of them.
+type StepDeregisterBackups struct {
+	ForceDeregister bool
+	Mode            string
+	ImageName       string
+	Regions         []string
+	Retention       int
+	InUse           bool
+	ProtectionTag   string
+	ShareAccounts   []string
+}
+
+func (step *StepDeregisterBackups) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	if !step.ForceDeregister || step.Mode != "safe" {
+		return multistep.ActionContinue
+	}
+
+	ui := state.Get("ui").(packer.Ui)
+	tc := state.Get("tc").(*tcapi.Client)
+	config := state.Get("config").(Config)
+	regions := append(append([]string(nil), step.Regions...), config.Region)
+
+	// the new images are already in place, so failing to prune backups is
+	// reported rather than halting and rolling the build back
+	for _, region := range regions {
+		thisClient := tc.Copy(region, nil)
+		images, err := privateImagesNamed(thisClient, "")
+		if err != nil {
+			ui.Error(fmt.Sprintf("could not query backups of image '%s' in region '%s': %s", step.ImageName, region, err))
+			continue
+		}
+
+		backups := make([]tcapi.Image, 0, len(images))
+		made := make(map[string]int64)
+		for _, image := range images {
+			if t, ok := backupImageTime(step.ImageName, image.ImageName); ok {
+				backups = append(backups, image)
+				made[image.ImageId] = t
+			}
+		}
+		// newest first
+		sort.Slice(backups, func(i, j int) bool {
+			return made[backups[i].ImageId] > made[backups[j].ImageId]
+		})
+
+		if len(backups) <= step.Retention {
+			continue
+		}
+
+		usage := make(ImageUsage)
+		if !step.InUse {
+			imageIds := make([]string, 0, len(backups)-step.Retention)
+			for _, image := range backups[step.Retention:] {
+				imageIds = append(imageIds, image.ImageId)
+			}
+			usage, err = findImageUsage(thisClient, imageIds, step.ProtectionTag, step.ShareAccounts)
+			if err != nil {
+				ui.Error(fmt.Sprintf("could not check usage of backup images in region '%s': %s", region, err))
+				continue
+			}
+		}
+
+		for i, image := range backups {
+			if i < step.Retention {
+				ui.Message(fmt.Sprintf("keeping backup image '%s' (ID '%s') in region '%s'", image.ImageName, image.ImageId, region))
+				continue
+			}
+			if err := usage.Err(image.ImageId); err != nil {
+				ui.Error(fmt.Sprintf("keeping backup image '%s' in region '%s': %s", image.ImageName, region, err))
+				continue
+			}
+			if err := deleteImage(thisClient, image.ImageId); err != nil {
+				ui.Error(fmt.Sprintf("could not delete backup image '%s' (ID '%s') in region '%s': %s", image.ImageName, image.ImageId, region, err))
+				continue
+			}
+			ui.Say(fmt.Sprintf("deleted backup image '%s' (ID '%s') from region '%s'", image.ImageName, image.ImageId, region))
+		}
+	}
+
+	return multistep.ActionContinue
+}
+
+func (step *StepDeregisterBackups) Cleanup(_ multistep.StateBag) {
 	return
 }
+
+// Backups are named backupPrefix, a hash of the image's name and the unix
+// time they were made at in base 36, which fits in backupTimeLen characters
+// until 2059. That stays within the 20 characters image names are limited
+// to, however long the image's own name is.
+const (
+	backupPrefix  = "bak-"
+	backupHashLen = 8
+	backupTimeLen = 6
+)
+
+// backupImageName is the name an image named name is renamed to when it's
+// backed up at t
+func backupImageName(name string, t time.Time) string {
+	return backupNamePrefix(name) + strconv.FormatInt(t.Unix(), 36)
+}
+
+// backupNamePrefix is what the names of every backup of the image named
+// name start with
+func backupNamePrefix(name string) string {
+	return fmt.Sprintf("%s%x", backupPrefix, sha1.Sum([]byte(name)))[:len(backupPrefix)+backupHashLen] + "-"
+}
+
+// backupImageTime returns the unix time a backup of the image named name was
+// made at, and whether imageName is the name of such a backup at all
+func backupImageTime(name, imageName string) (int64, bool) {
+	prefix := backupNamePrefix(name)
+	if !strings.HasPrefix(imageName, prefix) {
+		return 0, false
+	}
+	suffix := strings.TrimPrefix(imageName, prefix)
+	if len(suffix) != backupTimeLen || strings.Trim(suffix, "0123456789abcdefghijklmnopqrstuvwxyz") != "" {
+		return 0, false
+	}
+	t, err := strconv.ParseInt(suffix, 36, 64)
+	if err != nil {
+		return 0, false
+	}
+	return t, true
+}
+
+// privateImagesNamed lists the private images whose names match name, or
+// all private images if name is empty
+func privateImagesNamed(tc *tcapi.Client, name string) ([]tcapi.Image, error) {
+	req := &tcapi.DescribeImagesRequest{
+		Filters: []tcapi.Filter{
+			{
+				Name: "image-type",
+				Values: []string{
+					"PRIVATE_IMAGE",
+				},
+			},
+		},
+		Limit: 100,
+	}
+	if name != "" {
+		req.Filters = append(req.Filters, tcapi.Filter{
+			Name: "image-name",
+			Values: []string{
+				name,
+			},
+		})
+	}
+
+	images := []tcapi.Image{}
+	for {
+		resp, err := tc.DescribeImages(req)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, resp.ImageSet...)
+		if len(resp.ImageSet) == 0 || req.Offset+req.Limit >= resp.TotalCount {
+			break
+		}
+		req.Offset += req.Limit
+	}
+	return images, nil
+}
@@ -0,0 +1,30 @@
+package tencloud
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackupImageName(t *testing.T) {
+	made := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	name := backupImageName("web-server-20-chars", made)
+	if len(name) > 20 {
+		t.Fatalf("backup name too long: %s", name)
+	}
+	if got, ok := backupImageTime("web-server-20-chars", name); !ok || got != made.Unix() {
+		t.Fatalf("got %d, %t for %s", got, ok, name)
+	}
+
+	prefix := name[:len(name)-backupTimeLen]
+	for _, other := range []string{
+		"web-server-20-chars",
+		prefix,
+		prefix + "abcdefg",
+		prefix + "ABCDEF",
+		backupImageName("web-server", made),
+	} {
+		if _, ok := backupImageTime("web-server-20-chars", other); ok {
+			t.Errorf("%s shouldn't be taken for a backup", other)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package tencloud
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/3van/tencloud-go"
+	retry "github.com/hashicorp/packer/common"
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// StepElasticIP allocates a temporary elastic IP and binds it to the
+// instance, for reaching instances in private subnets with ssh_interface
+// eip. The address is released on cleanup.
+type StepElasticIP struct {
+	addressId string
+}
+
+func (step *StepElasticIP) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	tc := state.Get("tc").(*tcapi.Client)
+	ui := state.Get("ui").(packer.Ui)
+	config := state.Get("config").(Config)
+	instance := state.Get("instance").(tcapi.Instance)
+
+	// AllocateAddresses takes no idempotency token, so it isn't retried in
+	// case an attempt we never heard back from did allocate one
+	ui.Say("allocating temporary elastic ip")
+	resp, err := allocateAddresses(tc, &allocateAddressesRequest{
+		AddressCount: 1,
+	})
+	if err != nil {
+		state.Put("error", fmt.Errorf("could not allocate elastic ip: %s", err))
+		return multistep.ActionHalt
+	}
+	if len(resp.AddressSet) < 1 {
+		state.Put("error", fmt.Errorf("unknown error allocating elastic ip"))
+		return multistep.ActionHalt
+	}
+	step.addressId = resp.AddressSet[0]
+	state.Get("journal").(*Journal).Created(journalAddress, config.Region, step.addressId)
+
+	if err := tagRunResources(state, "cvm", "eip", step.addressId); err != nil {
+		ui.Error(fmt.Sprintf("could not tag elastic ip '%s': %s", step.addressId, err))
+	}
+
+	_, err = WaitForState(&StateChangeConf{
+		Pending:   []string{"CREATING"},
+		Target:    "UNBIND",
+		Refresh:   AddressStateRefreshFunc(tc, step.addressId),
+		StepState: state,
+		Context:   ctx,
+		Timeout:   config.InstanceReadyTimeout,
+	})
+	if err != nil {
+		state.Put("error", fmt.Errorf("error waiting for elastic ip '%s' to be allocated: %s", step.addressId, err))
+		return multistep.ActionHalt
+	}
+
+	ui.Say(fmt.Sprintf("binding elastic ip '%s' to instance '%s'", step.addressId, instance.InstanceId))
+	err = retry.Retry(0.2, 30, 11, func(_ uint) (bool, error) {
+		err := associateAddress(tc, &associateAddressRequest{
+			AddressId:  step.addressId,
+			InstanceId: instance.InstanceId,
+		})
+		if err != nil {
+			ui.Error(fmt.Sprintf("error binding elastic ip: %s", err))
+			if !isRetryable(err) {
+				return false, err
+			}
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		state.Put("error", fmt.Errorf("could not bind elastic ip '%s': %s", step.addressId, err))
+		return multistep.ActionHalt
+	}
+
+	bound, err := WaitForState(&StateChangeConf{
+		Pending:   []string{"UNBIND", "BINDING"},
+		Target:    "BIND",
+		Refresh:   AddressStateRefreshFunc(tc, step.addressId),
+		StepState: state,
+		Context:   ctx,
+		Timeout:   config.InstanceReadyTimeout,
+	})
+	if err != nil {
+		state.Put("error", fmt.Errorf("error waiting for elastic ip '%s' to be bound: %s", step.addressId, err))
+		return multistep.ActionHalt
+	}
+
+	eip := bound.(address).AddressIp
+	ui.Message(fmt.Sprintf("Elastic IP: %s", eip))
+	state.Put("eip", eip)
+	return multistep.ActionContinue
+}
+
+func (step *StepElasticIP) Cleanup(state multistep.StateBag) {
+	if step.addressId == "" {
+		return
+	}
+
+	tc := state.Get("tc").(*tcapi.Client)
+	ui := state.Get("ui").(packer.Ui)
+	config := state.Get("config").(Config)
+
+	ui.Say(fmt.Sprintf("releasing temporary elastic ip '%s'", step.addressId))
+	if err := releaseAddress(tc, step.addressId, config.InstanceTerminateTimeout); err != nil {
+		ui.Error(fmt.Sprintf("could not release elastic ip '%s': %s", step.addressId, err))
+		return
+	}
+	state.Get("journal").(*Journal).Deleted(journalAddress, config.Region, step.addressId)
+}
+
+// releaseAddress unbinds an elastic IP if it's bound and releases it, doing
+// nothing if it's already gone. There's no StepState in the waits, they
+// have to carry on when the build was cancelled.
+func releaseAddress(tc *tcapi.Client, addressId string, timeout time.Duration) error {
+	refresh := AddressStateRefreshFunc(tc, addressId)
+	_, status, err := refresh()
+	if err != nil {
+		return err
+	}
+	switch status {
+	case "":
+		return nil
+	case "CREATING", "BINDING", "UNBINDING":
+		settled, err := WaitForState(&StateChangeConf{
+			Pending: []string{"CREATING", "BINDING", "UNBINDING"},
+			Target:  "UNBIND",
+			Refresh: func() (interface{}, string, error) {
+				i, status, err := refresh()
+				// bound is as settled as unbound
+				if status == "BIND" {
+					status = "UNBIND"
+				}
+				return i, status, err
+			},
+			Timeout: timeout,
+		})
+		if err != nil {
+			return err
+		}
+		status = settled.(address).AddressStatus
+	}
+
+	if status == "BIND" {
+		err := retry.Retry(0.2, 30, 11, func(_ uint) (bool, error) {
+			err := disassociateAddress(tc, &disassociateAddressRequest{
+				AddressId: addressId,
+			})
+			if err != nil {
+				if !isRetryable(err) {
+					return false, err
+				}
+				return false, nil
+			}
+			return true, nil
+		})
+		if err != nil {
+			return fmt.Errorf("could not unbind: %s", err)
+		}
+		_, err = WaitForState(&StateChangeConf{
+			Pending: []string{"BIND", "UNBINDING"},
+			Target:  "UNBIND",
+			Refresh: refresh,
+			Timeout: timeout,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return retry.Retry(0.2, 30, 11, func(_ uint) (bool, error) {
+		err := releaseAddresses(tc, &releaseAddressesRequest{
+			AddressIds: []string{addressId},
+		})
+		if err != nil {
+			if isNotFound(err) {
+				return true, nil
+			}
+			if !isRetryable(err) {
+				return false, err
+			}
+			return false, nil
+		}
+		return true, nil
+	})
+}
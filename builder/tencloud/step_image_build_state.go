@@ -0,0 +1,31 @@
+package tencloud
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// StepImageBuildState marks the build's images complete once every other
+// step has run. Until then they're tagged incomplete, which is how the
+// janitor recognises images left behind by a killed build.
+type StepImageBuildState struct{}
+
+func (step *StepImageBuildState) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	created := state.Get("created_images").(*CreatedImages)
+
+	for _, region := range created.Regions() {
+		if err := tagImageBuildState(state, region, created.Get(region), "complete"); err != nil {
+			ui.Error(fmt.Sprintf("could not mark images in region '%s' complete, remove the '%s' tag manually: %s", region, BuildStateTag, err))
+		}
+	}
+
+	return multistep.ActionContinue
+}
+
+func (step *StepImageBuildState) Cleanup(_ multistep.StateBag) {
+	return
+}
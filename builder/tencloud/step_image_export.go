@@ -0,0 +1,195 @@
+package tencloud
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/3van/tencloud-go"
+
+	retry "github.com/hashicorp/packer/common"
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+type StepImageExport struct {
+	Buckets map[string]string
+	Format  string
+	Prefix  string
+}
+
+func (step *StepImageExport) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	if len(step.Buckets) == 0 {
+		return multistep.ActionContinue
+	}
+
+	tc := state.Get("tc").(*tcapi.Client)
+	ui := state.Get("ui").(packer.Ui)
+	images := state.Get("images").(map[string]string)
+
+	regions := make([]string, 0, len(images))
+	for region := range images {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+
+	ui.Say(fmt.Sprintf("exporting images to COS as %s", step.Format))
+
+	// every region exports at once, as they copy
+	results := make(map[string]*regionExport)
+	var wg sync.WaitGroup
+	for _, region := range regions {
+		e := &regionExport{Region: region, ImageId: images[region]}
+		results[region] = e
+		bucket, ok := step.Buckets[region]
+		if !ok {
+			e.Err = fmt.Errorf("no export bucket configured for region '%s'", region)
+			continue
+		}
+		wg.Add(1)
+		go func(e *regionExport) {
+			defer wg.Done()
+			e.URL, e.Err = step.export(ctx, state, tc.Copy(e.Region, nil), e.ImageId, bucket)
+		}(e)
+	}
+	wg.Wait()
+
+	exports := make(map[string]string)
+	errs := new(packer.MultiError)
+	for _, region := range regions {
+		e := results[region]
+		if e.Err != nil {
+			errs = packer.MultiErrorAppend(errs, e.Err)
+			continue
+		}
+		exports[region] = e.URL
+		ui.Message(fmt.Sprintf("exported image '%s' to %s", e.ImageId, e.URL))
+	}
+
+	state.Put("exports", exports)
+
+	if len(errs.Errors) > 0 {
+		state.Put("error", errs)
+		ui.Error(errs.Error())
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+func (step *StepImageExport) Cleanup(_ multistep.StateBag) {
+	return
+}
+
+// regionExport is the export of the image in one region
+type regionExport struct {
+	Region  string
+	ImageId string
+	URL     string
+	Err     error
+}
+
+// export exports imageId to bucket, waits for the export task to finish and
+// returns the URL of the object it wrote
+func (step *StepImageExport) export(ctx context.Context, state multistep.StateBag, tc *tcapi.Client, imageId, bucket string) (string, error) {
+	ui := state.Get("ui").(packer.Ui)
+	objectName := step.Prefix + imageId
+	ui.Message(fmt.Sprintf("exporting image '%s' in region '%s' to bucket '%s'", imageId, tc.Region, bucket))
+	resp, err := exportImages(tc, &exportImagesRequest{
+		BucketName:         bucket,
+		ImageIds:           []string{imageId},
+		ExportFormat:       strings.ToUpper(step.Format),
+		FileNamePrefixList: []string{objectName},
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not export image '%s' in region '%s': %s", imageId, tc.Region, err)
+	}
+
+	if err := waitForExportTask(ctx, state, tc, resp.TaskId, imageId); err != nil {
+		return "", fmt.Errorf("export task %d of image '%s' in region '%s' failed: %s", resp.TaskId, imageId, tc.Region, err)
+	}
+
+	// take the object the export task reports writing, and only hand it on
+	// once it's actually there
+	url := exportObjectURL(bucket, tc.Region, objectName, step.Format)
+	if len(resp.CosPaths) > 0 {
+		url = cosObjectURL(bucket, tc.Region, resp.CosPaths[0])
+	}
+	if err := waitForCOSObject(tc, url); err != nil {
+		return "", fmt.Errorf("export task %d of image '%s' in region '%s' finished, but its object can't be found: %s", resp.TaskId, imageId, tc.Region, err)
+	}
+	return url, nil
+}
+
+// waitForExportTask polls the export task until it succeeds, failing with its
+// message if the task fails. Where the API can't describe export tasks, it
+// waits for the image to leave EXPORTING instead, and the object check
+// catches failed tasks.
+func waitForExportTask(ctx context.Context, state multistep.StateBag, tc *tcapi.Client, taskId int, imageId string) error {
+	var message string
+	stateChange := StateChangeConf{
+		Pending: []string{"RUNNING"},
+		Target:  "SUCCESS",
+		Refresh: func() (interface{}, string, error) {
+			resp, err := describeImageExportTasks(tc, &describeImageExportTasksRequest{
+				TaskIds: []int{taskId},
+			})
+			if err != nil {
+				return nil, "", err
+			}
+			for _, task := range resp.TaskSet {
+				if task.TaskId == taskId {
+					message = task.Message
+					return task, task.TaskState, nil
+				}
+			}
+			return nil, "", nil
+		},
+		StepState: state,
+		Context:   ctx,
+	}
+	_, err := WaitForState(&stateChange)
+	if err != nil && isUnsupportedAction(err) {
+		stateChange = StateChangeConf{
+			Pending:   []string{"EXPORTING"},
+			Target:    "NORMAL",
+			Refresh:   ImageStateRefreshFunc(tc, imageId),
+			StepState: state,
+			Context:   ctx,
+		}
+		_, err = WaitForState(&stateChange)
+	}
+	if err != nil && message != "" {
+		return fmt.Errorf("%s: %s", err, message)
+	}
+	return err
+}
+
+// exportObjectURL returns the URL of the object an image export writes to
+// bucket, which is named after the requested prefix and the export format,
+// for when the export task doesn't report it.
+func exportObjectURL(bucket, region, objectName, format string) string {
+	return cosObjectURL(bucket, region, fmt.Sprintf("%s.%s", objectName, format))
+}
+
+// waitForCOSObject waits for the object at url to show up, as an export
+// finishes writing it around the time the image becomes usable again
+func waitForCOSObject(tc *tcapi.Client, url string) error {
+	var lastErr error
+	err := retry.Retry(1, 30, 10, func(_ uint) (bool, error) {
+		lastErr = headCOSObject(tc, url)
+		if lastErr == nil {
+			return true, nil
+		}
+		if isNotFound(lastErr) {
+			return false, nil
+		}
+		return false, lastErr
+	})
+	if err == retry.RetryExhaustedError {
+		return lastErr
+	}
+	return err
+}
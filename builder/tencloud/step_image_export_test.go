@@ -0,0 +1,68 @@
+package tencloud
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/3van/tencloud-go"
+)
+
+func TestWaitForExportTask(t *testing.T) {
+	cases := []struct {
+		name  string
+		task  func(url.Values) (interface{}, error)
+		image string
+		err   string
+	}{
+		{
+			name: "succeeded",
+			task: func(url.Values) (interface{}, error) {
+				return &describeImageExportTasksResponse{TaskSet: []imageExportTask{{TaskId: 7, TaskState: "SUCCESS"}}}, nil
+			},
+		},
+		{
+			name: "failed",
+			task: func(url.Values) (interface{}, error) {
+				return &describeImageExportTasksResponse{TaskSet: []imageExportTask{{TaskId: 7, TaskState: "FAILED", Message: "bucket is not writable"}}}, nil
+			},
+			err: "bucket is not writable",
+		},
+		{
+			name: "no task API, image exported",
+			task: func(url.Values) (interface{}, error) {
+				return nil, errors.New("InvalidAction")
+			},
+			image: "NORMAL",
+		},
+		{
+			name: "no task API, image broken",
+			task: func(url.Values) (interface{}, error) {
+				return nil, errors.New("InvalidAction")
+			},
+			image: "IMPORTFAILED",
+			err:   "unexpected state 'IMPORTFAILED'",
+		},
+	}
+
+	for _, c := range cases {
+		image := c.image
+		_, tc, restore := useFakeAPI(map[string]func(url.Values) (interface{}, error){
+			"DescribeImageExportTasks": c.task,
+			"DescribeImages": func(url.Values) (interface{}, error) {
+				return &tcapi.DescribeImagesResponse{ImageSet: []tcapi.Image{{ImageId: "img-1", ImageState: image}}, TotalCount: 1}, nil
+			},
+		})
+		err := waitForExportTask(context.Background(), testStepState(tc), tc, 7, "img-1")
+		restore()
+
+		if c.err == "" && err != nil {
+			t.Fatalf("%s: err: %s", c.name, err)
+		}
+		if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Fatalf("%s: expected error containing %q, got %v", c.name, c.err, err)
+		}
+	}
+}
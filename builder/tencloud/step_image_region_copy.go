@@ -3,6 +3,9 @@ package tencloud
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/3van/tencloud-go"
@@ -13,13 +16,21 @@ import (
 
 type StepImageRegionCopy struct {
 	Regions []string
-	Name    string
+	Timeout time.Duration
+}
+
+// regionCopy tracks the copies of the source image made in one region
+type regionCopy struct {
+	Region   string
+	ImageIds []string
+	Err      error
 }
 
 func (step *StepImageRegionCopy) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
 	tc := state.Get("tc").(*tcapi.Client)
 	config := state.Get("config").(Config)
 	ui := state.Get("ui").(packer.Ui)
+	created := state.Get("created_images").(*CreatedImages)
 	images := state.Get("images").(map[string]string)
 	image := images[config.Region]
 	syncRegions := make([]string, 0, len(step.Regions))
@@ -32,10 +43,14 @@ func (step *StepImageRegionCopy) Run(ctx context.Context, state multistep.StateB
 	ui.Say(fmt.Sprintf("copying built image artifact '%s' to other regions", image))
 
 	for _, region := range step.Regions {
-		if region == config.Region {
+		if region == config.Region || stringInSlice(region, syncRegions) {
 			ui.Message(fmt.Sprintf("duplicate region '%s' found, skipping", region))
 			continue
 		}
+		if imageId, ok := images[region]; ok {
+			ui.Message(fmt.Sprintf("image already copied to region '%s' as '%s', skipping", region, imageId))
+			continue
+		}
 
 		ui.Message(fmt.Sprintf("adding region '%s' to copy list", region))
 		syncRegions = append(syncRegions, region)
@@ -46,7 +61,7 @@ func (step *StepImageRegionCopy) Run(ctx context.Context, state multistep.StateB
 		return multistep.ActionContinue
 	}
 
-	err := tc.SyncImages(&tcapi.SyncImagesRequest{
+	resp, err := syncImages(tc, &syncImagesRequest{
 		ImageIds: []string{
 			image,
 		},
@@ -57,87 +72,120 @@ func (step *StepImageRegionCopy) Run(ctx context.Context, state multistep.StateB
 		return multistep.ActionHalt
 	}
 
-	errs := new(packer.MultiError)
+	copies := make(map[string]*regionCopy)
 	for _, region := range syncRegions {
-		ui.Message(fmt.Sprintf("searching for copied image ID in region '%s'", region))
-		images[region] = ""
-		thisClient := tc.Copy(region, nil)
-		iterCount := 0
-
-		req := &tcapi.DescribeImagesRequest{
-			Filters: []tcapi.Filter{
-				{
-					Name: "image-type",
-					Values: []string{
-						"PRIVATE_IMAGE",
-					},
-				},
-				{
-					Name: "image-name",
-					Values: []string{
-						step.Name,
-					},
-				},
-			},
-			Limit: 1,
-		}
-
-		for true {
-			if iterCount >= 5 {
-				errs = packer.MultiErrorAppend(errs, fmt.Errorf("could not find image copy in region '%s'", region))
-				break
-			}
-			resp, err := thisClient.DescribeImages(req)
-			if err != nil {
-				errs = packer.MultiErrorAppend(errs, err)
-				break
-			}
-			if (resp.TotalCount == 0) || (len(resp.ImageSet) == 0) {
-				time.Sleep(2 * time.Second)
-				iterCount++
-				continue
-			}
-
-			// yes, the ImageId is literally "unkown", this isn't a mistake
-			if (resp.ImageSet[0].ImageId != "unkown") && (resp.ImageSet[0].ImageName == step.Name) {
-				images[region] = resp.ImageSet[0].ImageId
-				break
-			}
-
-			time.Sleep(2 * time.Second)
-			iterCount++
-			continue
+		copies[region] = &regionCopy{Region: region}
+	}
+	for _, copied := range resp.ImageSet {
+		created.Add(copied.Region, copied.ImageId)
+		if c, ok := copies[copied.Region]; ok {
+			c.ImageIds = append(c.ImageIds, copied.ImageId)
 		}
 	}
 
-	for imageRegion, imageId := range images {
-		if imageId == "" {
+	var wg sync.WaitGroup
+	for _, c := range copies {
+		if len(c.ImageIds) == 0 {
+			c.Err = fmt.Errorf("no image copy was reported for region '%s'", c.Region)
 			continue
 		}
-		thisClient := tc.Copy(imageRegion, nil)
-		stateChange := StateChangeConf{
-			Pending:   []string{"SYNCING"},
-			Target:    "NORMAL",
-			Refresh:   ImageStateRefreshFunc(thisClient, imageId),
-			StepState: state,
+
+		ui.Message(fmt.Sprintf("[%s] copying to image %s", c.Region, strings.Join(c.ImageIds, ", ")))
+		if err := tagImageBuildState(state, c.Region, c.ImageIds, "incomplete"); err != nil {
+			ui.Error(fmt.Sprintf("[%s] could not tag image copy: %s", c.Region, err))
 		}
+		wg.Add(1)
+		go func(c *regionCopy) {
+			defer wg.Done()
+			c.Err = waitForRegionCopy(ctx, state, tc.Copy(c.Region, nil), c, step.Timeout)
+		}(c)
+	}
+	wg.Wait()
 
-		if _, err := WaitForState(&stateChange); err != nil {
-			errs = packer.MultiErrorAppend(errs, fmt.Errorf("error waiting for image copy '%s' in region '%s': %s", imageId, imageRegion, err))
+	var failed []string
+	for _, region := range syncRegions {
+		c := copies[region]
+		if c.Err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%s)", region, c.Err))
 			continue
 		}
+		images[region] = c.ImageIds[0]
 	}
+	state.Put("images", images)
 
-	if len(errs.Errors) > 0 {
-		state.Put("error", errs)
-		ui.Error(errs.Error())
+	ui.Say(fmt.Sprintf("image copied to %d of %d regions", len(syncRegions)-len(failed), len(syncRegions)))
+	if len(failed) > 0 {
+		err := fmt.Errorf("image copy failed in %d of %d regions: %s", len(failed), len(syncRegions), strings.Join(failed, "; "))
+		state.Put("error", err)
+		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
 
-	state.Put("images", images)
 	return multistep.ActionContinue
 }
 
 func (step *StepImageRegionCopy) Cleanup(_ multistep.StateBag) {
 	return
 }
+
+// waitForRegionCopy polls all of a region's copies in one DescribeImages call
+// until they're NORMAL, reporting each state change as it's seen.
+func waitForRegionCopy(ctx context.Context, state multistep.StateBag, tc *tcapi.Client, c *regionCopy, timeout time.Duration) error {
+	ui := state.Get("ui").(packer.Ui)
+	start := time.Now()
+	states := make(map[string]string)
+
+	stateChange := StateChangeConf{
+		Pending: []string{"SYNCING", "CREATING", "PENDING"},
+		Target:  "NORMAL",
+		Refresh: func() (interface{}, string, error) {
+			resp, err := tc.DescribeImages(&tcapi.DescribeImagesRequest{
+				ImageIds: c.ImageIds,
+				Limit:    len(c.ImageIds),
+			})
+			if err != nil {
+				return nil, "", err
+			}
+			for _, image := range resp.ImageSet {
+				if states[image.ImageId] != image.ImageState {
+					states[image.ImageId] = image.ImageState
+					ui.Message(fmt.Sprintf("[%s] image %s is %s (%s elapsed)", c.Region, image.ImageId, image.ImageState, time.Since(start).Round(time.Second)))
+				}
+			}
+			return resp.ImageSet, regionCopyState(c.ImageIds, states), nil
+		},
+		StepState: state,
+		Context:   ctx,
+		Timeout:   timeout,
+	}
+	if _, err := WaitForState(&stateChange); err != nil {
+		last := make([]string, 0, len(c.ImageIds))
+		for _, imageId := range c.ImageIds {
+			s, ok := states[imageId]
+			if !ok {
+				s = "not found"
+			}
+			last = append(last, fmt.Sprintf("%s: %s", imageId, s))
+		}
+		sort.Strings(last)
+		return fmt.Errorf("%s (last seen %s)", err, strings.Join(last, ", "))
+	}
+	return nil
+}
+
+// regionCopyState sums up the states of a region's copies: the first one
+// that's neither busy nor NORMAL, else SYNCING while any is busy or missing,
+// else NORMAL
+func regionCopyState(imageIds []string, states map[string]string) string {
+	state := "NORMAL"
+	for _, imageId := range imageIds {
+		switch states[imageId] {
+		case "NORMAL":
+		case "", "SYNCING", "CREATING", "PENDING":
+			state = "SYNCING"
+		default:
+			return states[imageId]
+		}
+	}
+	return state
+}
@@ -0,0 +1,70 @@
+package tencloud
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/3van/tencloud-go"
+)
+
+func TestWaitForRegionCopy(t *testing.T) {
+	// each poll reports the states of img-1 and img-2, the last one
+	// repeating; an empty state leaves the image out
+	cases := []struct {
+		name     string
+		polls    [][2]string
+		expected string
+	}{
+		{"synced", [][2]string{{"SYNCING", "PENDING"}, {"NORMAL", "SYNCING"}, {"NORMAL", "NORMAL"}}, ""},
+		{"shows up late", [][2]string{{"", ""}, {"SYNCING", ""}, {"NORMAL", "NORMAL"}}, ""},
+		{"one failed", [][2]string{{"SYNCING", "SYNCING"}, {"NORMAL", "SYNC_FAILED"}}, "unexpected state 'SYNC_FAILED'"},
+		{"stuck", [][2]string{{"NORMAL", "SYNCING"}}, "last seen img-1: NORMAL, img-2: SYNCING"},
+	}
+
+	var config Config
+	config.PollDelay = time.Millisecond
+	for _, c := range cases {
+		poll := 0
+		_, client, restore := useFakeAPI(map[string]func(url.Values) (interface{}, error){
+			"DescribeImages": func(params url.Values) (interface{}, error) {
+				states := c.polls[poll]
+				if poll < len(c.polls)-1 {
+					poll++
+				}
+				resp := &tcapi.DescribeImagesResponse{}
+				for i, s := range states {
+					if s != "" {
+						resp.ImageSet = append(resp.ImageSet, tcapi.Image{
+							ImageId:    []string{"img-1", "img-2"}[i],
+							ImageState: s,
+						})
+					}
+				}
+				resp.TotalCount = len(resp.ImageSet)
+				return resp, nil
+			},
+		})
+
+		state := testStepState(client)
+		state.Put("config", config)
+		rc := &regionCopy{
+			Region:   "ap-shanghai",
+			ImageIds: []string{"img-1", "img-2"},
+		}
+		err := waitForRegionCopy(context.Background(), state, client, rc, 200*time.Millisecond)
+		restore()
+
+		if c.expected == "" {
+			if err != nil {
+				t.Fatalf("%s: should not have error: %s", c.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Fatalf("%s: bad error: %v, expected %q", c.name, err, c.expected)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package tencloud
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/3van/tencloud-go"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// StepImageRetention deletes older images matching the retention selector.
+// An image is kept if it's one of the newest KeepCount matches, counting the
+// image just built, or if it's younger than KeepDays.
+type StepImageRetention struct {
+	Retention     ImageRetentionConfig
+	Regions       []string
+	InUse         bool
+	ProtectionTag string
+	ShareAccounts []string
+	TagDelim      string
+}
+
+func (step *StepImageRetention) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	if !step.Retention.IsSet() {
+		return multistep.ActionContinue
+	}
+
+	ui := state.Get("ui").(packer.Ui)
+	tc := state.Get("tc").(*tcapi.Client)
+	config := state.Get("config").(Config)
+	images := state.Get("images").(map[string]string)
+	regions := append([]string{config.Region}, step.Regions...)
+
+	if step.Retention.DryRun {
+		ui.Say("applying image retention (dry run, nothing will be deleted)")
+	} else {
+		ui.Say("applying image retention")
+	}
+
+	// the new images are already in place, so failing to prune old ones is
+	// reported rather than halting and rolling the build back
+	seen := make(map[string]bool)
+	for _, region := range regions {
+		if seen[region] {
+			continue
+		}
+		seen[region] = true
+
+		thisClient := tc.Copy(region, nil)
+		expired, err := step.expiredImages(thisClient, images[region])
+		if err != nil {
+			ui.Error(fmt.Sprintf("could not apply image retention in region '%s': %s", region, err))
+			continue
+		}
+		if len(expired) == 0 {
+			ui.Message(fmt.Sprintf("no images to remove in region '%s'", region))
+			continue
+		}
+
+		usage := make(ImageUsage)
+		if !step.InUse {
+			imageIds := make([]string, 0, len(expired))
+			for _, image := range expired {
+				imageIds = append(imageIds, image.ImageId)
+			}
+			usage, err = findImageUsage(thisClient, imageIds, step.ProtectionTag, step.ShareAccounts)
+			if err != nil {
+				ui.Error(fmt.Sprintf("could not check usage of images in region '%s': %s", region, err))
+				continue
+			}
+		}
+
+		for _, image := range expired {
+			if err := usage.Err(image.ImageId); err != nil {
+				ui.Error(fmt.Sprintf("keeping image '%s' in region '%s': %s", image.ImageName, region, err))
+				continue
+			}
+			if step.Retention.DryRun {
+				ui.Message(fmt.Sprintf("would delete image '%s' (ID '%s', created %s) from region '%s'", image.ImageName, image.ImageId, image.CreatedTime, region))
+				continue
+			}
+			if err := deleteImage(thisClient, image.ImageId); err != nil {
+				ui.Error(fmt.Sprintf("could not delete image '%s' (ID '%s') in region '%s': %s", image.ImageName, image.ImageId, region, err))
+				continue
+			}
+			ui.Message(fmt.Sprintf("deleted image '%s' (ID '%s', created %s) from region '%s'", image.ImageName, image.ImageId, image.CreatedTime, region))
+		}
+	}
+
+	return multistep.ActionContinue
+}
+
+func (step *StepImageRetention) Cleanup(_ multistep.StateBag) {
+	return
+}
+
+// expiredImages lists the images matching the selector that retention no
+// longer keeps, never including the image just built
+func (step *StepImageRetention) expiredImages(tc *tcapi.Client, builtImageId string) ([]tcapi.Image, error) {
+	all, err := privateImagesNamed(tc, "")
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]tcapi.Image, 0, len(all))
+	for _, image := range all {
+		if strings.HasPrefix(image.ImageName, step.Retention.NamePrefix) {
+			candidates = append(candidates, image)
+		}
+	}
+
+	if len(step.Retention.Tags) > 0 {
+		filter := TagFilterOptions{
+			TagFilters:     step.Retention.Tags,
+			TagFilterDelim: step.TagDelim,
+		}
+		candidates, err = filter.filterTagged(tc, candidates)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	created := make(map[string]time.Time)
+	for _, image := range candidates {
+		t, err := time.Parse(time.RFC3339, image.CreatedTime)
+		if err != nil {
+			return nil, fmt.Errorf("getting image (%s) created time: %v", image.ImageId, err)
+		}
+		created[image.ImageId] = t
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return created[candidates[i].ImageId].After(created[candidates[j].ImageId])
+	})
+
+	// the image just built always counts towards keep_count, even if it
+	// doesn't match the selector itself
+	kept := 1
+	cutoff := time.Now().AddDate(0, 0, -step.Retention.KeepDays)
+	expired := make([]tcapi.Image, 0)
+	for _, image := range candidates {
+		if image.ImageId == builtImageId {
+			continue
+		}
+		if kept < step.Retention.KeepCount {
+			kept++
+			continue
+		}
+		if step.Retention.KeepDays > 0 && created[image.ImageId].After(cutoff) {
+			continue
+		}
+		expired = append(expired, image)
+	}
+
+	return expired, nil
+}
@@ -0,0 +1,54 @@
+package tencloud
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/3van/tencloud-go"
+)
+
+func TestStepImageRetention(t *testing.T) {
+	now := time.Now()
+	image := func(id, name string, days int) *fakeImage {
+		return &fakeImage{
+			Image: tcapi.Image{
+				ImageId:     id,
+				ImageName:   name,
+				CreatedTime: now.AddDate(0, 0, -days).Format(time.RFC3339),
+			},
+			Region: "ap-guangzhou",
+		}
+	}
+	images := newFakeImages(
+		image("img-1", "app-1", 30),
+		image("img-2", "app-2", 20),
+		image("img-3", "app-3", 10),
+		image("img-4", "app-4", 5),
+		image("img-5", "app-5", 0),
+		image("img-other", "other-1", 40),
+	)
+	_, client, restore := useFakeAPI(images.handlers())
+	defer restore()
+
+	var config Config
+	config.Region = "ap-guangzhou"
+	state := testStepState(client)
+	state.Put("config", config)
+	state.Put("images", map[string]string{"ap-guangzhou": "img-5"})
+
+	// the image just built counts towards the three kept
+	step := &StepImageRetention{Retention: ImageRetentionConfig{NamePrefix: "app-", KeepCount: 3}}
+	step.Run(context.Background(), state)
+
+	for _, imageId := range []string{"img-3", "img-4", "img-5", "img-other"} {
+		if images.Get(imageId) == nil {
+			t.Fatalf("%s should have been kept", imageId)
+		}
+	}
+	for _, imageId := range []string{"img-1", "img-2"} {
+		if images.Get(imageId) != nil {
+			t.Fatalf("%s should have been deleted", imageId)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package tencloud
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/3van/tencloud-go"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+type StepImageShare struct {
+	Accounts []string
+}
+
+func (step *StepImageShare) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	if len(step.Accounts) == 0 {
+		return multistep.ActionContinue
+	}
+
+	tc := state.Get("tc").(*tcapi.Client)
+	ui := state.Get("ui").(packer.Ui)
+	images := state.Get("images").(map[string]string)
+
+	regions := make([]string, 0, len(images))
+	for region := range images {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+
+	ui.Say(fmt.Sprintf("sharing images with accounts %v", step.Accounts))
+
+	errs := new(packer.MultiError)
+	for _, region := range regions {
+		imageId := images[region]
+		thisClient := tc.Copy(region, nil)
+
+		ui.Message(fmt.Sprintf("sharing image '%s' in region '%s'", imageId, region))
+		err := thisClient.ModifyImageSharePermission(&tcapi.ModifyImageSharePermissionRequest{
+			ImageId:    imageId,
+			AccountIds: step.Accounts,
+			Permission: "SHARE",
+		})
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("could not share image '%s' in region '%s': %s", imageId, region, err))
+			continue
+		}
+
+		shared, err := imageSharedAccounts(thisClient, imageId)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("could not verify sharing of image '%s' in region '%s': %s", imageId, region, err))
+			continue
+		}
+		for _, account := range step.Accounts {
+			if !stringInSlice(account, shared) {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("image '%s' in region '%s' is not shared with account '%s'", imageId, region, account))
+			}
+		}
+	}
+
+	if len(errs.Errors) > 0 {
+		state.Put("error", errs)
+		ui.Error(errs.Error())
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+func (step *StepImageShare) Cleanup(_ multistep.StateBag) {
+	return
+}
+
+// imageSharedAccounts returns the accounts an image is currently shared with.
+func imageSharedAccounts(tc *tcapi.Client, imageId string) ([]string, error) {
+	resp, err := tc.DescribeImageSharePermission(&tcapi.DescribeImageSharePermissionRequest{
+		ImageId: imageId,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := make([]string, 0, len(resp.SharePermissionSet))
+	for _, perm := range resp.SharePermissionSet {
+		accounts = append(accounts, perm.Account)
+	}
+	return accounts, nil
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package tencloud
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/3van/tencloud-go"
+	"github.com/hashicorp/packer/helper/multistep"
+)
+
+func TestStepImageShare(t *testing.T) {
+	images := newFakeImages(
+		&fakeImage{Image: tcapi.Image{ImageId: "img-1"}, Region: "ap-guangzhou", Shared: []string{"300"}},
+		&fakeImage{Image: tcapi.Image{ImageId: "img-2"}, Region: "ap-shanghai"},
+	)
+	_, client, restore := useFakeAPI(images.handlers())
+	defer restore()
+
+	state := testStepState(client)
+	state.Put("images", map[string]string{"ap-guangzhou": "img-1", "ap-shanghai": "img-2"})
+	step := &StepImageShare{Accounts: []string{"100", "200"}}
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("should not have error: %v", state.Get("error"))
+	}
+
+	if shared := images.Get("img-1").Shared; strings.Join(shared, ",") != "300,100,200" {
+		t.Fatalf("img-1 shared with %v", shared)
+	}
+	if shared := images.Get("img-2").Shared; strings.Join(shared, ",") != "100,200" {
+		t.Fatalf("img-2 shared with %v", shared)
+	}
+}
+
+func TestStepImageShare_notShared(t *testing.T) {
+	images := newFakeImages(&fakeImage{Image: tcapi.Image{ImageId: "img-1"}, Region: "ap-guangzhou"})
+	handlers := images.handlers()
+	// the share is accepted but never takes effect
+	handlers["ModifyImageSharePermission"] = func(url.Values) (interface{}, error) {
+		return map[string]string{}, nil
+	}
+	_, client, restore := useFakeAPI(handlers)
+	defer restore()
+
+	state := testStepState(client)
+	state.Put("images", map[string]string{"ap-guangzhou": "img-1"})
+	step := &StepImageShare{Accounts: []string{"100"}}
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatal("should have halted")
+	}
+	if err := state.Get("error").(error); !strings.Contains(err.Error(), "is not shared with account '100'") {
+		t.Fatalf("bad error: %s", err)
+	}
+}
@@ -0,0 +1,67 @@
+package tencloud
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/3van/tencloud-go"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+type StepImageTags struct {
+	Tags TagMap
+}
+
+func (step *StepImageTags) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	if !step.Tags.IsSet() {
+		return multistep.ActionContinue
+	}
+
+	tc := state.Get("tc").(*tcapi.Client)
+	ui := state.Get("ui").(packer.Ui)
+	images := state.Get("images").(map[string]string)
+
+	uin, err := ownerUin(state)
+	if err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	regions := make([]string, 0, len(images))
+	for region := range images {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+
+	ui.Say("tagging images")
+	errs := new(packer.MultiError)
+	for _, region := range regions {
+		imageId := images[region]
+		ui.Message(fmt.Sprintf("tagging image '%s' in region '%s'", imageId, region))
+		err := tagResources(tc, &tagResourcesRequest{
+			ResourceList: []string{
+				resourceName(region, uin, "image", imageId),
+			},
+			Tags: step.Tags.tcTags(),
+		})
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("could not tag image '%s' in region '%s': %s", imageId, region, err))
+		}
+	}
+
+	if len(errs.Errors) > 0 {
+		state.Put("error", errs)
+		ui.Error(errs.Error())
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+func (step *StepImageTags) Cleanup(_ multistep.StateBag) {
+	return
+}
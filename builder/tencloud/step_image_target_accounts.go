@@ -0,0 +1,139 @@
+package tencloud
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/3van/tencloud-go"
+
+	"github.com/hashicorp/packer/common/uuid"
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// importURLExpiry is how long the signed export URL handed to an import
+// stays valid, leaving time for the import to be queued
+const importURLExpiry = 24 * time.Hour
+
+type StepImageTargetAccounts struct {
+	Accounts     []ImageTargetAccount
+	ImageName    string
+	OsType       string
+	OsVersion    string
+	Architecture string
+}
+
+func (step *StepImageTargetAccounts) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	if len(step.Accounts) == 0 {
+		return multistep.ActionContinue
+	}
+
+	tc := state.Get("tc").(*tcapi.Client)
+	ui := state.Get("ui").(packer.Ui)
+	exports := state.Get("exports").(map[string]string)
+
+	accountImages := make(map[string]string)
+	errs := new(packer.MultiError)
+	for _, target := range step.Accounts {
+		ui.Say(fmt.Sprintf("delivering image copies to account '%s'", target.AccountId))
+		for _, region := range target.Regions {
+			imageId, err := step.deliver(ctx, state, tc, target, region, exports[region])
+			if err != nil {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("could not deliver image to account '%s' in region '%s': %s", target.AccountId, region, err))
+				continue
+			}
+			accountImages[accountImageKey(target.AccountId, region)] = imageId
+			ui.Message(fmt.Sprintf("account '%s' owns image '%s' in region '%s'", target.AccountId, imageId, region))
+		}
+	}
+
+	state.Put("account_images", accountImages)
+
+	if len(errs.Errors) > 0 {
+		state.Put("error", errs)
+		ui.Error(errs.Error())
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+// deliver imports the exported image at url into the target account's
+// region, returning the ID of the image that account now owns.
+func (step *StepImageTargetAccounts) deliver(ctx context.Context, state multistep.StateBag, tc *tcapi.Client, target ImageTargetAccount, region, url string) (string, error) {
+	if url == "" {
+		return "", fmt.Errorf("no image export found in region '%s'", region)
+	}
+
+	roleClient, token, err := assumeRole(tc, target.RoleArn, region)
+	if err != nil {
+		return "", fmt.Errorf("could not assume role '%s': %s", target.RoleArn, err)
+	}
+
+	// the import doesn't report the new image's ID, so the image is tagged
+	// to be found by
+	importId := uuid.TimeOrderedUUID()
+	config := state.Get("config").(Config)
+	tags := config.ResourceTags()
+	tags[ImportTag] = importId
+
+	// the export is private to this account, so the target account is
+	// handed a URL signed with this account's credentials to read it
+	signed, err := cosPresign(tc, "GET", url, time.Now().Add(-time.Minute), importURLExpiry)
+	if err != nil {
+		return "", fmt.Errorf("could not sign export URL: %s", err)
+	}
+	err = importImage(roleClient, token, &importImageRequest{
+		Architecture:     step.Architecture,
+		OsType:           step.OsType,
+		OsVersion:        step.OsVersion,
+		ImageUrl:         signed,
+		ImageName:        step.ImageName,
+		TagSpecification: tags.tagSpecification("image"),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// record the copy as soon as it shows up, so it's removed along with
+	// the build's other images if the build fails or is killed while the
+	// import is still running
+	stateChange := StateChangeConf{
+		Pending:   []string{"IMPORTING", "CREATING"},
+		Target:    "NORMAL",
+		Refresh:   ImportedImageRefreshFunc(roleClient, token, importId),
+		StepState: state,
+		Context:   ctx,
+	}
+	image, err := WaitForExists(&stateChange)
+	if err != nil {
+		return "", fmt.Errorf("error waiting for import to start: %s", err)
+	}
+	imageId := image.(tcapi.Image).ImageId
+	state.Get("created_images").(*CreatedImages).AddAccountImage(target.AccountId, target.RoleArn, region, imageId)
+
+	if _, err := WaitForState(&stateChange); err != nil {
+		return "", fmt.Errorf("error waiting for import of image '%s': %s", imageId, err)
+	}
+
+	return imageId, nil
+}
+
+func (step *StepImageTargetAccounts) Cleanup(state multistep.StateBag) {
+	_, cancelled := state.GetOk(multistep.StateCancelled)
+	_, halted := state.GetOk(multistep.StateHalted)
+	if !cancelled && !halted {
+		return
+	}
+
+	ui := state.Get("ui").(packer.Ui)
+	created := state.Get("created_images").(*CreatedImages)
+	if err := created.RollbackAccounts(state); err != nil {
+		ui.Error(fmt.Sprintf("could not delete all image copies in target accounts, remove these manually: %s", err))
+	}
+}
+
+func accountImageKey(account, region string) string {
+	return fmt.Sprintf("%s/%s", account, region)
+}
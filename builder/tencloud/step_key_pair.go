@@ -1,9 +1,11 @@
 package tencloud
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
 	"runtime"
 
@@ -11,6 +13,7 @@ import (
 	retry "github.com/hashicorp/packer/common"
 	"github.com/hashicorp/packer/helper/multistep"
 	"github.com/hashicorp/packer/packer"
+	"golang.org/x/crypto/ssh"
 )
 
 type StepKeyPair struct {
@@ -19,6 +22,9 @@ type StepKeyPair struct {
 	TemporaryKeyPairName string
 	KeyPairName          string
 	PrivateKeyFile       string
+	PrivateKeyPassphrase string
+	KeyPairType          string
+	KeyPairBits          int
 
 	doCleanup bool
 }
@@ -26,7 +32,31 @@ type StepKeyPair struct {
 func (step *StepKeyPair) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
 	ui := state.Get("ui").(packer.Ui)
 
-	if step.PrivateKeyFile != "" {
+	// a key pair the user owns is only looked up, it's never deleted
+	if step.KeyPairName != "" {
+		tc := state.Get("tc").(*tcapi.Client)
+		keyID, err := keyPairIdNamed(tc, step.KeyPairName)
+		if err != nil {
+			state.Put("error", fmt.Errorf("could not find key pair '%s': %s", step.KeyPairName, err))
+			return multistep.ActionHalt
+		}
+		ui.Say(fmt.Sprintf("using key pair '%s' (ID '%s')", step.KeyPairName, keyID))
+		state.Put("keyPair", step.KeyPairName)
+		state.Put("keyID", keyID)
+
+		if step.PrivateKeyFile != "" {
+			privateKey, err := ioutil.ReadFile(step.PrivateKeyFile)
+			if err != nil {
+				state.Put("error", fmt.Errorf("could not load private key for SSH: %s", err))
+				return multistep.ActionHalt
+			}
+			state.Put("privateKey", string(privateKey))
+		}
+
+		return multistep.ActionContinue
+	}
+
+	if step.PrivateKeyFile != "" && step.TemporaryKeyPairName == "" {
 		ui.Say("using provided private key for SSH")
 		privateKey, err := ioutil.ReadFile(step.PrivateKeyFile)
 		if err != nil {
@@ -44,24 +74,80 @@ func (step *StepKeyPair) Run(ctx context.Context, state multistep.StateBag) mult
 		return multistep.ActionContinue
 	}
 
+	// private keys never leave the build host, only the public key is
+	// imported
+	var privateKey, publicKey string
+	if step.PrivateKeyFile != "" {
+		ui.Say("using provided private key for SSH")
+		contents, err := ioutil.ReadFile(step.PrivateKeyFile)
+		if err != nil {
+			state.Put("error", fmt.Errorf("could not load private key for SSH: %s", err))
+			return multistep.ActionHalt
+		}
+		privateKey = string(contents)
+		publicKey, err = publicKeyOf(contents, step.PrivateKeyPassphrase)
+		if err != nil {
+			state.Put("error", fmt.Errorf("could not derive public key from private key: %s", err))
+			return multistep.ActionHalt
+		}
+	} else {
+		ui.Say(fmt.Sprintf("generating %s key pair", step.KeyPairType))
+		var err error
+		privateKey, publicKey, err = generateKeyPair(step.KeyPairType, step.KeyPairBits)
+		if err != nil {
+			state.Put("error", err)
+			return multistep.ActionHalt
+		}
+	}
+
 	tc := state.Get("tc").(*tcapi.Client)
 	config := state.Get("config").(Config)
 
+	// a public key can only be registered once, so a key pair that already
+	// holds the provided key is used as it is and left in place
+	if step.PrivateKeyFile != "" {
+		existing, err := keyPairWithPublicKey(tc, publicKey)
+		if err != nil {
+			state.Put("error", fmt.Errorf("could not look for key pairs holding the provided key: %s", err))
+			return multistep.ActionHalt
+		}
+		if existing != nil {
+			ui.Say(fmt.Sprintf("using key pair '%s' (ID '%s'), which already holds the provided key", existing.KeyName, existing.KeyId))
+			state.Put("keyPair", existing.KeyName)
+			state.Put("privateKey", privateKey)
+			state.Put("keyID", existing.KeyId)
+			return multistep.ActionContinue
+		}
+	}
+
 	created := false
-	var keyID, privateKey string
-	err := retry.Retry(0.2, 30, 11, func(_ uint) (bool, error) {
-		ui.Say(fmt.Sprintf("creating temporary keypair '%s'", step.TemporaryKeyPairName))
-		resp, err := tc.CreateKeyPair(&tcapi.CreateKeyPairRequest{
+	var keyID string
+	err := retry.Retry(0.2, 30, 11, func(i uint) (bool, error) {
+		// ImportKeyPair takes no idempotency token and key names are unique,
+		// so a key pair made by an attempt we never heard back from is
+		// removed before trying again
+		if i > 0 {
+			if err := step.deleteOrphanKeyPair(tc); err != nil {
+				ui.Error(fmt.Sprintf("error removing key pair left by a failed attempt: %s", err))
+				return false, nil
+			}
+		}
+
+		ui.Say(fmt.Sprintf("importing temporary keypair '%s'", step.TemporaryKeyPairName))
+		resp, err := tc.ImportKeyPair(&tcapi.ImportKeyPairRequest{
 			KeyName:   step.TemporaryKeyPairName,
 			ProjectId: config.Project,
+			PublicKey: publicKey,
 		})
 		if err != nil {
 			ui.Error(fmt.Sprintf("error creating temporary key pair: %s", err))
+			if !isRetryable(err) {
+				return false, err
+			}
 			return false, nil
 		}
 		created = true
-		keyID = resp.KeyPair.KeyId
-		privateKey = resp.KeyPair.PrivateKey
+		keyID = resp.KeyId
 		return true, nil
 	})
 
@@ -71,12 +157,17 @@ func (step *StepKeyPair) Run(ctx context.Context, state multistep.StateBag) mult
 	}
 
 	step.doCleanup = true
+	state.Get("journal").(*Journal).Created(journalKeyPair, config.Region, keyID)
+
+	if err := tagRunResources(state, "cvm", "keypair", keyID); err != nil {
+		ui.Error(fmt.Sprintf("could not tag temporary keypair '%s': %s", step.TemporaryKeyPairName, err))
+	}
 
 	state.Put("keyPair", step.TemporaryKeyPairName)
 	state.Put("privateKey", privateKey)
 	state.Put("keyID", keyID)
 
-	if step.Debug {
+	if step.Debug && step.PrivateKeyFile == "" {
 		ui.Message(fmt.Sprintf("saving private key for '%s' to '%s'", step.TemporaryKeyPairName, step.DebugKeyPath))
 		fh, err := os.Create(step.DebugKeyPath)
 		if err != nil {
@@ -99,6 +190,100 @@ func (step *StepKeyPair) Run(ctx context.Context, state multistep.StateBag) mult
 	return multistep.ActionContinue
 }
 
+// keyPairIdNamed returns the ID of the key pair named keyName
+func keyPairIdNamed(tc *tcapi.Client, keyName string) (string, error) {
+	resp, err := tc.DescribeKeyPairs(&tcapi.DescribeKeyPairsRequest{
+		Filters: []tcapi.Filter{
+			{
+				Name: "key-name",
+				Values: []string{
+					keyName,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	// the filter matches names containing keyName too
+	for _, keyPair := range resp.KeyPairSet {
+		if keyPair.KeyName == keyName {
+			return keyPair.KeyId, nil
+		}
+	}
+	return "", fmt.Errorf("no key pair named '%s' in region '%s'", keyName, tc.Region)
+}
+
+// keyPairWithPublicKey returns the key pair holding publicKey, or nil if
+// there's none
+func keyPairWithPublicKey(tc *tcapi.Client, publicKey string) (*tcapi.KeyPair, error) {
+	req := &tcapi.DescribeKeyPairsRequest{
+		Limit: 100,
+	}
+	for {
+		resp, err := tc.DescribeKeyPairs(req)
+		if err != nil {
+			return nil, err
+		}
+		for i, keyPair := range resp.KeyPairSet {
+			if sameAuthorizedKey(keyPair.PublicKey, publicKey) {
+				return &resp.KeyPairSet[i], nil
+			}
+		}
+		if len(resp.KeyPairSet) == 0 || req.Offset+req.Limit >= resp.TotalCount {
+			return nil, nil
+		}
+		req.Offset += req.Limit
+	}
+}
+
+// sameAuthorizedKey reports whether two public keys in authorized_keys
+// format are the same key, whatever their comments
+func sameAuthorizedKey(a, b string) bool {
+	keyA, _, _, _, err := ssh.ParseAuthorizedKey([]byte(a))
+	if err != nil {
+		return false
+	}
+	keyB, _, _, _, err := ssh.ParseAuthorizedKey([]byte(b))
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(keyA.Marshal(), keyB.Marshal())
+}
+
+// deleteOrphanKeyPair deletes the temporary key pair if an earlier attempt
+// created it after all
+func (step *StepKeyPair) deleteOrphanKeyPair(tc *tcapi.Client) error {
+	resp, err := tc.DescribeKeyPairs(&tcapi.DescribeKeyPairsRequest{
+		Filters: []tcapi.Filter{
+			{
+				Name: "key-name",
+				Values: []string{
+					step.TemporaryKeyPairName,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	for _, keyPair := range resp.KeyPairSet {
+		if keyPair.KeyName != step.TemporaryKeyPairName {
+			continue
+		}
+		log.Printf("deleting key pair '%s' (ID '%s') left by a failed attempt", keyPair.KeyName, keyPair.KeyId)
+		err := tc.DeleteKeyPairs(&tcapi.DeleteKeyPairsRequest{
+			KeyIds: []string{
+				keyPair.KeyId,
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (step *StepKeyPair) Cleanup(state multistep.StateBag) {
 	if !step.doCleanup {
 		return
@@ -106,6 +291,8 @@ func (step *StepKeyPair) Cleanup(state multistep.StateBag) {
 
 	tc := state.Get("tc").(*tcapi.Client)
 	ui := state.Get("ui").(packer.Ui)
+	config := state.Get("config").(Config)
+	journal := state.Get("journal").(*Journal)
 	keyId := state.Get("keyID").(string)
 
 	if keyId != "" {
@@ -120,6 +307,7 @@ func (step *StepKeyPair) Cleanup(state multistep.StateBag) {
 				ui.Error(fmt.Sprintf("could not disassociate key from instance: %s", err))
 				return false, nil
 			}
+			journal.Deleted(journalKeyPair, config.Region, keyId)
 			state.Put("keyID", "")
 			return true, nil
 		})
@@ -128,7 +316,7 @@ func (step *StepKeyPair) Cleanup(state multistep.StateBag) {
 		}
 	}
 
-	if step.Debug {
+	if step.Debug && step.PrivateKeyFile == "" {
 		if err := os.Remove(step.DebugKeyPath); err != nil {
 			ui.Error(fmt.Sprintf("could not remove private key from disk: %s", err))
 		}
@@ -0,0 +1,78 @@
+package tencloud
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// StepResume takes over what's left of a failed build in place of the steps
+// it had completed: its stopped instance and key pair, which are removed at
+// the end like the build's own would be, and the images it had finished.
+type StepResume struct {
+	Point *ResumePoint
+
+	instance *StepRunInstance
+	keyPair  *StepKeyPair
+}
+
+func (step *StepResume) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	created := state.Get("created_images").(*CreatedImages)
+	point := step.Point
+
+	switch point.Stage {
+	case resumeImageCopy:
+		ui.Say(fmt.Sprintf("resuming build '%s' at copying its image to other regions", point.BuildUUID))
+	default:
+		ui.Say(fmt.Sprintf("resuming build '%s' at creating its image", point.BuildUUID))
+	}
+
+	if point.KeyId != "" {
+		ui.Message(fmt.Sprintf("taking over keypair '%s' (ID '%s')", point.KeyName, point.KeyId))
+		state.Put("keyID", point.KeyId)
+		step.keyPair = &StepKeyPair{
+			TemporaryKeyPairName: point.KeyName,
+			doCleanup:            true,
+		}
+	}
+
+	if point.Instance != nil {
+		ui.Message(fmt.Sprintf("taking over instance '%s' (%s)", point.Instance.InstanceId, point.Instance.InstanceState))
+		state.Put("instance", *point.Instance)
+		step.instance = &StepRunInstance{
+			InstanceName: point.Instance.InstanceName,
+			instanceId:   point.Instance.InstanceId,
+		}
+	}
+
+	if len(point.Images) > 0 {
+		regions := make([]string, 0, len(point.Images))
+		for region := range point.Images {
+			regions = append(regions, region)
+		}
+		sort.Strings(regions)
+
+		images := make(map[string]string)
+		for _, region := range regions {
+			ui.Message(fmt.Sprintf("taking over image '%s' in region '%s'", point.Images[region], region))
+			images[region] = point.Images[region]
+			created.Add(region, point.Images[region])
+		}
+		state.Put("images", images)
+	}
+
+	return multistep.ActionContinue
+}
+
+func (step *StepResume) Cleanup(state multistep.StateBag) {
+	if step.instance != nil {
+		step.instance.Cleanup(state)
+	}
+	if step.keyPair != nil {
+		step.keyPair.Cleanup(state)
+	}
+}
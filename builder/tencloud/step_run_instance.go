@@ -7,13 +7,12 @@ import (
 	"io/ioutil"
 	"log"
 	"strconv"
-	"strings"
 
 	"github.com/3van/tencloud-go"
 	retry "github.com/hashicorp/packer/common"
-	"github.com/hashicorp/packer/common/uuid"
 	"github.com/hashicorp/packer/helper/multistep"
 	"github.com/hashicorp/packer/packer"
+	"golang.org/x/crypto/ssh"
 )
 
 type StepRunInstance struct {
@@ -29,12 +28,13 @@ type StepRunInstance struct {
 	InternetChargeType      string           `mapstructure:"internet_charge_type"`
 	InternetMaxBandwidthOut string           `mapstructure:"internet_max_bandwidth_out"`
 	PublicIpAssigned        bool             `mapstructure:"public_ip_assigned"`
-	SecurityGroupIds        []string         `mapstructure:"security_group_ids"`
 	UserData                string           `mapstructure:"user_data"`
 	UserDataFile            string           `mapstructure:"user_data_file"`
+	WinRMBootstrap          bool             `mapstructure:"winrm_bootstrap"`
+	HostKeyCheck            string           `mapstructure:"ssh_host_key_check"`
+	InstanceName            string           `mapstructure:"instance_name"`
 
-	instanceId   string
-	instanceName string
+	instanceId string
 }
 
 func (step *StepRunInstance) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
@@ -46,6 +46,11 @@ func (step *StepRunInstance) Run(ctx context.Context, state multistep.StateBag)
 		keyID = tempID.(string)
 	}
 
+	var securityGroupIds []string
+	if ids, ok := state.GetOk("securityGroupIds"); ok {
+		securityGroupIds = ids.([]string)
+	}
+
 	image, ok := state.Get("source_image").(tcapi.Image)
 	if !ok {
 		state.Put("error", fmt.Errorf("source_image failed type assert"))
@@ -62,16 +67,26 @@ func (step *StepRunInstance) Run(ctx context.Context, state multistep.StateBag)
 		}
 		userData = string(contents)
 	}
+	if step.WinRMBootstrap {
+		userData = winrmBootstrapUserData
+	}
+	if step.HostKeyCheck == hostKeyCheckStrict {
+		var hostKey ssh.PublicKey
+		var err error
+		userData, hostKey, err = hostKeyUserData(userData)
+		if err != nil {
+			state.Put("error", err)
+			return multistep.ActionHalt
+		}
+		ui.Message(fmt.Sprintf("pinning host key %s", ssh.FingerprintSHA256(hostKey)))
+		state.Put("hostKey", hostKey)
+	}
 	if _, err := base64.StdEncoding.DecodeString(userData); err != nil {
 		log.Printf("base64 encoding userdata")
 		userData = base64.StdEncoding.EncodeToString([]byte(userData))
 	}
 
 	ui.Say("launching source instance")
-	step.instanceName = fmt.Sprintf("packer_%s", uuid.TimeOrderedUUID())
-	step.instanceName = strings.Replace(step.instanceName, "-", "", -1)
-	step.instanceName = step.instanceName[:24]
-
 	intDiskSize, err := strconv.Atoi(step.SystemDiskSize)
 	if err != nil {
 		state.Put("error", fmt.Errorf("could not convert system_disk_size to int: %s", err))
@@ -83,39 +98,82 @@ func (step *StepRunInstance) Run(ctx context.Context, state multistep.StateBag)
 		return multistep.ActionHalt
 	}
 
-	req := &tcapi.RunInstancesRequest{
-		Placement: tcapi.Placement{
-			Zone:      step.AvailabilityZone,
-			ProjectId: config.Project,
-		},
-		ImageId:            imageID,
-		InstanceChargeType: step.InstanceChargeType,
-		InstanceType:       step.InstanceType,
-		SystemDisk: tcapi.SystemDisk{
-			DiskType: step.SystemDiskType,
-			DiskSize: intDiskSize,
-		},
-		VirtualPrivateCloud: tcapi.VirtualPrivateCloud{
-			VpcId:    step.VpcId,
-			SubnetId: step.SubnetId,
-		},
-		InternetAccessible: tcapi.InternetAccessible{
-			InternetChargeType:      step.InternetChargeType,
-			InternetMaxBandwidthOut: intMaxBandwidth,
-			PublicIpAssigned:        strconv.FormatBool(step.PublicIpAssigned),
-		},
-		InstanceCount: 1,
-		InstanceName:  step.instanceName,
-		LoginSettings: tcapi.LoginSettings{
-			KeyIds: []string{
-				keyID,
+	// instances without a key pair are logged into with a password, which
+	// windows instances always are
+	var loginSettings tcapi.LoginSettings
+	var password string
+	switch {
+	case config.Comm.Type == "winrm":
+		password = config.Comm.WinRMPassword
+	case keyID != "":
+		loginSettings.KeyIds = []string{
+			keyID,
+		}
+	default:
+		password = config.Comm.SSHPassword
+	}
+	if loginSettings.KeyIds == nil {
+		if password == "" {
+			password, err = instancePassword()
+			if err != nil {
+				state.Put("error", err)
+				return multistep.ActionHalt
+			}
+			ui.Message("generated a login password for the instance")
+		}
+		state.Put("password", password)
+		loginSettings.Password = password
+	}
+
+	// the instance is tagged as it launches, so the janitor can tell it's
+	// this build's even if the build is killed while it boots
+	req := &runInstancesRequest{
+		RunInstancesRequest: tcapi.RunInstancesRequest{
+			Placement: tcapi.Placement{
+				Zone:      step.AvailabilityZone,
+				ProjectId: config.Project,
+			},
+			ImageId:            imageID,
+			InstanceChargeType: step.InstanceChargeType,
+			InstanceType:       step.InstanceType,
+			SystemDisk: tcapi.SystemDisk{
+				DiskType: step.SystemDiskType,
+				DiskSize: intDiskSize,
 			},
+			VirtualPrivateCloud: tcapi.VirtualPrivateCloud{
+				VpcId:    step.VpcId,
+				SubnetId: step.SubnetId,
+			},
+			InternetAccessible: tcapi.InternetAccessible{
+				InternetChargeType:      step.InternetChargeType,
+				InternetMaxBandwidthOut: intMaxBandwidth,
+				PublicIpAssigned:        strconv.FormatBool(step.PublicIpAssigned),
+			},
+			InstanceCount:    1,
+			InstanceName:     step.InstanceName,
+			LoginSettings:    loginSettings,
+			SecurityGroupIds: securityGroupIds,
+			UserData:         userData,
+			ClientToken:      clientToken(config.BuildUUID(), "run-instances"),
 		},
-		SecurityGroupIds: step.SecurityGroupIds,
-		UserData:         userData,
+		TagSpecification: config.ResourceTags().tagSpecification("instance"),
 	}
 
-	resp, err := tc.RunInstances(req)
+	// the client token makes retries of a launch that succeeded without us
+	// hearing back return the same instance
+	var resp *tcapi.RunInstancesResponse
+	err = retry.Retry(0.2, 30, 11, func(_ uint) (bool, error) {
+		resp, err = runInstances(tc, req)
+		err = redactPassword(err, password)
+		if err != nil {
+			ui.Error(fmt.Sprintf("error launching source instance: %s", err))
+			if !isRetryable(err) {
+				return false, err
+			}
+			return false, nil
+		}
+		return true, nil
+	})
 	if err != nil {
 		state.Put("error", fmt.Errorf("error launching source instance: %s", err))
 		return multistep.ActionHalt
@@ -125,9 +183,10 @@ func (step *StepRunInstance) Run(ctx context.Context, state multistep.StateBag)
 		return multistep.ActionHalt
 	}
 	step.instanceId = resp.InstanceIdSet[0]
+	state.Get("journal").(*Journal).Created(journalInstance, config.Region, step.instanceId)
 
 	ui.Message(fmt.Sprintf("spawned instance ID: %s", step.instanceId))
-	ui.Message(fmt.Sprintf("spawned instance name: %s", step.instanceName))
+	ui.Message(fmt.Sprintf("spawned instance name: %s", step.InstanceName))
 	ui.Say(fmt.Sprintf("waiting for instance '%s' to become ready...", step.instanceId))
 
 	stateChange := StateChangeConf{
@@ -135,6 +194,8 @@ func (step *StepRunInstance) Run(ctx context.Context, state multistep.StateBag)
 		Target:    "RUNNING",
 		Refresh:   InstanceStateRefreshFunc(tc, step.instanceId),
 		StepState: state,
+		Context:   ctx,
+		Timeout:   config.InstanceReadyTimeout,
 	}
 
 	if _, err := WaitForState(&stateChange); err != nil {
@@ -153,6 +214,15 @@ func (step *StepRunInstance) Run(ctx context.Context, state multistep.StateBag)
 	}
 
 	instance := describeResp.InstanceSet[0]
+
+	// the system disk has no resource type to be tagged at launch with, and
+	// goes with the instance anyway, so failing to tag it doesn't fail the
+	// build
+	if instance.SystemDisk.DiskId != "" {
+		if err := tagRunResources(state, "cbs", "disk", instance.SystemDisk.DiskId); err != nil {
+			ui.Error(fmt.Sprintf("could not tag system disk '%s' of instance '%s': %s", instance.SystemDisk.DiskId, step.instanceId, err))
+		}
+	}
 	if instance.PrivateIpAddresses != nil && len(instance.PrivateIpAddresses) > 0 {
 		ui.Message(fmt.Sprintf("Private IP: %s", instance.PrivateIpAddresses[0]))
 	}
@@ -211,16 +281,21 @@ func (step *StepRunInstance) Cleanup(state multistep.StateBag) {
 
 		ui.Say(fmt.Sprintf("waiting for instance '%s' to cease existence...", step.instanceId))
 
+		// no StepState here, the wait has to carry on when the build was
+		// cancelled
+		config := state.Get("config").(Config)
 		stateChange := StateChangeConf{
-			Pending:   []string{"TERMINATING"},
-			Target:    "TERMINATED",
-			Refresh:   InstanceStateRefreshFunc(tc, step.instanceId),
-			StepState: state,
+			Pending: []string{"TERMINATING"},
+			Target:  "TERMINATED",
+			Refresh: InstanceStateRefreshFunc(tc, step.instanceId),
+			Timeout: config.InstanceTerminateTimeout,
 		}
 
 		if _, err := WaitForDoesNotExist(&stateChange); err != nil {
 			ui.Error(fmt.Sprintf("error waiting for instance '%s' to cease existence: %s", step.instanceId, err))
+			return
 		}
+		state.Get("journal").(*Journal).Deleted(journalInstance, config.Region, step.instanceId)
 	}
 	return
 }
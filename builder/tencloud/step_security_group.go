@@ -0,0 +1,221 @@
+package tencloud
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/3van/tencloud-go"
+	retry "github.com/hashicorp/packer/common"
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// publicIPURL answers with the public IP address requests come from
+var publicIPURL = "https://api.ipify.org"
+
+// StepSecurityGroup creates a temporary security group letting the
+// communicator in from SourceCidrs, unless SecurityGroupIds are given. If
+// there are no SourceCidrs it lets in the VPC when Private is set, as the
+// communicator connects to the private IP then, and the build host's public
+// IP otherwise. It puts the groups to launch the instance in as
+// "securityGroupIds".
+type StepSecurityGroup struct {
+	SecurityGroupIds           []string
+	TemporarySecurityGroupName string
+	SourceCidrs                []string
+	Port                       int
+	Private                    bool
+	VpcId                      string
+	SubnetId                   string
+
+	securityGroupId string
+}
+
+func (step *StepSecurityGroup) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	if len(step.SecurityGroupIds) > 0 {
+		state.Put("securityGroupIds", step.SecurityGroupIds)
+		return multistep.ActionContinue
+	}
+
+	tc := state.Get("tc").(*tcapi.Client)
+	ui := state.Get("ui").(packer.Ui)
+	config := state.Get("config").(Config)
+
+	sourceCidrs := step.SourceCidrs
+	if len(sourceCidrs) == 0 && step.Private {
+		cidr, err := vpcCidr(tc, step.VpcId, step.SubnetId)
+		if err != nil {
+			state.Put("error", fmt.Errorf("could not look up the vpc's cidr, set temporary_security_group_source_cidrs: %s", err))
+			return multistep.ActionHalt
+		}
+		sourceCidrs = []string{cidr}
+	} else if len(sourceCidrs) == 0 {
+		ip, err := detectPublicIP()
+		if err != nil {
+			state.Put("error", fmt.Errorf("could not detect the build host's public ip, set temporary_security_group_source_cidrs: %s", err))
+			return multistep.ActionHalt
+		}
+		ui.Message(fmt.Sprintf("detected build host public ip: %s", ip))
+		if ip.To4() != nil {
+			sourceCidrs = []string{ip.String() + "/32"}
+		} else {
+			sourceCidrs = []string{ip.String() + "/128"}
+		}
+	}
+
+	// CreateSecurityGroup takes no idempotency token, so it isn't retried in
+	// case an attempt we never heard back from did create one
+	ui.Say(fmt.Sprintf("creating temporary security group '%s'", step.TemporarySecurityGroupName))
+	resp, err := createSecurityGroup(tc, &createSecurityGroupRequest{
+		GroupName:        step.TemporarySecurityGroupName,
+		GroupDescription: "temporary group for packer build " + config.BuildUUID(),
+		ProjectId:        config.Project,
+	})
+	if err != nil {
+		state.Put("error", fmt.Errorf("could not create temporary security group: %s", err))
+		return multistep.ActionHalt
+	}
+	step.securityGroupId = resp.SecurityGroup.SecurityGroupId
+	state.Get("journal").(*Journal).Created(journalSecurityGroup, config.Region, step.securityGroupId)
+
+	if err := tagRunResources(state, "cvm", "sg", step.securityGroupId); err != nil {
+		ui.Error(fmt.Sprintf("could not tag temporary security group '%s': %s", step.securityGroupId, err))
+	}
+
+	policies := make([]securityGroupPolicy, 0, len(sourceCidrs))
+	for _, cidr := range sourceCidrs {
+		policy := securityGroupPolicy{
+			Protocol:          "TCP",
+			Port:              strconv.Itoa(step.Port),
+			Action:            "ACCEPT",
+			PolicyDescription: "packer communicator",
+		}
+		if strings.Contains(cidr, ":") {
+			policy.Ipv6CidrBlock = cidr
+		} else {
+			policy.CidrBlock = cidr
+		}
+		policies = append(policies, policy)
+	}
+	ui.Message(fmt.Sprintf("allowing port %d from %s", step.Port, strings.Join(sourceCidrs, ", ")))
+	err = retry.Retry(0.2, 30, 11, func(_ uint) (bool, error) {
+		err := createSecurityGroupPolicies(tc, &createSecurityGroupPoliciesRequest{
+			SecurityGroupId: step.securityGroupId,
+			SecurityGroupPolicySet: securityGroupPolicySet{
+				Ingress: policies,
+				// groups made through the API have no rules at all, so
+				// provisioners need outbound access allowed explicitly
+				Egress: []securityGroupPolicy{
+					{
+						Protocol:          "ALL",
+						Port:              "ALL",
+						CidrBlock:         "0.0.0.0/0",
+						Action:            "ACCEPT",
+						PolicyDescription: "packer outbound",
+					},
+				},
+			},
+		})
+		if err != nil {
+			ui.Error(fmt.Sprintf("error adding rules to temporary security group: %s", err))
+			if !isRetryable(err) {
+				return false, err
+			}
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		state.Put("error", fmt.Errorf("could not add rules to temporary security group '%s': %s", step.securityGroupId, err))
+		return multistep.ActionHalt
+	}
+
+	state.Put("securityGroupIds", []string{step.securityGroupId})
+	return multistep.ActionContinue
+}
+
+func (step *StepSecurityGroup) Cleanup(state multistep.StateBag) {
+	if step.securityGroupId == "" {
+		return
+	}
+
+	tc := state.Get("tc").(*tcapi.Client)
+	ui := state.Get("ui").(packer.Ui)
+	config := state.Get("config").(Config)
+
+	// the group is in use until the instance is fully gone, which can be a
+	// while after it's reported terminated
+	ui.Say(fmt.Sprintf("removing temporary security group '%s'", step.securityGroupId))
+	err := retry.Retry(5, 30, 20, func(_ uint) (bool, error) {
+		err := deleteSecurityGroup(tc, &deleteSecurityGroupRequest{
+			SecurityGroupId: step.securityGroupId,
+		})
+		if err != nil && !isNotFound(err) {
+			log.Printf("could not delete security group '%s', retrying: %s", step.securityGroupId, err)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		ui.Error(fmt.Sprintf("could not delete temporary security group '%s': %s", step.securityGroupId, err))
+		return
+	}
+	state.Get("journal").(*Journal).Deleted(journalSecurityGroup, config.Region, step.securityGroupId)
+}
+
+// vpcCidr returns the CIDR block of the VPC, or of the subnet's VPC if
+// vpcId isn't set
+func vpcCidr(tc *tcapi.Client, vpcId, subnetId string) (string, error) {
+	if vpcId == "" {
+		resp, err := describeSubnets(tc, &describeSubnetsRequest{
+			SubnetIds: []string{subnetId},
+		})
+		if err != nil {
+			return "", err
+		}
+		if len(resp.SubnetSet) == 0 {
+			return "", fmt.Errorf("subnet not found: %s", subnetId)
+		}
+		vpcId = resp.SubnetSet[0].VpcId
+	}
+	resp, err := describeVpcs(tc, &describeVpcsRequest{
+		VpcIds: []string{vpcId},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(resp.VpcSet) == 0 {
+		return "", fmt.Errorf("vpc not found: %s", vpcId)
+	}
+	return resp.VpcSet[0].CidrBlock, nil
+}
+
+// detectPublicIP asks publicIPURL for the address the build host's
+// requests come from
+func detectPublicIP() (net.IP, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(publicIPURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s", publicIPURL, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return nil, fmt.Errorf("%s answered with no ip address", publicIPURL)
+	}
+	return ip, nil
+}
@@ -0,0 +1,31 @@
+package tencloud
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDetectPublicIP(t *testing.T) {
+	answer := "203.0.113.5\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, answer)
+	}))
+	defer server.Close()
+	defer func(url string) { publicIPURL = url }(publicIPURL)
+	publicIPURL = server.URL
+
+	ip, err := detectPublicIP()
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if ip.String() != "203.0.113.5" {
+		t.Fatalf("bad ip: %s", ip)
+	}
+
+	answer = "<html>blocked</html>"
+	if _, err := detectPublicIP(); err == nil {
+		t.Fatal("should have errored on an answer that isn't an ip")
+	}
+}
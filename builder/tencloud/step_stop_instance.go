@@ -18,6 +18,7 @@ type StepStopInstance struct {
 }
 
 func (step *StepStopInstance) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(Config)
 	tc := state.Get("tc").(*tcapi.Client)
 	instance := state.Get("instance").(tcapi.Instance)
 	ui := state.Get("ui").(packer.Ui)
@@ -26,7 +27,10 @@ func (step *StepStopInstance) Run(ctx context.Context, state multistep.StateBag)
 		return multistep.ActionContinue
 	}
 
-	if !step.DisableStopInstance {
+	_, guestShutdown := state.GetOk("guest_shutdown")
+	if guestShutdown {
+		ui.Say("waiting for the instance to shut itself down")
+	} else if !step.DisableStopInstance {
 		ui.Say("stopping source instance")
 		err := common.Retry(10, 60, 6, func(i uint) (bool, error) {
 			ui.Message(fmt.Sprintf("stopping instance '%s', attempt %d", instance.InstanceId, i+1))
@@ -53,6 +57,8 @@ func (step *StepStopInstance) Run(ctx context.Context, state multistep.StateBag)
 		Target:    "STOPPED",
 		Refresh:   InstanceStateRefreshFunc(tc, instance.InstanceId),
 		StepState: state,
+		Context:   ctx,
+		Timeout:   config.InstanceStopTimeout,
 	}
 
 	if _, err := WaitForState(&stateChange); err != nil {
@@ -60,7 +66,8 @@ func (step *StepStopInstance) Run(ctx context.Context, state multistep.StateBag)
 		return multistep.ActionHalt
 	}
 
-	if tempKeyID, ok := state.GetOk("keyID"); ok {
+	// a key pair the user owns stays associated
+	if tempKeyID, ok := state.GetOk("keyID"); ok && config.SSHKeyPairName == "" {
 		keyID := tempKeyID.(string)
 		if keyID != "" {
 			err := retry.Retry(0.2, 30, 11, func(_ uint) (bool, error) {
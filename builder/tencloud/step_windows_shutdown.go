@@ -0,0 +1,53 @@
+package tencloud
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+const (
+	windowsShutdownCommand = `shutdown /s /t 5 /f /d p:4:1 /c "Packer Shutdown"`
+	windowsSysprepCommand  = `C:\Windows\System32\Sysprep\sysprep.exe /generalize /oobe /quiet /shutdown /mode:vm`
+)
+
+// StepWindowsShutdown shuts a Windows instance down from the inside, so
+// pending updates are finished, generalizing it with sysprep first if
+// Sysprep is set. StepStopInstance then only waits for it to stop.
+type StepWindowsShutdown struct {
+	Sysprep bool
+}
+
+func (step *StepWindowsShutdown) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	comm := state.Get("communicator").(packer.Communicator)
+	ui := state.Get("ui").(packer.Ui)
+
+	command := windowsShutdownCommand
+	if step.Sysprep {
+		ui.Say("generalizing instance with sysprep, it shuts down when done")
+		command = windowsSysprepCommand
+	} else {
+		ui.Say("shutting down windows instance")
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := &packer.RemoteCmd{
+		Command: command,
+		Stdout:  &stdout,
+		Stderr:  &stderr,
+	}
+	if err := comm.Start(cmd); err != nil {
+		state.Put("error", fmt.Errorf("could not shut down instance: %s", err))
+		return multistep.ActionHalt
+	}
+	state.Put("guest_shutdown", true)
+
+	return multistep.ActionContinue
+}
+
+func (step *StepWindowsShutdown) Cleanup(_ multistep.StateBag) {
+	return
+}
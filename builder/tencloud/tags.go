@@ -1,12 +1,35 @@
 package tencloud
 
 import (
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"log"
+	"os"
+	"os/user"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/3van/tencloud-go"
+	"github.com/hashicorp/packer/helper/multistep"
+)
+
+// Build metadata tags put on every temporary resource of a build
+const (
+	BuildUUIDTag    = "packer-build-uuid"
+	BuildNameTag    = "packer-build-name"
+	TemplateHashTag = "packer-template-hash"
+	CreatorTag      = "packer-creator"
+	CreatedTag      = "packer-created"
+
+	// BuildStateTag marks the images of a build that hasn't finished, so
+	// ones left behind by a killed build can be told apart
+	BuildStateTag = "packer-build-state"
+
+	// ImportTag identifies the image an import into a target account makes,
+	// which the import doesn't report the ID of
+	ImportTag = "packer-import"
 )
 
 // TagMap is a helper type for a string=>string map
@@ -20,19 +43,163 @@ type TagFilterOptions struct {
 	MostRecent     bool              `mapstructure:"most_recent"`
 }
 
+// tcTags converts the TagMap to tag API tags, sorted by key
+// tagSpecification returns the tags for a resource of resourceType created
+// with them, or nil if there are none
+func (t TagMap) tagSpecification(resourceType string) []tagSpecification {
+	if !t.IsSet() {
+		return nil
+	}
+	tags := make([]cvmTag, 0, len(t))
+	for _, tag := range t.tcTags() {
+		tags = append(tags, cvmTag{Key: tag.TagKey, Value: tag.TagValue})
+	}
+	return []tagSpecification{
+		{ResourceType: resourceType, Tags: tags},
+	}
+}
+
+func (t TagMap) tcTags() []tag {
+	keys := make([]string, 0, len(t))
+	for k := range t {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	tags := make([]tag, 0, len(t))
+	for _, k := range keys {
+		tags = append(tags, tag{TagKey: k, TagValue: t[k]})
+	}
+	return tags
+}
+
 // IsSet determines if the TagMap is set or not
 func (t TagMap) IsSet() bool {
 	return len(t) > 0
 }
 
-// Flatten well... flattens the tag map with the supplied delimiter
+// descTagsVersion marks a description written by Flatten, as opposed to the
+// unversioned, unescaped ":k=v" format of older builds
+const descTagsVersion = "v1"
+
+// legacyDescTagsDelim is what builds older than tag_delimiter separated tags
+// with
+const legacyDescTagsDelim = ":"
+
+// Flatten encodes the tag map into an image description: the format version
+// followed by the tags sorted by key, all separated by delim. Backslashes,
+// "=" and any character of delim are escaped with a backslash.
 func (t TagMap) Flatten(delim string) string {
-	var res string
-	for k, v := range t {
-		res = fmt.Sprintf("%s:%s=%s", res, k, v)
+	keys := make([]string, 0, len(t))
+	for k := range t {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(t)+1)
+	parts = append(parts, descTagsVersion)
+	for _, k := range keys {
+		parts = append(parts, escapeDescTag(k, delim)+"="+escapeDescTag(t[k], delim))
 	}
 
-	return res
+	return strings.Join(parts, delim)
+}
+
+// ParseDescTags decodes tags written into an image description by Flatten.
+// Descriptions in the older unversioned format are still understood, split
+// on delim or, if that finds no tags, on ":", and parts that aren't tags are
+// ignored.
+func ParseDescTags(desc, delim string) TagMap {
+	tags := TagMap{}
+	if delim == "" {
+		return tags
+	}
+
+	parts := splitDescTags(desc, delim)
+	if len(parts) == 0 || parts[0] != descTagsVersion {
+		// older builds wrote "k=v" pairs without any escaping, separated by
+		// the configured delimiter, or ":" before it could be configured
+		tags = parseLegacyDescTags(desc, delim)
+		if len(tags) == 0 && delim != legacyDescTagsDelim {
+			tags = parseLegacyDescTags(desc, legacyDescTagsDelim)
+		}
+		return tags
+	}
+
+	for _, part := range parts[1:] {
+		k, v, ok := splitDescTag(part)
+		if !ok || k == "" {
+			continue
+		}
+		tags[k] = v
+	}
+	return tags
+}
+
+func parseLegacyDescTags(desc, delim string) TagMap {
+	tags := TagMap{}
+	for _, part := range strings.Split(desc, delim) {
+		p := strings.Split(part, "=")
+		if len(p) != 2 || p[0] == "" {
+			continue
+		}
+		tags[p[0]] = p[1]
+	}
+	return tags
+}
+
+func escapeDescTag(s, delim string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r == '\\' || r == '=' || strings.ContainsRune(delim, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// splitDescTags splits desc at every delim that isn't escaped, leaving the
+// escapes in place for splitDescTag
+func splitDescTags(desc, delim string) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(desc); {
+		switch {
+		case desc[i] == '\\':
+			i += 2
+		case strings.HasPrefix(desc[i:], delim):
+			parts = append(parts, desc[start:i])
+			i += len(delim)
+			start = i
+		default:
+			i++
+		}
+	}
+	return append(parts, desc[start:])
+}
+
+// splitDescTag splits an escaped "k=v" part at its unescaped "=" and removes
+// the escapes
+func splitDescTag(part string) (string, string, bool) {
+	var k, v strings.Builder
+	cur := &k
+	sep := false
+	for i := 0; i < len(part); i++ {
+		switch c := part[i]; {
+		case c == '\\' && i+1 < len(part):
+			i++
+			cur.WriteByte(part[i])
+		case c == '=' && !sep:
+			sep = true
+			cur = &v
+		case c == '=':
+			return "", "", false
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	return k.String(), v.String(), sep
 }
 
 // Empty determines if the TagFilterOptions is set or not
@@ -64,22 +231,7 @@ func (t TagFilterOptions) FindImage(client *tcapi.Client) (*tcapi.Image, error)
 			break
 		}
 
-		// if we have no tag filters to process, add images to list
-		if len(t.TagFilters) == 0 {
-			images = append(images, resp.ImageSet...)
-		} else {
-			for i := range resp.ImageSet {
-				// Process description tags
-				if resp.ImageSet[i].ImageDescription == "" {
-					continue
-				}
-
-				// if tags match, add to list
-				if t.matchImageDesc(resp.ImageSet[i].ImageDescription) {
-					images = append(images, resp.ImageSet[i])
-				}
-			}
-		}
+		images = append(images, resp.ImageSet...)
 
 		if resp.TotalCount > req.Limit {
 			req.Offset += req.Limit
@@ -89,6 +241,15 @@ func (t TagFilterOptions) FindImage(client *tcapi.Client) (*tcapi.Image, error)
 		}
 	}
 
+	// if we have tag filters to process, only keep images that match them
+	if len(t.TagFilters) > 0 {
+		var err error
+		images, err = t.filterTagged(client, images)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	log.Printf("Found %d images", len(images))
 
 	if len(images) == 0 {
@@ -96,7 +257,7 @@ func (t TagFilterOptions) FindImage(client *tcapi.Client) (*tcapi.Image, error)
 	}
 
 	if len(images) == 1 {
-		log.Printf("Using ImageID: %s", &images[0].ImageId)
+		log.Printf("Using ImageID: %s", images[0].ImageId)
 		return &images[0], nil
 	}
 
@@ -140,23 +301,7 @@ func (t TagFilterOptions) tcFilters() []tcapi.Filter {
 }
 
 func (t TagFilterOptions) matchImageDesc(iDesc string) bool {
-	// First, convert image description to map, checking length along the way.
-	iTags := map[string]string{}
-	parts := strings.Split(iDesc, t.TagFilterDelim)
-	if len(parts) == 0 {
-		return false
-	}
-	for i := range parts {
-		if parts[i] == "" {
-			continue
-		}
-		p := strings.Split(parts[i], "=")
-		if len(p) != 2 {
-			continue
-		}
-		iTags[p[0]] = p[1]
-	}
-
+	iTags := ParseDescTags(iDesc, t.TagFilterDelim)
 	if len(iTags) == 0 {
 		return false
 	}
@@ -171,3 +316,203 @@ func (t TagFilterOptions) matchImageDesc(iDesc string) bool {
 
 	return true
 }
+
+// filterTagged keeps the images that carry all of the tag filters, either
+// encoded in their description or as resource tags. Only private images that
+// don't match by description are looked up in the tag API, and if that fails
+// the description matches are used alone.
+func (t TagFilterOptions) filterTagged(client *tcapi.Client, images []tcapi.Image) ([]tcapi.Image, error) {
+	matched := make([]tcapi.Image, 0, len(images))
+	lookup := make([]tcapi.Image, 0, len(images))
+	for _, image := range images {
+		switch {
+		case t.matchImageDesc(image.ImageDescription):
+			matched = append(matched, image)
+		case image.ImageType == "PRIVATE_IMAGE":
+			lookup = append(lookup, image)
+		}
+	}
+	if len(lookup) == 0 {
+		return matched, nil
+	}
+
+	imageIds := make([]string, 0, len(lookup))
+	for _, image := range lookup {
+		imageIds = append(imageIds, image.ImageId)
+	}
+	resourceTags, err := imageResourceTags(client, imageIds)
+	if err != nil {
+		if len(matched) == 0 {
+			return nil, err
+		}
+		log.Printf("could not look up image tags, using the %d images matching by description: %s", len(matched), err)
+		return matched, nil
+	}
+	for _, image := range lookup {
+		if t.matchTags(resourceTags[image.ImageId]) {
+			matched = append(matched, image)
+		}
+	}
+
+	return matched, nil
+}
+
+func (t TagFilterOptions) matchTags(tags map[string]string) bool {
+	if len(tags) == 0 {
+		return false
+	}
+	for k, v := range t.TagFilters {
+		if w, ok := tags[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+// imageResourceTags returns the resource tags of the given images in the
+// client's region, keyed by image ID
+func imageResourceTags(client *tcapi.Client, imageIds []string) (map[string]map[string]string, error) {
+	return resourceTags(client, "cvm", "image", imageIds)
+}
+
+// resourceTags returns the tag API tags of the given resources in the
+// client's region, keyed by resource ID
+func resourceTags(client *tcapi.Client, service, resourcePrefix string, ids []string) (map[string]map[string]string, error) {
+	tags := make(map[string]map[string]string)
+	for start := 0; start < len(ids); start += 50 {
+		end := start + 50
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		for offset := 0; ; offset += 100 {
+			resp, err := describeResourceTagsByResourceIds(client, &describeResourceTagsByResourceIdsRequest{
+				ServiceType:    service,
+				ResourcePrefix: resourcePrefix,
+				ResourceIds:    ids[start:end],
+				ResourceRegion: client.Region,
+				Offset:         offset,
+				Limit:          100,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("could not list %s tags: %s", resourcePrefix, err)
+			}
+			for _, tag := range resp.Tags {
+				if tags[tag.ResourceId] == nil {
+					tags[tag.ResourceId] = make(map[string]string)
+				}
+				tags[tag.ResourceId][tag.TagKey] = tag.TagValue
+			}
+			if len(resp.Tags) == 0 || offset+100 >= resp.TotalCount {
+				break
+			}
+		}
+	}
+
+	return tags, nil
+}
+
+// resourceName returns the six-segment name the tag API identifies a CVM
+// resource by
+func resourceName(region, ownerUin, resourcePrefix, id string) string {
+	return serviceResourceName("cvm", region, ownerUin, resourcePrefix, id)
+}
+
+// serviceResourceName is resourceName for resources of services other than
+// cvm, such as cbs disks
+func serviceResourceName(service, region, ownerUin, resourcePrefix, id string) string {
+	return fmt.Sprintf("qcs::%s:%s:uin/%s:%s/%s", service, region, ownerUin, resourcePrefix, id)
+}
+
+// buildMetadataTags returns the tags identifying a build: its UUID and name,
+// a hash of its builder configuration, who ran it and when
+func buildMetadataTags(buildUUID, buildName string, raw interface{}) TagMap {
+	tags := TagMap{
+		BuildUUIDTag: buildUUID,
+		CreatedTag:   time.Now().UTC().Format(time.RFC3339),
+	}
+	if buildName != "" {
+		tags[BuildNameTag] = buildName
+	}
+	if hash := templateHash(raw); hash != "" {
+		tags[TemplateHashTag] = hash
+	}
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		tags[CreatorTag] = u.Username
+	} else if name := os.Getenv("USER"); name != "" {
+		tags[CreatorTag] = name
+	}
+	return tags
+}
+
+// templateHashIgnored are the keys of the builder configuration that change
+// between runs of the same template, and so aren't part of its hash
+var templateHashIgnored = []string{
+	"resume",
+	"resume_build_uuid",
+	"cleanup_journal",
+	"disable_cleanup_journal",
+}
+
+// templateHash hashes the builder configuration, leaving out the keys that
+// are set per run and packer's own packer_* settings
+func templateHash(raw interface{}) string {
+	if m, ok := raw.(map[string]interface{}); ok {
+		filtered := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			if strings.HasPrefix(k, "packer_") || stringInSlice(k, templateHashIgnored) {
+				continue
+			}
+			filtered[k] = v
+		}
+		raw = filtered
+	}
+	if raw == nil {
+		return ""
+	}
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
+
+// tagRunResources puts the configured resource tags on temporary resources
+// of the build region
+func tagRunResources(state multistep.StateBag, service, resourcePrefix string, ids ...string) error {
+	tc := state.Get("tc").(*tcapi.Client)
+	config := state.Get("config").(Config)
+	tags := config.ResourceTags()
+	if !tags.IsSet() || len(ids) == 0 {
+		return nil
+	}
+
+	uin, err := ownerUin(state)
+	if err != nil {
+		return err
+	}
+	resources := make([]string, 0, len(ids))
+	for _, id := range ids {
+		resources = append(resources, serviceResourceName(service, config.Region, uin, resourcePrefix, id))
+	}
+	return tagResources(tc, &tagResourcesRequest{
+		ResourceList: resources,
+		Tags:         tags.tcTags(),
+	})
+}
+
+// ownerUin returns the UIN of the account owning the builder's resources,
+// looking it up once per build
+func ownerUin(state multistep.StateBag) (string, error) {
+	if uin, ok := state.GetOk("owner_uin"); ok {
+		return uin.(string), nil
+	}
+
+	tc := state.Get("tc").(*tcapi.Client)
+	resp, err := getUserAppId(tc)
+	if err != nil {
+		return "", fmt.Errorf("could not look up account owner: %s", err)
+	}
+	state.Put("owner_uin", resp.OwnerUin)
+	return resp.OwnerUin, nil
+}
@@ -0,0 +1,172 @@
+package tencloud
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/3van/go-querystring/query"
+	"github.com/3van/tencloud-go"
+)
+
+func TestTagMapFlatten_sorted(t *testing.T) {
+	tags := TagMap{
+		"os":      "centos",
+		"app":     "web",
+		"version": "1.2",
+	}
+
+	expected := "v1:app=web:os=centos:version=1.2"
+	for i := 0; i < 10; i++ {
+		if got := tags.Flatten(":"); got != expected {
+			t.Fatalf("bad: %q, expected %q", got, expected)
+		}
+	}
+
+	if got := tags.Flatten(";"); got != "v1;app=web;os=centos;version=1.2" {
+		t.Fatalf("delimiter not used: %q", got)
+	}
+}
+
+func TestTagMapFlatten_escaped(t *testing.T) {
+	tags := TagMap{
+		"url":  "http://host:80/a=b",
+		"path": `C:\temp`,
+		"a:b":  "",
+	}
+
+	desc := tags.Flatten(":")
+	if expected := `v1:a\:b=:path=C\:\\temp:url=http\://host\:80/a\=b`; desc != expected {
+		t.Fatalf("bad: %q, expected %q", desc, expected)
+	}
+
+	for _, delim := range []string{":", ",", "::", "|-"} {
+		got := ParseDescTags(tags.Flatten(delim), delim)
+		if !reflect.DeepEqual(got, tags) {
+			t.Fatalf("delimiter %q: bad round trip: %#v", delim, got)
+		}
+	}
+}
+
+func TestParseDescTags_legacy(t *testing.T) {
+	got := ParseDescTags(":os=centos:app=web:junk", ":")
+	expected := TagMap{
+		"os":  "centos",
+		"app": "web",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("bad: %#v", got)
+	}
+
+	if got := ParseDescTags("just a description", ":"); len(got) != 0 {
+		t.Fatalf("bad: %#v", got)
+	}
+
+	// older builds used the configured delimiter, falling back to ":"
+	// for builds from before it could be configured
+	for _, desc := range []string{"|os=centos|app=web|junk", ":os=centos:app=web:junk"} {
+		if got := ParseDescTags(desc, "|"); !reflect.DeepEqual(got, expected) {
+			t.Fatalf("%q: bad: %#v", desc, got)
+		}
+	}
+	if got := ParseDescTags("|os=centos:7|app=web", "|"); !reflect.DeepEqual(got, TagMap{"os": "centos:7", "app": "web"}) {
+		t.Fatalf("bad: %#v", got)
+	}
+}
+
+func TestTagFilterOptions_matchImageDesc(t *testing.T) {
+	filter := TagFilterOptions{
+		TagFilters: map[string]string{
+			"url": "http://host:80",
+		},
+		TagFilterDelim: ":",
+	}
+
+	if !filter.matchImageDesc(TagMap{"url": "http://host:80", "os": "centos"}.Flatten(":")) {
+		t.Fatal("should match encoded tags")
+	}
+	if filter.matchImageDesc(TagMap{"url": "http://other:80"}.Flatten(":")) {
+		t.Fatal("should not match")
+	}
+
+	filter.TagFilters = map[string]string{"os": "centos"}
+	if !filter.matchImageDesc(":os=centos:app=web") {
+		t.Fatal("should match legacy tags")
+	}
+}
+
+func TestTagFilterOptions_filterTagged(t *testing.T) {
+	filter := TagFilterOptions{
+		TagFilters:     map[string]string{"app": "web"},
+		TagFilterDelim: ":",
+	}
+	images := []tcapi.Image{
+		{ImageId: "img-desc", ImageType: "PRIVATE_IMAGE", ImageDescription: TagMap{"app": "web"}.Flatten(":")},
+		{ImageId: "img-tagged", ImageType: "PRIVATE_IMAGE"},
+		{ImageId: "img-other", ImageType: "PRIVATE_IMAGE"},
+		{ImageId: "img-public", ImageType: "PUBLIC_IMAGE"},
+	}
+
+	var looked []string
+	tagAPI := func(params url.Values) (interface{}, error) {
+		looked = append(looked, paramList(params, "ResourceIds")...)
+		return &describeResourceTagsByResourceIdsResponse{
+			Tags: []resourceTag{{TagKey: "app", TagValue: "web", ResourceId: "img-tagged"}},
+		}, nil
+	}
+	_, tc, restore := useFakeAPI(map[string]func(url.Values) (interface{}, error){
+		"DescribeResourceTagsByResourceIds": tagAPI,
+	})
+	matched, err := filter.filterTagged(tc, images)
+	restore()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(matched) != 2 || matched[0].ImageId != "img-desc" || matched[1].ImageId != "img-tagged" {
+		t.Fatalf("bad: %#v", matched)
+	}
+	// images matching by description and public images aren't looked up
+	if strings.Join(looked, ",") != "img-tagged,img-other" {
+		t.Fatalf("looked up %v", looked)
+	}
+
+	// without tag permissions, the description matches still do
+	_, tc, restore = useFakeAPI(nil)
+	defer restore()
+	matched, err = filter.filterTagged(tc, images)
+	if err != nil || len(matched) != 1 || matched[0].ImageId != "img-desc" {
+		t.Fatalf("bad: %#v, %v", matched, err)
+	}
+	if _, err := filter.filterTagged(tc, images[1:]); err == nil {
+		t.Fatal("should have errored without any match")
+	}
+}
+
+func TestTagMap_tagSpecification(t *testing.T) {
+	req := &runInstancesRequest{
+		RunInstancesRequest: tcapi.RunInstancesRequest{InstanceName: "packer"},
+		TagSpecification:    TagMap{"app": "web", BuildUUIDTag: "0123"}.tagSpecification("instance"),
+	}
+	values, err := query.Values(req)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := url.Values{
+		"InstanceName":                    {"packer"},
+		"TagSpecification.0.ResourceType": {"instance"},
+		"TagSpecification.0.Tags.0.Key":   {"app"},
+		"TagSpecification.0.Tags.0.Value": {"web"},
+		"TagSpecification.0.Tags.1.Key":   {BuildUUIDTag},
+		"TagSpecification.0.Tags.1.Value": {"0123"},
+	}
+	for k, v := range expected {
+		if !reflect.DeepEqual(values[k], v) {
+			t.Fatalf("%s: got %v, expected %v in %v", k, values[k], v, values)
+		}
+	}
+
+	if specs := (TagMap{}).tagSpecification("instance"); specs != nil {
+		t.Fatalf("bad: %#v", specs)
+	}
+}
@@ -0,0 +1,34 @@
+package tencloud
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/packer/helper/communicator"
+	"github.com/hashicorp/packer/helper/multistep"
+)
+
+// winrmBootstrapUserData is the user_data that sets up WinRM over HTTPS with a
+// self-signed certificate and basic authentication, and opens port 5986.
+const winrmBootstrapUserData = `#ps1_sysnative
+Enable-PSRemoting -Force -SkipNetworkProfileCheck
+$cert = New-SelfSignedCertificate -DnsName $env:COMPUTERNAME -CertStoreLocation Cert:\LocalMachine\My
+Get-ChildItem WSMan:\localhost\Listener | Where-Object { $_.Keys -contains "Transport=HTTPS" } | Remove-Item -Recurse -Force
+New-Item -Path WSMan:\localhost\Listener -Transport HTTPS -Address * -CertificateThumbPrint $cert.Thumbprint -Force
+Set-Item WSMan:\localhost\Service\Auth\Basic -Value $true
+New-NetFirewallRule -DisplayName "WinRM HTTPS" -Direction Inbound -Protocol TCP -LocalPort 5986 -Action Allow
+Restart-Service WinRM
+`
+
+// WinRMConfig returns the credentials the instance was launched with
+func WinRMConfig(username string) func(multistep.StateBag) (*communicator.WinRMConfig, error) {
+	return func(state multistep.StateBag) (*communicator.WinRMConfig, error) {
+		password, ok := state.GetOk("password")
+		if !ok {
+			return nil, fmt.Errorf("no password was set for the instance")
+		}
+		return &communicator.WinRMConfig{
+			Username: username,
+			Password: password.(string),
+		}, nil
+	}
+}
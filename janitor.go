@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/3van/packer-builder-tencloud/builder/tencloud"
+	"github.com/3van/tencloud-go"
+	"github.com/hashicorp/packer/packer"
+)
+
+// janitor removes what killed builds left behind. It only reports unless
+// --apply is passed.
+func janitor(args []string) int {
+	flags := flag.NewFlagSet("janitor", flag.ContinueOnError)
+	keyID, key := authFlags(flags)
+	regions := flags.String("regions", os.Getenv("TENCENT_REGION"), "comma separated regions to scan, defaults to $TENCENT_REGION")
+	olderThan := flags.Duration("older-than", 24*time.Hour, "only consider resources created longer ago than this")
+	prefix := flags.String("prefix", "packer", "resource_name_prefix the builds used")
+	apply := flags.Bool("apply", false, "delete the resources found instead of only reporting them")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *regions == "" {
+		fmt.Fprintln(os.Stderr, "janitor: --regions must be specified")
+		return 2
+	}
+	config := tencloud.JanitorConfig{
+		Regions:   strings.Split(*regions, ","),
+		OlderThan: *olderThan,
+		Prefix:    *prefix,
+		Apply:     *apply,
+	}
+
+	tc, err := client(*keyID, *key, config.Regions[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "janitor: %s\n", err)
+		return 2
+	}
+
+	if err := tencloud.RunJanitor(tc, config, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "janitor: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// cleanupJournal removes what the builds in a cleanup journal left behind,
+// like the builder does itself before each build
+func cleanupJournal(args []string) int {
+	flags := flag.NewFlagSet("cleanup-journal", flag.ContinueOnError)
+	keyID, key := authFlags(flags)
+	path := flags.String("journal", tencloud.DefaultCleanupJournal, "path of the cleanup journal")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	tc, err := client(*keyID, *key, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cleanup-journal: %s\n", err)
+		return 2
+	}
+
+	ui := &packer.BasicUi{
+		Reader:      os.Stdin,
+		Writer:      os.Stdout,
+		ErrorWriter: os.Stderr,
+	}
+	if err := tencloud.ReplayJournal(tc, *path, ui, tencloud.ReplayOptions{}); err != nil {
+		fmt.Fprintf(os.Stderr, "cleanup-journal: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func authFlags(flags *flag.FlagSet) (*string, *string) {
+	keyID := flags.String("key-id", os.Getenv("TENCENT_API_KEY_ID"), "API key ID, defaults to $TENCENT_API_KEY_ID")
+	key := flags.String("key", os.Getenv("TENCENT_API_KEY"), "API key, defaults to $TENCENT_API_KEY")
+	return keyID, key
+}
+
+func client(keyID, key, region string) (*tcapi.Client, error) {
+	auth := tencloud.AuthConfig{
+		KeyID:  keyID,
+		Key:    key,
+		Region: region,
+	}
+	if errs := auth.Prepare(nil); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return auth.Client()
+}
@@ -1,11 +1,22 @@
 package main
 
 import (
+	"os"
+
 	"github.com/3van/packer-builder-tencloud/builder/tencloud"
 	"github.com/hashicorp/packer/packer/plugin"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "janitor":
+			os.Exit(janitor(os.Args[2:]))
+		case "cleanup-journal":
+			os.Exit(cleanupJournal(os.Args[2:]))
+		}
+	}
+
 	server, err := plugin.Server()
 	if err != nil {
 		panic(err)